@@ -0,0 +1,199 @@
+package api
+
+import (
+	"log"
+	"strconv"
+	"net/http"
+	"encoding/json"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/utils"
+	"OnlineQuizSystem/models"
+)
+
+
+/* ########################################## ACCOMMODATION MODEL FUNCTIONS ################################## */
+
+func CreateAccommodationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nCreateAccommodationHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var accommodation models.Accommodation
+	if err := json.NewDecoder(r.Body).Decode(&accommodation); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if accommodation.TimeMultiplier == 0 {
+		accommodation.TimeMultiplier = 1
+	}
+	if accommodation.TimeMultiplier < 1 || accommodation.ExtraSeconds < 0 {
+		http.Error(w, "time_multiplier must be at least 1 and extra_seconds can not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if !ownsAccommodationQuiz(r, user, accommodation.QuizEventID) {
+		http.Error(w, "Forbidden: accommodations can only be given for your own quiz events", http.StatusForbidden)
+		return
+	}
+
+	var student models.User
+	if err := db.DB.First(&student, accommodation.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := db.DB.Create(&accommodation).Error; err != nil {
+		http.Error(w, "Failed to create Accommodation: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(accommodation)
+}
+
+
+
+
+
+
+
+
+func RetrieveAccommodationListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveAccommodationListHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	query := db.DB
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var listAccommodation []models.Accommodation
+	if err := query.Find(&listAccommodation).Error; err != nil {
+		http.Error(w, "Could not fetch list of Accommodations", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(listAccommodation)
+}
+
+
+
+
+
+
+
+
+func RetrieveAccommodationDetailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveAccommodationDetailHandler handling request: ", r)
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var accommodation models.Accommodation
+	if err := db.DB.First(&accommodation, id).Error; err != nil {
+		http.Error(w, "Accommodation not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(accommodation)
+}
+
+
+
+
+
+
+
+func UpdateAccommodationPatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nUpdateAccommodationPatchHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	updates, ok := decodePatch(w, r, user, accommodationPatchSchema)
+	if !ok {
+		return
+	}
+	if value, ok := updates["quiz_event_id"]; ok {
+		var quizEventID *uint
+		if id, ok := value.(uint); ok {
+			quizEventID = &id
+		}
+		if !ownsAccommodationQuiz(r, user, quizEventID) {
+			http.Error(w, "Forbidden: accommodations can only be moved to your own quiz events", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := db.DB.Model(&models.Accommodation{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		http.Error(w, "Failed to update Accommodation", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Accommodation updated successfully"})
+}
+
+
+
+
+
+
+
+func SoftDeleteAccommodationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nSoftDeleteAccommodationHandler handling request: ", r)
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DB.Delete(&models.Accommodation{}, id).Error; err != nil {
+		http.Error(w, "Failed to delete Accommodation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Accommodation soft-deleted successfully"})
+}
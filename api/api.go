@@ -5,10 +5,10 @@ import (
 	// "io"
 	"log"
 	"fmt"
-	"time"
 	"strconv"
 	"strings"
 	"net/http"
+	"errors"
 	"encoding/json"
 
 	"OnlineQuizSystem/db"
@@ -16,15 +16,14 @@ import (
 	"OnlineQuizSystem/models"
 
 	"golang.org/x/crypto/bcrypt"
-	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
-	Role     string `json:"role"` // admin, teacher, student  
-	Otp      string `json:"otp"`
-	AdminKey string `json:"admin_key"`
+	Role     string `json:"role"` // teacher or student, admins need an invitation
+	InviteToken string `json:"invite_token"` // from an invite link, the invitation decides the role
 }
 
 type VerifyEmailRequest struct {
@@ -51,10 +50,26 @@ type ChangePassword struct {
 
 
 
-var newRegisterStore = make(map[string]RegisterRequest)
+// pendingRegistration is kept with the register OTP until the email is verified,
+// the password is hashed right away so it is never stored in clear text.
+type pendingRegistration struct {
+	Email        string `json:"email"`
+	PasswordHash string `json:"password_hash"`
+	Role         string `json:"role"`
+	InvitationID *uint  `json:"invitation_id"`
+}
 
 
-var passwordForgottenStore = make(map[string]ChangePassword)
+// otpErrorStatus maps the errors of utils.OTP to a response status.
+func otpErrorStatus(err error) int {
+	switch err {
+	case utils.ErrOTPInvalid, utils.ErrOTPExpired:
+		return http.StatusUnauthorized
+	case utils.ErrOTPTooManyAttempts, utils.ErrOTPCooldown:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
 
 
 
@@ -74,6 +89,18 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req.Role = strings.TrimSpace(strings.ToLower(req.Role))
+	req.Email = strings.TrimSpace(req.Email)
+
+	var invitationID *uint
+	if req.InviteToken != "" {
+		invitation, err := utils.FindInvitation(req.InviteToken, req.Email)
+		if err != nil {
+			http.Error(w, err.Error(), invitationErrorStatus(err))
+			return
+		}
+		req.Role = invitation.Role
+		invitationID = &invitation.ID
+	}
 
 	if ( req.Role != "admin") && (req.Role != "teacher") && (req.Role != "student") {
 		s := `Role of type '%s' is not valid. Only one of the three roles (admin, teacher & student) can be assigned to a user.`
@@ -81,16 +108,29 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return 
 	}
 
-	if ( req.Role == "admin" && req.AdminKey != os.Getenv("ADMIN_KEY")){
-		http.Error(w, "To become an Admin user, Contact the developer - Anurag", http.StatusForbidden)
+	if ( req.Role == "admin" && invitationID == nil ){
+		http.Error(w, "Admin accounts can only be created from an invitation, ask an existing admin for one.", http.StatusForbidden)
 		return
 	}
 
-	otp := fmt.Sprintf("%06d", time.Now().UnixNano()%1000000)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 
-	newRegisterStore[req.Email] = req
+	otp, err := utils.OTP.Issue(utils.OTPPurposeRegister, req.Email, pendingRegistration{
+		Email:        req.Email,
+		PasswordHash: string(hashedPassword),
+		Role:         req.Role,
+		InvitationID: invitationID,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), otpErrorStatus(err))
+		return
+	}
 
-	log.Printf("Sending OTP to %s: %s\n", req.Email, otp)
+	log.Printf("Sending OTP to %s\n", req.Email)
 	
 	if strings.ToLower(strings.TrimSpace(os.Getenv("SEND_OTP_FLAG"))) == "yes" {
 		err := utils.SendOtpEmail(req.Email, otp, "Your OTP for Email Verification from Online Quiz System")
@@ -124,51 +164,51 @@ func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("New register store: ", newRegisterStore)
-	var storedReq RegisterRequest
-	storedReq, exists := newRegisterStore[req.Email]
-	if !exists || req.OTP != storedReq.Otp {
-		http.Error(w, "Invalid OTP or Email", http.StatusUnauthorized)
-		return
-	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(storedReq.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	var storedReq pendingRegistration
+	if err := utils.OTP.Verify(utils.OTPPurposeRegister, req.Email, req.OTP, &storedReq); err != nil {
+		http.Error(w, err.Error(), otpErrorStatus(err))
 		return
 	}
 
 	user := models.User{
 		Email:    storedReq.Email,
-		Password: string(hashedPassword),
+		Password: storedReq.PasswordHash,
 		UserType: storedReq.Role,
 	}
 
-	if err := db.DB.Create(&user).Error; err != nil {
-		http.Error(w, "User already exists or DB error", http.StatusBadRequest)
-		return
-	}
+	// The account, the redeemed invitation and the audit entry of the role are saved together.
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if storedReq.InvitationID == nil {
+			return utils.RecordRoleChange(tx, user.ID, "", user.UserType, nil, utils.RoleSourceSelfRegistration, nil)
+		}
 
-	fmt.Println("user.ID: ", user.ID)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id" : user.ID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		if err := utils.RedeemInvitation(tx, *storedReq.InvitationID, user.ID); err != nil {
+			return err
+		}
+		var invitation models.Invitation
+		if err := tx.First(&invitation, *storedReq.InvitationID).Error; err != nil {
+			return err
+		}
+		if invitation.Department != nil {
+			if err := tx.Create(&models.UserDetails{UserID: user.ID, Department: invitation.Department}).Error; err != nil {
+				return err
+			}
+		}
+		return utils.RecordRoleChange(tx, user.ID, "", user.UserType, &invitation.InvitedByID, utils.RoleSourceInvitation, &invitation.ID)
 	})
-	// Remove below 2 lines
-	s := token.Claims.(jwt.MapClaims)
-	fmt.Println(s)
-
-	secret := os.Getenv("SECRET_KEY")
-	tokenString, err := token.SignedString([]byte(secret))
+	if errors.Is(err, utils.ErrInvitationUsed) {
+		http.Error(w, "The invitation has been used, revoked or has expired in the meantime", http.StatusGone)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		http.Error(w, "User already exists or DB error", http.StatusBadRequest)
 		return
 	}
 
-	delete(newRegisterStore, storedReq.Email)
-
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	completeLogin(w, r, &user, http.StatusCreated)
 }
 
 
@@ -192,31 +232,124 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if accountLocked(w, req.Email) {
+		return
+	}
+
+	// Unknown emails count as failures too, so the lockout does not tell which accounts exist.
 	var user models.User
 	if err := db.DB.Where("email = ?", strings.TrimSpace(req.Email)).First(&user).Error; err != nil {
+		utils.RecordLoginFailure(req.Email)
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		utils.RecordLoginFailure(req.Email)
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id" : user.ID,
-		"exp":   time.Now().Add(24 * time.Hour).Unix(),
-	})
+	if utils.IsServiceAccount(user.ID) {
+		http.Error(w, "Service accounts cannot log in, use an API key", http.StatusForbidden)
+		return
+	}
+
+	completeLogin(w, r, &user, http.StatusAccepted)
+}
+
+
+
+
+
+
+
+
 
-	secret := os.Getenv("SECRET_KEY")
-	tokenString, err := token.SignedString([]byte(secret))
+
+
+
+
+
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRefreshTokenHandler handling request: ", r)
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := utils.RefreshTokens(req.RefreshToken)
 	if err != nil {
-		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nLogoutHandler handling request: ", r)
+	_, session, _, err := utils.AuthorizeSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if session == nil {
+		http.Error(w, "API keys have no session to log out of, revoke the key instead", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.RevokeSession(session.ID); err != nil {
+		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+
+
+
+
+
+
+
+
+
+
+
+
+
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nLogoutAllHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := utils.RevokeAllSessions(user.ID); err != nil {
+		http.Error(w, "Logout failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out of all devices"})
 }
 
 
@@ -232,11 +365,11 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nForgotPasswordHandler handling request: ", r)
 	var req ForgotPassword
-	var fpCompleteReq ChangePassword
 	var user models.User
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid Body Value", http.StatusUnprocessableEntity)
+		return
 	}
 
 	req.Email = strings.TrimSpace(req.Email)
@@ -246,12 +379,13 @@ func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return 
 	}
 
-	otp := fmt.Sprintf("%06d", time.Now().UnixNano()%1000000)	
-	fpCompleteReq.Email = user.Email
-	fpCompleteReq.Otp = otp
-	passwordForgottenStore[user.Email] = fpCompleteReq
+	otp, err := utils.OTP.Issue(utils.OTPPurposeForgotPassword, user.Email, nil)
+	if err != nil {
+		http.Error(w, err.Error(), otpErrorStatus(err))
+		return
+	}
 
-	err := utils.SendOtpEmail(req.Email, otp, "Your OTP for forgot password identity verification from Online Quiz System")
+	err = utils.SendOtpEmail(req.Email, otp, "Your OTP for forgot password identity verification from Online Quiz System")
 	if err != nil {
 		log.Println("Failed to send OTP on email:", err)
 		http.Error(w, "Unable to send OTP", http.StatusForbidden)
@@ -280,6 +414,7 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid Body Value", http.StatusUnprocessableEntity)
+		return
 	}
 
 	req.Email = strings.TrimSpace(req.Email)
@@ -289,8 +424,8 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return 
 	}
 
-	if strings.TrimSpace(req.Otp) != strings.TrimSpace(passwordForgottenStore[user.Email].Otp) {
-		http.Error(w, "OTP did not match", http.StatusUnauthorized)
+	if err := utils.OTP.Verify(utils.OTPPurposeForgotPassword, user.Email, req.Otp, nil); err != nil {
+		http.Error(w, err.Error(), otpErrorStatus(err))
 		return 
 	}
 
@@ -306,6 +441,11 @@ func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return 
 	}
 
+	// Whoever knew the old password may still be logged in somewhere.
+	if err := utils.RevokeAllSessions(user.ID); err != nil {
+		log.Printf("Could not revoke sessions of user %d after password change: %v", user.ID, err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Password is successfully changed."})
 }
@@ -402,15 +542,11 @@ func RetrieveCurrentUserProfileHandler(w http.ResponseWriter, r *http.Request){
 
 func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nCreateUserHandler handling request: ", r)
-	user, _, err := utils.AuthorizeUser(r)
+	admin, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	if user.UserType != "admin" {
-		http.Error(w, "Unauthorized: Only admins can create users", http.StatusUnauthorized)
-		return
-	}
 
 	var newUser models.User
 	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
@@ -425,7 +561,13 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	newUser.Password = string(hashedPassword)
 
-	if err := db.DB.Create(&newUser).Error; err != nil {
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newUser).Error; err != nil {
+			return err
+		}
+		return utils.RecordRoleChange(tx, newUser.ID, "", newUser.UserType, &admin.ID, utils.RoleSourceUserCreate, nil)
+	})
+	if err != nil {
 		http.Error(w, "Failed to create user: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -443,14 +585,19 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func RetrieveUserListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nRetrieveUserListHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	query := db.DB
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		query = query.Where("id = ?", user.ID)
+	}
+
 	var users []models.User
-	if err := db.DB.Preload("UserDetails").Preload("QuizEvents").Preload("EventResults").Find(&users).Error; err != nil {
+	if err := query.Preload("UserDetails").Preload("QuizEvents").Preload("EventResults").Find(&users).Error; err != nil {
 		http.Error(w, "Could not fetch users", http.StatusInternalServerError)
 		return
 	}
@@ -497,7 +644,7 @@ func RetrieveUserDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 func UpdateUserPatchHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nUpdateUserPatchHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -510,15 +657,33 @@ func UpdateUserPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updates map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	updates, ok := decodePatch(w, r, user, userPatchSchema)
+	if !ok {
+		return
+	}
+
+	currentPassword, hasCurrentPassword := updates["current_password"].(string)
+	delete(updates, "current_password")
+	if _, ok := updates["password"]; !ok && hasCurrentPassword {
+		http.Error(w, "current_password is only used to change the password", http.StatusBadRequest)
 		return
 	}
 
 	// Do not allow password updates here without hashing
-	if password, ok := updates["password"]; ok {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password.(string)), bcrypt.DefaultCost)
+	if password, ok := updates["password"].(string); ok {
+		// A stolen access token alone must not be enough to take the account over. Admins
+		// resetting someone else's password do not know theirs.
+		if uint(id) == user.ID {
+			if !hasCurrentPassword {
+				http.Error(w, "current_password is required to change your password", http.StatusBadRequest)
+				return
+			}
+			if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)) != nil {
+				http.Error(w, "Current password is incorrect", http.StatusForbidden)
+				return
+			}
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
 			http.Error(w, "Error hashing password", http.StatusInternalServerError)
 			return
@@ -526,20 +691,34 @@ func UpdateUserPatchHandler(w http.ResponseWriter, r *http.Request) {
 		updates["password"] = string(hashedPassword)
 	}
 
-	if err := db.DB.Model(&models.User{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+	// A new role is saved together with its audit entry.
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var existing models.User
+		if err := tx.First(&existing, id).Error; err != nil {
+			return err
+		}
+		oldRole := existing.UserType
+		if err := tx.Model(&existing).Updates(updates).Error; err != nil {
+			return err
+		}
+		if newRole, ok := updates["user_type"].(string); ok && newRole != oldRole {
+			if err := utils.RecordRoleChange(tx, existing.ID, oldRole, newRole, &user.ID, utils.RoleSourceUserUpdate, nil); err != nil {
+				return err
+			}
+			// A demoted owner no longer holds keys for service accounts above their new role.
+			return utils.RevokeOwnerAPIKeys(tx, existing.ID, newRole)
+		}
+		return nil
+	})
+	if err != nil {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
 	}
 
-	if _, ok := updates["deleted_at"]; ok {
-		var user models.User
-		if err := db.DB.Unscoped().First(&user, id).Error; err != nil {
-			http.Error(w, "User not found (even among soft-deleted)", http.StatusNotFound)
-			return
-		}
-		if err := db.DB.Unscoped().Model(&user).Update("deleted_at", nil).Error; err != nil {
-			http.Error(w, "Failed to restore user", http.StatusInternalServerError)
-			return
+	// Same as the change password api, a new password ends every session.
+	if _, ok := updates["password"]; ok {
+		if err := utils.RevokeAllSessions(uint(id)); err != nil {
+			log.Printf("Could not revoke sessions of user %d after password change: %v", id, err)
 		}
 	}
 
@@ -567,7 +746,14 @@ func SoftDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := db.DB.Delete(&models.User{}, id).Error; err != nil {
+	// The keys of the user and of their service accounts go with them.
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := utils.RevokeOwnerAPIKeys(tx, uint(id), ""); err != nil {
+			return err
+		}
+		return tx.Delete(&models.User{}, id).Error
+	})
+	if err != nil {
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
@@ -637,23 +823,31 @@ func SoftDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func CreateUserDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nCreateUserDetailsHandler handling request: ", r)
-	user, _, err := utils.AuthorizeUser(r)
+	currentUser, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if user.UserType != "admin" {
-		http.Error(w, "Unauthorized: Only admins can create userDetails details", http.StatusUnauthorized)
-		return
-	}
-
 	var newUserDetails models.UserDetails
 	if err := json.NewDecoder(r.Body).Decode(&newUserDetails); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	// Users without the any scope can only create their own details.
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		newUserDetails.UserID = currentUser.ID
+	}
+
+	// Department heads send invitations into their department, so the fields the update api keeps
+	// to admins can not be set on create either.
+	if (newUserDetails.Department != nil && !userDetailsPatchSchema.Allows(currentUser.UserType, "department")) ||
+		(newUserDetails.DepartmentHead && !userDetailsPatchSchema.Allows(currentUser.UserType, "department_head")) {
+		http.Error(w, fmt.Sprintf("Forbidden: role '%s' can not set department or department_head", currentUser.UserType), http.StatusForbidden)
+		return
+	}
+
 	if newUserDetails.UserID != 0 {
 		var user models.User
 		result := db.DB.First(&user, newUserDetails.UserID)
@@ -686,14 +880,19 @@ func CreateUserDetailsHandler(w http.ResponseWriter, r *http.Request) {
 
 func RetrieveUserDetailsListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nRetrieveUserDetailsListHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	query := db.DB
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		query = query.Where("user_id = ?", user.ID)
+	}
+
 	var listUserDetails []models.UserDetails
-	if err := db.DB.Find(&listUserDetails).Error; err != nil {
+	if err := query.Find(&listUserDetails).Error; err != nil {
 		http.Error(w, "Could not fetch list of userDetails", http.StatusInternalServerError)
 		return
 	}
@@ -740,7 +939,7 @@ func RetrieveUserDetailsDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 func UpdateUserDetailsPatchHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nUpdateUserDetailsPatchHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -753,9 +952,8 @@ func UpdateUserDetailsPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updates map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	updates, ok := decodePatch(w, r, user, userDetailsPatchSchema)
+	if !ok {
 		return
 	}
 
@@ -764,18 +962,6 @@ func UpdateUserDetailsPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := updates["deleted_at"]; ok {
-		var userDetail models.UserDetails
-		if err := db.DB.Unscoped().First(&userDetail, id).Error; err != nil {
-			http.Error(w, "userDetail not found (even among soft-deleted)", http.StatusNotFound)
-			return
-		}
-		if err := db.DB.Unscoped().Model(&userDetail).Update("deleted_at", nil).Error; err != nil {
-			http.Error(w, "Failed to restore userDetails", http.StatusInternalServerError)
-			return
-		}
-	}
-
 	json.NewEncoder(w).Encode(map[string]string{"message": "userDetails updated successfully"})
 }
 
@@ -875,11 +1061,6 @@ func CreateQuizEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.UserType != "admin" && user.UserType != "teacher" {
-		http.Error(w, "Unauthorized: Only admins & teachers can create QuizEvent", http.StatusUnauthorized)
-		return
-	}
-
 	var reqBody map[string]any
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -919,14 +1100,23 @@ func CreateQuizEventHandler(w http.ResponseWriter, r *http.Request) {
 
 func RetrieveQuizEventListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nRetrieveQuizEventListHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	query := db.DB.Preload("EventResult")
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		// Own quiz events and the ones taken part in, with only the caller's result of the latter.
+		owned := db.DB.Model(&models.QuizEvent{}).Select("id").Where("user_id = ?", user.ID)
+		joined := db.DB.Model(&models.EventResult{}).Select("quiz_event_id").Where("user_id = ?", user.ID)
+		query = db.DB.Preload("EventResult", "user_id = ? OR quiz_event_id IN (?)", user.ID, owned).
+			Where("user_id = ? OR id IN (?)", user.ID, joined)
+	}
+
 	var listQuizEvent []models.QuizEvent
-	if err := db.DB.Preload("EventResult").Find(&listQuizEvent).Error; err != nil {
+	if err := query.Find(&listQuizEvent).Error; err != nil {
 		http.Error(w, "Could not fetch list of QuizEvents", http.StatusInternalServerError)
 		return
 	}
@@ -973,7 +1163,7 @@ func RetrieveQuizEventDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 func UpdateQuizEventPatchHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nUpdateQuizEventPatchHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -986,9 +1176,8 @@ func UpdateQuizEventPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updates map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	updates, ok := decodePatch(w, r, user, quizEventPatchSchema)
+	if !ok {
 		return
 	}
 
@@ -997,18 +1186,6 @@ func UpdateQuizEventPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := updates["deleted_at"]; ok {
-		var quizEvent models.QuizEvent
-		if err := db.DB.Unscoped().First(&quizEvent, id).Error; err != nil {
-			http.Error(w, "QuizEvent not found (even among soft-deleted)", http.StatusNotFound)
-			return
-		}
-		if err := db.DB.Unscoped().Model(&quizEvent).Update("deleted_at", nil).Error; err != nil {
-			http.Error(w, "Failed to restore QuizEvent", http.StatusInternalServerError)
-			return
-		}
-	}
-
 	json.NewEncoder(w).Encode(map[string]string{"message": "QuizEvent updated successfully"})
 }
 
@@ -1111,15 +1288,19 @@ func CreateEventResultHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.UserType != "admin" && user.UserType != "teacher" {
-		http.Error(w, "Unauthorized: Only admins & teachers can create EventResult", http.StatusUnauthorized)
-		return
-	}
-
-
 	var eventResult models.EventResult
 	if err := json.NewDecoder(r.Body).Decode(&eventResult); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Teachers can only add results to their own quiz events.
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		var quizEvent models.QuizEvent
+		if err := db.DB.First(&quizEvent, eventResult.QuizEventID).Error; err != nil || quizEvent.UserID != user.ID {
+			http.Error(w, "Forbidden: you do not own this quiz event", http.StatusForbidden)
+			return
+		}
 	}
 	
 	if err := db.DB.Create(&eventResult).Error; err != nil {
@@ -1140,14 +1321,21 @@ func CreateEventResultHandler(w http.ResponseWriter, r *http.Request) {
 
 func RetrieveEventResultListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nRetrieveEventResultListHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	// Students see their own results, teachers also the results of their quiz events.
+	query := db.DB
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		ownQuizEvents := db.DB.Model(&models.QuizEvent{}).Select("id").Where("user_id = ?", user.ID)
+		query = query.Where("user_id = ? OR quiz_event_id IN (?)", user.ID, ownQuizEvents)
+	}
+
 	var listEventResult []models.EventResult
-	if err := db.DB.Preload("QuizEvent").Find(&listEventResult).Error; err != nil {
+	if err := query.Preload("QuizEvent").Find(&listEventResult).Error; err != nil {
 		http.Error(w, "Could not fetch list of EventResults", http.StatusInternalServerError)
 		return
 	}
@@ -1194,7 +1382,7 @@ func RetrieveEventResultDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 func UpdateEventResultPatchHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("\n\nUpdateEventResultPatchHandler handling request: ", r)
-	_, _, err := utils.AuthorizeUser(r)
+	user, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -1207,9 +1395,8 @@ func UpdateEventResultPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updates map[string]any
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	updates, ok := decodePatch(w, r, user, eventResultPatchSchema)
+	if !ok {
 		return
 	}
 
@@ -1218,18 +1405,6 @@ func UpdateEventResultPatchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := updates["deleted_at"]; ok {
-		var eventResult models.EventResult
-		if err := db.DB.Unscoped().First(&eventResult, id).Error; err != nil {
-			http.Error(w, "EventResult not found (even among soft-deleted)", http.StatusNotFound)
-			return
-		}
-		if err := db.DB.Unscoped().Model(&eventResult).Update("deleted_at", nil).Error; err != nil {
-			http.Error(w, "Failed to restore EventResult", http.StatusInternalServerError)
-			return
-		}
-	}
-
 	json.NewEncoder(w).Encode(map[string]string{"message": "EventResult updated successfully"})
 }
 
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+)
+
+type ServiceAccountRequest struct {
+	Name        string  `json:"name"`
+	Role        string  `json:"role"`
+	Description *string `json:"description"`
+}
+
+type APIKeyRequest struct {
+	Name          string             `json:"name"`
+	Scopes        []utils.Permission `json:"scopes"`
+	UserID        uint               `json:"user_id"` // a service account of the caller, the caller when 0
+	ExpiresInDays int                `json:"expires_in_days"`
+}
+
+// CreateServiceAccountHandler lets admins add service accounts of any role, teachers (own scope)
+// can only add teacher and student accounts, which they then manage the keys of.
+func CreateServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nCreateServiceAccountHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req ServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Service account name is required", http.StatusBadRequest)
+		return
+	}
+	req.Role = strings.TrimSpace(strings.ToLower(req.Role))
+	if req.Role != "admin" && req.Role != "teacher" && req.Role != "student" {
+		http.Error(w, fmt.Sprintf("Role of type '%s' is not valid.", req.Role), http.StatusPreconditionFailed)
+		return
+	}
+	if utils.RequestScope(r) == utils.ScopeOwn && req.Role == "admin" {
+		http.Error(w, "Forbidden: only admins can create admin service accounts", http.StatusForbidden)
+		return
+	}
+
+	account, err := utils.CreateServiceAccount(user.ID, req.Name, req.Role, req.Description)
+	if err != nil {
+		http.Error(w, "Failed to create service account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(account)
+}
+
+func RetrieveServiceAccountListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveServiceAccountListHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	query := db.DB.Preload("User").Order("id desc")
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		query = query.Where("owner_id = ?", user.ID)
+	}
+
+	var accounts []models.ServiceAccount
+	if err := query.Find(&accounts).Error; err != nil {
+		http.Error(w, "Could not fetch service accounts", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// DeleteServiceAccountHandler revokes all keys of the service account and deletes its user.
+func DeleteServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nDeleteServiceAccountHandler handling request: ", r)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var account models.ServiceAccount
+	if err := db.DB.First(&account, id).Error; err != nil {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return
+	}
+
+	if err := utils.RevokeUserAPIKeys(account.UserID); err != nil {
+		http.Error(w, "Could not revoke the service account's keys", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.Delete(&account).Error; err != nil {
+		http.Error(w, "Could not delete service account", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.Delete(&models.User{}, account.UserID).Error; err != nil {
+		http.Error(w, "Could not delete service account", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Service account deleted successfully"})
+}
+
+// CreateAPIKeyHandler issues a key for the caller or one of their service accounts (any service
+// account for admins). The key is shown only in this response.
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nCreateAPIKeyHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "API key name is required", http.StatusBadRequest)
+		return
+	}
+
+	keyUser := user
+	if req.UserID != 0 && req.UserID != user.ID {
+		var account models.ServiceAccount
+		if err := db.DB.Preload("User").Where("user_id = ?", req.UserID).First(&account).Error; err != nil {
+			http.Error(w, "Service account not found, API keys can only be issued for yourself or a service account", http.StatusNotFound)
+			return
+		}
+		if utils.RequestScope(r) == utils.ScopeOwn && account.OwnerID != user.ID {
+			http.Error(w, "Forbidden: you do not own this service account", http.StatusForbidden)
+			return
+		}
+		keyUser = account.User
+	}
+
+	ttl := utils.DefaultAPIKeyTTL
+	if req.ExpiresInDays > 0 {
+		ttl = min(time.Duration(req.ExpiresInDays)*24*time.Hour, utils.MaxAPIKeyTTL)
+	}
+
+	key, apiKey, err := utils.CreateAPIKey(keyUser, user.ID, req.Name, req.Scopes, ttl)
+	if errors.Is(err, utils.ErrAPIKeyScopes) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create API key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"api_key": apiKey,
+		"key":     key,
+		"message": "Store the key now, it is shown only once. Send it in the X-API-Key header or as the bearer token.",
+	})
+}
+
+// RetrieveAPIKeyListHandler lists keys without the keys themselves, ?user_id=<id> for one user.
+// Own scope callers see their keys and those of their service accounts.
+func RetrieveAPIKeyListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveAPIKeyListHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	query := db.DB.Order("id desc")
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		owned := db.DB.Model(&models.ServiceAccount{}).Select("user_id").Where("owner_id = ?", user.ID)
+		query = query.Where("user_id = ? OR user_id IN (?)", user.ID, owned)
+	}
+
+	var apiKeys []models.APIKey
+	if err := query.Find(&apiKeys).Error; err != nil {
+		http.Error(w, "Could not fetch API keys", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRevokeAPIKeyHandler handling request: ", r)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.RevokeAPIKey(uint(id)); err != nil {
+		http.Error(w, "API key not found or already revoked", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked successfully"})
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"OnlineQuizSystem/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// AuthProvider is an external identity provider users can log in with next to the email and
+// password flow, e.g. utils.OIDCProvider for OpenID Connect.
+type AuthProvider interface {
+	Name() string
+	// AuthURL is where the browser is sent to log in, state, nonce and the PKCE challenge
+	// come back through the callback.
+	AuthURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error)
+	// Exchange turns the callback's code into the verified identity of the user.
+	Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*utils.ExternalIdentity, error)
+}
+
+var authProviders = map[string]AuthProvider{}
+
+// RegisterAuthProvider makes a provider available at /auth/{name}/login, main does this at startup.
+func RegisterAuthProvider(provider AuthProvider) {
+	authProviders[provider.Name()] = provider
+}
+
+const (
+	ssoCookieName = "sso_login"
+	ssoLoginTTL   = 10 * time.Minute
+)
+
+func providerFromPath(w http.ResponseWriter, r *http.Request) (AuthProvider, bool) {
+	provider, ok := authProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+	}
+	return provider, ok
+}
+
+func ListAuthProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(authProviders))
+	for name := range authProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	json.NewEncoder(w).Encode(map[string]any{"providers": names})
+}
+
+// SSOLoginHandler starts a single sign-on login. The state, nonce and PKCE verifier are kept in
+// a short-lived signed cookie, so the callback can land on any instance.
+func SSOLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nSSOLoginHandler handling request: ", r)
+	provider, ok := providerFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := utils.NewRandomState()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := utils.NewRandomState()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := utils.NewPKCE()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("Identity provider %s is not reachable: %v", provider.Name(), err)
+		http.Error(w, "Identity provider is not reachable", http.StatusBadGateway)
+		return
+	}
+
+	cookie, err := utils.Keys.Sign(utils.TokenTypeSSOLogin, jwt.MapClaims{
+		"provider": provider.Name(),
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(ssoLoginTTL).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookieName,
+		Value:    cookie,
+		Path:     "/auth/",
+		MaxAge:   int(ssoLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// SSOCallbackHandler finishes a single sign-on login, provisioning the user on their first
+// login, and answers like /login (tokens, or a 2FA challenge).
+func SSOCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nSSOCallbackHandler handling request: ", r)
+	provider, ok := providerFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	cookie, err := r.Cookie(ssoCookieName)
+	if err != nil {
+		http.Error(w, "Login session not found, please start the login again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoCookieName, Value: "", Path: "/auth/", MaxAge: -1, HttpOnly: true})
+
+	token, err := utils.Keys.Parse(cookie.Value, utils.TokenTypeSSOLogin)
+	if err != nil {
+		http.Error(w, "Login session expired, please start the login again", http.StatusBadRequest)
+		return
+	}
+	login, _ := token.Claims.(jwt.MapClaims)
+	loginProvider, _ := login["provider"].(string)
+	state, _ := login["state"].(string)
+	nonce, _ := login["nonce"].(string)
+	verifier, _ := login["verifier"].(string)
+	if loginProvider != provider.Name() || state == "" {
+		http.Error(w, "Login session expired, please start the login again", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		http.Error(w, "Identity provider refused the login: "+idpError, http.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("Single sign-on with %s failed: %v", provider.Name(), err)
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := utils.ProvisionSSOUser(identity)
+	if errors.Is(err, utils.ErrSSOEmailUnverified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sign in: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, user, http.StatusAccepted)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"OnlineQuizSystem/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// stubProvider records the exchanges the callback asks for, it never logs anyone in.
+type stubProvider struct {
+	exchanges int
+}
+
+func (p *stubProvider) Name() string { return "stub" }
+
+func (p *stubProvider) AuthURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	return "https://idp.example/authorize?" + url.Values{"state": {state}}.Encode(), nil
+}
+
+func (p *stubProvider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*utils.ExternalIdentity, error) {
+	p.exchanges++
+	return nil, errors.New("stub provider does not log anyone in")
+}
+
+// startSSOLogin runs the login handler and returns the cookie and state it handed out.
+func startSSOLogin(t *testing.T) (*http.Cookie, string) {
+	t.Helper()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/auth/stub/login", nil), map[string]string{"provider": "stub"})
+	rec := httptest.NewRecorder()
+	SSOLoginHandler(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login answered %d: %s", rec.Code, rec.Body)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ssoCookieName {
+		t.Fatalf("login set cookies %v", cookies)
+	}
+	return cookies[0], location.Query().Get("state")
+}
+
+func ssoCallback(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	target := "/auth/stub/callback?" + url.Values{"code": {"the-code"}, "state": {state}}.Encode()
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, target, nil), map[string]string{"provider": "stub"})
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	SSOCallbackHandler(rec, req)
+	return rec
+}
+
+func TestSSOCallbackChecksState(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	keys := &utils.KeyRing{Store: utils.NewMemorySigningKeyStore()}
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	previous := utils.Keys
+	utils.Keys = keys
+	t.Cleanup(func() { utils.Keys = previous })
+
+	provider := &stubProvider{}
+	RegisterAuthProvider(provider)
+	t.Cleanup(func() { delete(authProviders, provider.Name()) })
+
+	cookie, state := startSSOLogin(t)
+	if state == "" {
+		t.Fatal("login did not send a state to the provider")
+	}
+
+	if rec := ssoCallback(cookie, "forged-state"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback with a wrong state answered %d", rec.Code)
+	}
+	if rec := ssoCallback(nil, state); rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback without the login cookie answered %d", rec.Code)
+	}
+	if provider.exchanges != 0 {
+		t.Fatalf("the code was exchanged %d times before the state was checked", provider.exchanges)
+	}
+
+	if rec := ssoCallback(cookie, state); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("callback with the right state answered %d", rec.Code)
+	}
+	if provider.exchanges != 1 {
+		t.Fatalf("the code was exchanged %d times with the right state", provider.exchanges)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+)
+
+type InvitationRequest struct {
+	Email          string  `json:"email"` // optional, binds the invitation to one email
+	Role           string  `json:"role"`
+	Department     *string `json:"department"`
+	ExpiresInHours int     `json:"expires_in_hours"`
+}
+
+func invitationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrInvitationInvalid), errors.Is(err, utils.ErrInvitationEmail):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrInvitationUsed), errors.Is(err, utils.ErrInvitationExpired):
+		return http.StatusGone
+	}
+	return http.StatusInternalServerError
+}
+
+// CreateInvitationHandler lets admins invite anyone with any role. Department heads (teachers
+// with the own scope) can only invite teachers and students into their own department.
+func CreateInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nCreateInvitationHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req InvitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Role = strings.TrimSpace(strings.ToLower(req.Role))
+	if req.Role != "admin" && req.Role != "teacher" && req.Role != "student" {
+		http.Error(w, fmt.Sprintf("Role of type '%s' is not valid.", req.Role), http.StatusPreconditionFailed)
+		return
+	}
+
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		if !user.UserDetails.DepartmentHead || user.UserDetails.Department == nil {
+			http.Error(w, "Forbidden: only admins and department heads can send invitations", http.StatusForbidden)
+			return
+		}
+		if req.Role == "admin" {
+			http.Error(w, "Forbidden: department heads can only invite teachers and students", http.StatusForbidden)
+			return
+		}
+		req.Department = user.UserDetails.Department
+	}
+
+	ttl := utils.DefaultInvitationTTL
+	if req.ExpiresInHours > 0 {
+		ttl = min(time.Duration(req.ExpiresInHours)*time.Hour, utils.MaxInvitationTTL)
+	}
+
+	token, invitation, err := utils.CreateInvitation(user.ID, req.Email, req.Role, req.Department, ttl)
+	if err != nil {
+		http.Error(w, "Failed to create invitation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"invitation":   invitation,
+		"invite_url":   utils.InvitationURL(token),
+		"invite_token": token,
+		"message":      "Send the invite url to the invitee, it is shown only once and works for one registration.",
+	})
+}
+
+func RetrieveInvitationListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveInvitationListHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	query := db.DB.Order("id desc")
+	if utils.RequestScope(r) == utils.ScopeOwn {
+		query = query.Where("invited_by_id = ?", user.ID)
+	}
+
+	var invitations []models.Invitation
+	if err := query.Find(&invitations).Error; err != nil {
+		http.Error(w, "Could not fetch invitations", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func RevokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRevokeInvitationHandler handling request: ", r)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.RevokeInvitation(uint(id)); err != nil {
+		http.Error(w, "Invitation not found or already used", invitationErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invitation revoked successfully"})
+}
+
+// RetrieveRoleChangeListHandler is the role audit trail, ?user_id=<id> for one user.
+func RetrieveRoleChangeListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveRoleChangeListHandler handling request: ", r)
+	query := db.DB.Order("id desc")
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var changes []models.RoleChange
+	if err := query.Find(&changes).Error; err != nil {
+		http.Error(w, "Could not fetch role changes", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(changes)
+}
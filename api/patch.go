@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+)
+
+var (
+	allRoles   = []string{"admin", "teacher", "student"}
+	staffRoles = []string{"admin", "teacher"}
+	adminRoles = []string{"admin"}
+)
+
+// The fields the generic PATCH apis may change, per model and role. Ids, owners and stored
+// file paths are left out or admin only, deleted_at is never patched, use the restore apis.
+var userPatchSchema = utils.PatchSchema{
+	"email":    {Kind: utils.FieldString, Roles: adminRoles},
+	"password": {Kind: utils.FieldString, Roles: allRoles},
+	// current_password is checked by the handler before a password change, it is never written.
+	"current_password": {Kind: utils.FieldString, Roles: allRoles},
+	"user_type":        {Kind: utils.FieldString, Roles: adminRoles, OneOf: allRoles},
+}
+
+var userDetailsPatchSchema = utils.PatchSchema{
+	"full_name":       {Kind: utils.FieldString, Roles: allRoles},
+	"profession":      {Kind: utils.FieldString, Nullable: true, Roles: allRoles},
+	"brief_intro":     {Kind: utils.FieldString, Nullable: true, Roles: allRoles},
+	"profile_image":   {Kind: utils.FieldString, Nullable: true, Roles: allRoles},
+	"department":      {Kind: utils.FieldString, Nullable: true, Roles: adminRoles}, // department heads invite into it
+	"department_head": {Kind: utils.FieldBool, Roles: adminRoles},
+	"extra_json_info": {Kind: utils.FieldJSON, Column: "extra_info_json", Nullable: true, Roles: allRoles},
+	"user_id":         {Kind: utils.FieldUint, Roles: adminRoles},
+}
+
+var quizEventPatchSchema = utils.PatchSchema{
+	"quiz_event_name": {Kind: utils.FieldString, Roles: staffRoles},
+	"user_id":         {Kind: utils.FieldUint, Roles: adminRoles},
+}
+
+var eventResultPatchSchema = utils.PatchSchema{
+	"exp_score":       {Kind: utils.FieldInt, Roles: staffRoles},
+	"extra_json_info": {Kind: utils.FieldJSON, Column: "extra_info_json", Nullable: true, Roles: staffRoles},
+	"team_name":       {Kind: utils.FieldString, Nullable: true, Roles: staffRoles},
+	"team_score":      {Kind: utils.FieldInt, Nullable: true, Roles: staffRoles},
+	"user_id":         {Kind: utils.FieldUint, Roles: adminRoles},
+	"quiz_event_id":   {Kind: utils.FieldUint, Roles: adminRoles},
+}
+
+var accommodationPatchSchema = utils.PatchSchema{
+	"time_multiplier": {Kind: utils.FieldFloat, Roles: staffRoles, Min: utils.MinValue(1)},
+	"extra_seconds":   {Kind: utils.FieldInt, Roles: staffRoles, Min: utils.MinValue(0)},
+	"notes":           {Kind: utils.FieldString, Nullable: true, Roles: staffRoles},
+	"quiz_event_id":   {Kind: utils.FieldUint, Nullable: true, Roles: staffRoles},
+}
+
+// decodePatch reads a PATCH body and keeps it to the schema's fields for the user's role,
+// writing the error response itself when the body is rejected.
+func decodePatch(w http.ResponseWriter, r *http.Request, user *models.User, schema utils.PatchSchema) (map[string]any, bool) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return nil, false
+	}
+
+	updates, err := schema.Apply(user.UserType, body)
+	if errors.Is(err, utils.ErrPatchForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return updates, true
+}
+
+// restoreRecord un-deletes a soft-deleted record of the model from the ?id= query.
+func restoreRecord(w http.ResponseWriter, r *http.Request, model any, name string) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	result := db.DB.Unscoped().Model(model).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if result.Error != nil {
+		http.Error(w, "Failed to restore "+name, http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		if err := db.DB.Unscoped().First(model, id).Error; err != nil {
+			http.Error(w, name+" not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, name+" is not deleted", http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("%s restored successfully", name)})
+}
+
+func RestoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRestoreUserHandler handling request: ", r)
+	restoreRecord(w, r, &models.User{}, "User")
+}
+
+func RestoreUserDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRestoreUserDetailsHandler handling request: ", r)
+	restoreRecord(w, r, &models.UserDetails{}, "userDetails")
+}
+
+func RestoreQuizEventHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRestoreQuizEventHandler handling request: ", r)
+	restoreRecord(w, r, &models.QuizEvent{}, "QuizEvent")
+}
+
+func RestoreEventResultHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRestoreEventResultHandler handling request: ", r)
+	restoreRecord(w, r, &models.EventResult{}, "EventResult")
+}
+
+func RestoreAccommodationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRestoreAccommodationHandler handling request: ", r)
+	restoreRecord(w, r, &models.Accommodation{}, "Accommodation")
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Ownership finds the users that own the resource a request is about. Callers whose role only
+// has the own scope of the route's permission must be one of them.
+type Ownership func(r *http.Request) ([]uint, error)
+
+var errResourceNotFound = errors.New("resource not found")
+
+// Require is the policy layer every authenticated route goes through: it authorizes the caller by
+// login or API key, checks the role (and the key's scopes) grant the permission and, for an own
+// scope grant, that the caller owns the resource. Routes without a single resource (lists,
+// creates) pass nil owners and the handler limits ScopeOwn callers with utils.RequestScope.
+func Require(permission utils.Permission, owners Ownership, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, session, apiKey, status, err := utils.AuthorizeRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		scope := utils.CredentialScope(user.UserType, apiKey, permission)
+		if scope == utils.ScopeNone && apiKey != nil && utils.PermissionScope(user.UserType, permission) != utils.ScopeNone {
+			http.Error(w, fmt.Sprintf("Forbidden: API key does not have the '%s' scope", permission), http.StatusForbidden)
+			return
+		}
+		if scope == utils.ScopeNone {
+			http.Error(w, fmt.Sprintf("Forbidden: role '%s' does not have the '%s' permission", user.UserType, permission), http.StatusForbidden)
+			return
+		}
+
+		if scope == utils.ScopeOwn && owners != nil {
+			ownerIDs, err := owners(r)
+			if errors.Is(err, errResourceNotFound) {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(ownerIDs, user.ID) {
+				http.Error(w, "Forbidden: you do not own this resource", http.StatusForbidden)
+				return
+			}
+		}
+
+		next(w, utils.WithAuth(r, user, session, apiKey, scope))
+	}
+}
+
+func queryID(r *http.Request) (uint, error) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		return 0, errors.New("Invalid ID")
+	}
+	return uint(id), nil
+}
+
+func pathID(r *http.Request) (uint, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		return 0, errors.New("Invalid quiz ID")
+	}
+	return uint(id), nil
+}
+
+// loadOwned also finds soft-deleted records, so their owners can restore them.
+func loadOwned(dest any, id uint) error {
+	err := db.DB.Unscoped().First(dest, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errResourceNotFound
+	}
+	return err
+}
+
+func quizEventOwner(quizEventID uint) ([]uint, error) {
+	var quizEvent models.QuizEvent
+	if err := loadOwned(&quizEvent, quizEventID); err != nil {
+		return nil, err
+	}
+	return []uint{quizEvent.UserID}, nil
+}
+
+// OwnsUser: users own themselves.
+func OwnsUser(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	return []uint{id}, nil
+}
+
+func OwnsUserDetails(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var userDetails models.UserDetails
+	if err := loadOwned(&userDetails, id); err != nil {
+		return nil, err
+	}
+	return []uint{userDetails.UserID}, nil
+}
+
+// OwnsQuizEvent: the teacher who created the quiz event owns it, for the ?id= crud apis.
+func OwnsQuizEvent(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	return quizEventOwner(id)
+}
+
+// SeesQuizEvent is for reading a quiz event: its owner and the students who took part see it.
+func SeesQuizEvent(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := quizEventOwner(id)
+	if err != nil {
+		return nil, err
+	}
+	var participants []uint
+	if err := db.DB.Model(&models.EventResult{}).Where("quiz_event_id = ?", id).Pluck("user_id", &participants).Error; err != nil {
+		return nil, err
+	}
+	return append(owners, participants...), nil
+}
+
+// OwnsQuiz is OwnsQuizEvent for the /quiz/{id}/... apis.
+func OwnsQuiz(r *http.Request) ([]uint, error) {
+	id, err := pathID(r)
+	if err != nil {
+		return nil, err
+	}
+	return quizEventOwner(id)
+}
+
+// OwnsEventResult: a result is changed only by the teacher of the quiz, never by the student.
+func OwnsEventResult(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var eventResult models.EventResult
+	if err := loadOwned(&eventResult, id); err != nil {
+		return nil, err
+	}
+	owners, err := quizEventOwner(eventResult.QuizEventID)
+	if err != nil && !errors.Is(err, errResourceNotFound) {
+		return nil, err
+	}
+	return owners, nil
+}
+
+// SeesEventResult: the student reads their own result, next to the teacher of the quiz.
+func SeesEventResult(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var eventResult models.EventResult
+	if err := loadOwned(&eventResult, id); err != nil {
+		return nil, err
+	}
+	owners, err := quizEventOwner(eventResult.QuizEventID)
+	if err != nil && !errors.Is(err, errResourceNotFound) {
+		return nil, err
+	}
+	return append(owners, eventResult.UserID), nil
+}
+
+func OwnsAccommodation(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var accommodation models.Accommodation
+	if err := loadOwned(&accommodation, id); err != nil {
+		return nil, err
+	}
+	return []uint{accommodation.UserID}, nil
+}
+
+// ManagesAccommodation: an accommodation for one quiz event is changed by the teacher of that quiz.
+// One for every quiz reaches other teachers' quizzes too, so only callers with the any scope
+// change those.
+func ManagesAccommodation(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var accommodation models.Accommodation
+	if err := loadOwned(&accommodation, id); err != nil {
+		return nil, err
+	}
+	if accommodation.QuizEventID == nil {
+		return nil, nil
+	}
+	return quizEventOwner(*accommodation.QuizEventID)
+}
+
+// ownsAccommodationQuiz tells whether a caller with the own scope may tie an accommodation to the
+// quiz event, it has to be one of theirs.
+func ownsAccommodationQuiz(r *http.Request, user *models.User, quizEventID *uint) bool {
+	if utils.RequestScope(r) != utils.ScopeOwn {
+		return true
+	}
+	if quizEventID == nil {
+		return false
+	}
+	owners, err := quizEventOwner(*quizEventID)
+	return err == nil && slices.Contains(owners, user.ID)
+}
+
+// OwnsServiceAccount: a service account belongs to whoever created it.
+func OwnsServiceAccount(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var account models.ServiceAccount
+	if err := loadOwned(&account, id); err != nil {
+		return nil, err
+	}
+	return []uint{account.OwnerID}, nil
+}
+
+// OwnsAPIKey: a key belongs to its user and, for a service account's key, to the account's owner.
+func OwnsAPIKey(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var apiKey models.APIKey
+	if err := loadOwned(&apiKey, id); err != nil {
+		return nil, err
+	}
+	owners := []uint{apiKey.UserID}
+	var account models.ServiceAccount
+	if err := db.DB.Where("user_id = ?", apiKey.UserID).First(&account).Error; err == nil {
+		owners = append(owners, account.OwnerID)
+	}
+	return owners, nil
+}
+
+// OwnsInvitation: an invitation belongs to whoever sent it.
+func OwnsInvitation(r *http.Request) ([]uint, error) {
+	id, err := queryID(r)
+	if err != nil {
+		return nil, err
+	}
+	var invitation models.Invitation
+	if err := loadOwned(&invitation, id); err != nil {
+		return nil, err
+	}
+	return []uint{invitation.InvitedByID}, nil
+}
@@ -17,7 +17,7 @@ import (
 )
 
 func StartQuiz(w http.ResponseWriter, r *http.Request) {
-	user, _, err := utils.AuthorizeUser(r)
+	_, _, err := utils.AuthorizeUser(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -33,11 +33,6 @@ func StartQuiz(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Quiz not found", http.StatusNotFound)
 		return
 	}
-	log.Printf("quizEvent.UserID: %d and user.ID: %d\n", quizEvent.UserID, user.ID)
-	if quizEvent.UserID != user.ID {
-		http.Error(w, "Unauthorized, You did not created this event.", http.StatusUnauthorized)
-		return
-	}
 
 	quizJson, err := quizEvent.GetQuizJsonFileMap()
 	if err != nil {
@@ -96,21 +91,302 @@ func EndQuiz(w http.ResponseWriter, r *http.Request) {
 	log.Println("vars: ", vars)
 	quizID, _ := strconv.Atoi(vars["id"])
 	var quiz models.QuizEvent
-	if err := db.DB.First(&quiz, "id = ?", quizID).Error; err != nil || quiz.UserID != user.ID {
-		http.Error(w, "Unauthorized user: " + err.Error(), http.StatusInternalServerError)
+	if err := db.DB.First(&quiz, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
 		return 
 	}
 
-	errStr := utils.PrepareEndQuiz(quiz, user, sockets.GetActiveSessions())
+	room, exists := socManager.GetManager().GetRoom(*quiz.ChannelCode)
+	if exists && room.TeacherIsRemote() {
+		// The answers are held by the instance the teacher is connected to, let it finalize.
+		if err := room.SendCommand(sockets.CommandEndQuiz, user.ID, map[string]uint{"quiz_id": quiz.ID}); err != nil {
+			http.Error(w, "Failed to end quiz: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "quiz finalizing"})
+		return
+	}
+
+	var errStr string
+	if exists {
+		errStr = sockets.FinishQuiz(room, quiz, user)
+	} else {
+		errStr = utils.PrepareEndQuiz(quiz, user, sockets.GetActiveSessions())
+	}
 	if errStr != "Prepared" {
 		http.Error(w, errStr, http.StatusInternalServerError)
 		return 
 	}
-	// Notify teacher
-	if room, exists := socManager.GetManager().GetRoom(*quiz.ChannelCode); exists {
-		room.BroadcastToTeacher( map[string]any{ "type": "end_quiz_event", "payload" : map[string]bool{"results" : true} }, )
-	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "quiz finalized"})
-}
\ No newline at end of file
+}
+
+
+
+func GetDisplayToken(w http.ResponseWriter, r *http.Request) {
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+	if quizEvent.ChannelCode == nil {
+		http.Error(w, "QuizEvent has no room to display", http.StatusBadRequest)
+		return
+	}
+
+	displayToken, err := utils.GenerateDisplayToken(quizEvent.ID, *quizEvent.ChannelCode)
+	if err != nil {
+		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"display_token": displayToken,
+		"websocket_url": "ws://"+utils.GetServerBaseUrl()+"/ws?channel_code=" + *quizEvent.ChannelCode + "&display_token=" + displayToken,
+	})
+}
+
+
+
+// getOwnedRunningRoom loads the quiz from the {id} path variable and returns its room,
+// writing the error response itself when it has no room. Ownership is checked by the OwnsQuiz policy.
+func getOwnedRunningRoom(w http.ResponseWriter, r *http.Request) (*socManager.Room, bool) {
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return nil, false
+	}
+	if quizEvent.ChannelCode == nil {
+		http.Error(w, "Room for quiz event do not exists", http.StatusNotFound)
+		return nil, false
+	}
+
+	room, exists := socManager.GetManager().GetRoom(*quizEvent.ChannelCode)
+	if !exists {
+		http.Error(w, "Room for quiz event do not exists", http.StatusNotFound)
+		return nil, false
+	}
+	return room, true
+}
+
+
+
+func PauseQuiz(w http.ResponseWriter, r *http.Request) {
+	room, ok := getOwnedRunningRoom(w, r)
+	if !ok {
+		return
+	}
+
+	if err := sockets.PauseQuiz(room); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"status": "quiz paused", "remaining_ms": room.RemainingMillis()})
+}
+
+
+
+func ResumeQuiz(w http.ResponseWriter, r *http.Request) {
+	room, ok := getOwnedRunningRoom(w, r)
+	if !ok {
+		return
+	}
+
+	endTime, err := sockets.ResumeQuiz(room)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"status": "quiz resumed", "end_time": endTime})
+}
+
+
+
+func ExtendQuizTime(w http.ResponseWriter, r *http.Request) {
+	room, ok := getOwnedRunningRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var req sockets.ExtendTimeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	endTime, err := sockets.ExtendQuiz(room, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"status": "quiz extended", "end_time": endTime})
+}
+
+
+// GetQuizMessages lists the Q&A and announcements of a quiz run for the quiz owner, ?user_id= narrows
+// it down to the conversation with one student.
+func GetQuizMessages(w http.ResponseWriter, r *http.Request) {
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	query := db.DB.Where("quiz_event_id = ?", quizEvent.ID)
+	if studentID, err := strconv.Atoi(r.URL.Query().Get("user_id")); err == nil {
+		query = query.Where("sender_id = ? OR recipient_id = ?", studentID, studentID)
+	}
+
+	var messages []models.RoomMessage
+	if err := query.Order("created_at").Find(&messages).Error; err != nil {
+		http.Error(w, "Failed to load messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+
+
+// RegradeQuiz grades an ended quiz again, optionally after changing the answer key of one question.
+// Body: {"question_id": 3, "reason": "...", "edit": {...}, "voided": true, "accept_answers": [...]}
+func RegradeQuiz(w http.ResponseWriter, r *http.Request) {
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	var req utils.RegradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	regrade, diffs, err := utils.RegradeQuiz(quizEvent, user.ID, req)
+	if err == utils.ErrQuizNotEnded {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Regrade failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"regrade_id":  regrade.ID,
+		"question_id": regrade.QuestionID,
+		"reason":      regrade.Reason,
+		"diff":        diffs,
+	})
+	log.Printf("Quiz %d regraded by %d: %s", quizEvent.ID, user.ID, regrade.Reason)
+}
+
+
+
+// GetQuizRegrades lists the regrades of a quiz, who ran them, why and what changed.
+func GetQuizRegrades(w http.ResponseWriter, r *http.Request) {
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	var regrades []models.QuizRegrade
+	if err := db.DB.Where("quiz_event_id = ?", quizEvent.ID).Order("created_at").Find(&regrades).Error; err != nil {
+		http.Error(w, "Failed to load regrades", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(regrades)
+}
+
+
+
+// GetQuizCalibration reports how confidence matched correctness, per student and per question,
+// for the quiz owner once results are in.
+func GetQuizCalibration(w http.ResponseWriter, r *http.Request) {
+	_, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	quizID, _ := strconv.Atoi(vars["id"])
+
+	var quizEvent models.QuizEvent
+	if err := db.DB.First(&quizEvent, "id = ?", quizID).Error; err != nil {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	perStudent, perQuestion, err := utils.QuizCalibration(quizEvent)
+	if err != nil {
+		http.Error(w, "Failed to compute calibration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"students":  perStudent,
+		"questions": perQuestion,
+	})
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/utils"
+)
+
+// Limit allows Requests per Window on a route for every caller IP, or for every account when
+// PerAccount is set. The account is the "email" of the body, the user of a 2FA "challenge_token"
+// or the logged in user.
+type Limit struct {
+	Requests   int64
+	Window     time.Duration
+	PerAccount bool
+}
+
+func PerIP(requests int64, window time.Duration) Limit {
+	return Limit{Requests: requests, Window: window}
+}
+
+func PerAccount(requests int64, window time.Duration) Limit {
+	return Limit{Requests: requests, Window: window, PerAccount: true}
+}
+
+// requestAccount peeks at the json body for an email or a 2FA challenge, putting the body back
+// for the handler.
+func requestAccount(r *http.Request) string {
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			var payload struct {
+				Email          string `json:"email"`
+				ChallengeToken string `json:"challenge_token"`
+			}
+			if json.Unmarshal(body, &payload) == nil {
+				if strings.TrimSpace(payload.Email) != "" {
+					return "email:" + strings.ToLower(strings.TrimSpace(payload.Email))
+				}
+				if payload.ChallengeToken != "" {
+					if user, err := utils.ParseTwoFactorChallenge(payload.ChallengeToken); err == nil {
+						return "user:" + strconv.Itoa(int(user.ID))
+					}
+				}
+			}
+		}
+	}
+	if r.Header.Get("Authorization") != "" {
+		if user, _, err := utils.AuthorizeUser(r); err == nil {
+			return "user:" + strconv.Itoa(int(user.ID))
+		}
+	}
+	return ""
+}
+
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// accountLocked answers 429 when the account is locked after too many failed logins.
+func accountLocked(w http.ResponseWriter, email string) bool {
+	locked := utils.AccountLockedFor(email)
+	if locked <= 0 {
+		return false
+	}
+	retryAfter(w, locked)
+	http.Error(w, fmt.Sprintf("Too many failed logins, the account is locked for %d more seconds", int(math.Ceil(locked.Seconds()))), http.StatusTooManyRequests)
+	return true
+}
+
+// Throttle rate limits a route, answering 429 with a Retry-After header once any of the
+// limits is used up. Counters live in utils.Limiter.
+func Throttle(route string, next http.HandlerFunc, limits ...Limit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var account string
+		accountRead := false
+		for _, limit := range limits {
+			key := "ip:" + utils.RequestIP(r)
+			if limit.PerAccount {
+				if !accountRead {
+					account, accountRead = requestAccount(r), true
+				}
+				if account == "" {
+					continue
+				}
+				key = account
+			}
+			key = fmt.Sprintf("%s:%s:%d", route, key, int64(limit.Window.Seconds()))
+
+			count, reset, err := utils.Limiter.Incr(key, limit.Window)
+			if err != nil {
+				// Better to let requests through than to take the api down with the store.
+				log.Println("Rate limiter store failed: ", err)
+				continue
+			}
+			if count > limit.Requests {
+				retryAfter(w, reset)
+				http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+)
+
+// JWKSHandler publishes the public keys our JWTs are signed with. Keys stay listed until every
+// token they signed has expired, so verifiers can cache the set for a few minutes.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(utils.Keys.JWKS())
+}
+
+// RetrieveSigningKeyListHandler lists the key ring, newest first, without the private keys.
+func RetrieveSigningKeyListHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRetrieveSigningKeyListHandler handling request: ", r)
+	var signingKeys []models.SigningKey
+	if err := db.DB.Order("id desc").Find(&signingKeys).Error; err != nil {
+		http.Error(w, "Could not fetch signing keys", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(signingKeys)
+}
+
+// RotateSigningKeyHandler rotates ahead of schedule, tokens signed by the old key keep working.
+func RotateSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRotateSigningKeyHandler handling request: ", r)
+	signingKey, err := utils.Keys.Rotate()
+	if err != nil {
+		http.Error(w, "Failed to rotate the signing key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(signingKey)
+}
+
+// RevokeSigningKeyHandler takes a leaked key (?kid=<kid>) out of the ring right away.
+func RevokeSigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nRevokeSigningKeyHandler handling request: ", r)
+	kid := r.URL.Query().Get("kid")
+	if kid == "" {
+		http.Error(w, "kid is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.Keys.Revoke(kid); err != nil {
+		if errors.Is(err, utils.ErrUnknownSigningKey) {
+			http.Error(w, "Signing key not found or already expired", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke the signing key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signing key revoked, tokens it signed no longer work"})
+}
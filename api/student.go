@@ -2,13 +2,13 @@ package api
 
 import (
 	"log"
-	"strconv"
 	"net/http"
 	"encoding/json"
 
 	"OnlineQuizSystem/db"
 	"OnlineQuizSystem/models"
 	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/sockets"
 	"OnlineQuizSystem/utils"
 )
 
@@ -44,22 +44,41 @@ func JoinQuizEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if utils.IsBanned(quizEvent.ID, user.ID) {
+		http.Error(w, "You are banned from this quiz event", http.StatusForbidden)
+		return
+	}
+
 	manager := socManager.GetManager()
-	if room, exists := manager.GetRoom(req.ChannelCode); exists {
-		room.Participants[user.ID] = true // false = not ready yet
-	} else if !exists {
+	room, exists := manager.GetRoom(req.ChannelCode)
+	if !exists {
 		http.Error(w, "Room for quiz event do not exists, Please contact the teacher for creating a quizEvent again.", http.StatusNotFound)
 		return 
 	}
 
+	outcome, err := room.RequestJoin(user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	sockets.PushLobbyState(room)
+
+	message := "Please join the room and wait for quiz event to start."
+	if outcome == socManager.JoinWaiting {
+		message = "The teacher has to admit you first, please join the room and wait in the lobby."
+	}
+
 	response := map[string]any{
-		"status":      "joined",
+		"status":      outcome,
 		"quiz_event":  quizEvent,
-		"websocket_url": "ws://"+utils.GetServerBaseUrl()+"/ws?channel_code=" + req.ChannelCode + "&user_id=" + strconv.Itoa(int(user.ID)),
-		"message" : "Please join the room and wait for quiz event to start.",
+		"websocket_url": "ws://"+utils.GetServerBaseUrl()+"/ws?channel_code=" + req.ChannelCode,
+		"message" : message,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if outcome == socManager.JoinWaiting {
+		w.WriteHeader(http.StatusAccepted)
+	}
 	json.NewEncoder(w).Encode(response)
-	log.Printf("User %d joined quiz %d", user.ID, quizEvent.ID)
+	log.Printf("User %d %s quiz %d", user.ID, outcome, quizEvent.ID)
 }
\ No newline at end of file
@@ -32,11 +32,6 @@ func CreateQuizEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.UserType != "admin" && user.UserType != "teacher" {
-		http.Error(w, "Unauthorized: Only admins & teachers can create QuizEvent", http.StatusUnauthorized)
-		return
-	}
-
 	var reqBody struct {
 		QuizEventName string         `json:"quiz_event_name"`
 		QuizJson      map[string]any `json:"quiz_json"`
@@ -66,13 +61,15 @@ func CreateQuizEvent(w http.ResponseWriter, r *http.Request) {
 	}
 
 	manager := socManager.GetManager()
-	manager.CreateRoom(newQuizEvent.ID, channelCode, user.ID)
+	room := manager.CreateRoom(newQuizEvent.ID, channelCode, user.ID)
+	room.UpdateLobby(utils.GetLobbySettings(reqBody.QuizJson))
+	room.SetAutoEnd(utils.GetSubmissionOptions(reqBody.QuizJson).AutoEnd)
 
 	response := map[string]any{
 		"channel_code": channelCode,
 		"status":      "created",
 		"quiz_event":   newQuizEvent,
-		"websocket_url": "ws://"+utils.GetServerBaseUrl()+"/ws?channel_code=" + channelCode + "&user_id=" + strconv.Itoa(int(user.ID)),
+		"websocket_url": "ws://"+utils.GetServerBaseUrl()+"/ws?channel_code=" + channelCode,
 		"message" : "Please join the room and start quiz event whenever you like.",
 	}
 
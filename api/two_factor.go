@@ -0,0 +1,279 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/utils"
+)
+
+type TwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func twoFactorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrTwoFactorInvalidCode), errors.Is(err, utils.ErrInvalidChallenge):
+		return http.StatusUnauthorized
+	case errors.Is(err, utils.ErrTwoFactorEnabled):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrTwoFactorNotEnrolled):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, utils.ErrTwoFactorRequired):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrTwoFactorLocked):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// completeLogin hands out the tokens of a user who passed the password step, or a challenge
+// token when a second factor (or setting one up) is still needed.
+func completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, status int) {
+	enabled, err := utils.TwoFactorEnabled(user.ID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if enabled || utils.TwoFactorRequired(user.UserType) {
+		challenge, err := utils.IssueTwoFactorChallenge(user.ID)
+		if err != nil {
+			http.Error(w, "Token generation failed", http.StatusInternalServerError)
+			return
+		}
+		response := map[string]any{"challenge_token": challenge, "expires_in": int64(utils.TwoFactorChallengeTTL.Seconds())}
+		if enabled {
+			response["two_factor_required"] = true
+		} else {
+			response["two_factor_setup_required"] = true
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	tokens, err := utils.IssueTokens(user, r)
+	if err != nil {
+		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		return
+	}
+	utils.ClearLoginFailures(user.Email)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// twoFactorCaller is the user setting up 2FA: either logged in, or half way through a login
+// that requires setting it up first.
+func twoFactorCaller(r *http.Request, challengeToken string) (*models.User, bool, int, error) {
+	if challengeToken != "" {
+		user, err := utils.ParseTwoFactorChallenge(challengeToken)
+		if err != nil {
+			return nil, false, http.StatusUnauthorized, err
+		}
+		return user, true, http.StatusOK, nil
+	}
+	user, status, err := utils.AuthorizeUser(r)
+	if err != nil {
+		return nil, false, status, err
+	}
+	if utils.PermissionScope(user.UserType, utils.PermAccount) == utils.ScopeNone {
+		return nil, false, http.StatusForbidden, errors.New("Forbidden")
+	}
+	return user, false, http.StatusOK, nil
+}
+
+func TwoFactorEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nTwoFactorEnrollHandler handling request: ", r)
+	var req TwoFactorRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid input", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, _, status, err := twoFactorCaller(r, req.ChallengeToken)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	secret, otpauthURL, err := utils.StartTwoFactorEnrollment(user)
+	if err != nil {
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_url": otpauthURL,
+		"message":     "Scan the otpauth url as a QR code (or enter the secret) in your authenticator app, then confirm a code at /2fa/enable.",
+	})
+}
+
+func TwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nTwoFactorEnableHandler handling request: ", r)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, fromChallenge, status, err := twoFactorCaller(r, req.ChallengeToken)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	recoveryCodes, err := utils.ConfirmTwoFactorEnrollment(user.ID, req.Code)
+	if err != nil {
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+
+	response := map[string]any{
+		"message":        "Two-factor authentication enabled. Keep the recovery codes somewhere safe, they are only shown once.",
+		"recovery_codes": recoveryCodes,
+	}
+	// Setting 2FA up was the second step of a login, finish it.
+	if fromChallenge {
+		if err := utils.SpendTwoFactorChallenge(req.ChallengeToken); err != nil {
+			http.Error(w, err.Error(), twoFactorErrorStatus(err))
+			return
+		}
+		tokens, err := utils.IssueTokens(user, r)
+		if err != nil {
+			http.Error(w, "Token generation failed", http.StatusInternalServerError)
+			return
+		}
+		response["tokens"] = tokens
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// TwoFactorVerifyHandler is the second login step: the challenge token plus a TOTP code or a
+// recovery code.
+func TwoFactorVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nTwoFactorVerifyHandler handling request: ", r)
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, err := utils.ParseTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if accountLocked(w, user.Email) {
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords.
+	if err := utils.VerifySecondFactor(user.ID, req.Code, req.RecoveryCode); err != nil {
+		if errors.Is(err, utils.ErrTwoFactorInvalidCode) {
+			utils.RecordLoginFailure(user.Email)
+		}
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+	if err := utils.SpendTwoFactorChallenge(req.ChallengeToken); err != nil {
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+
+	tokens, err := utils.IssueTokens(user, r)
+	if err != nil {
+		http.Error(w, "Token generation failed", http.StatusInternalServerError)
+		return
+	}
+	utils.ClearLoginFailures(user.Email)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nTwoFactorDisableHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if utils.TwoFactorRequired(user.UserType) {
+		http.Error(w, utils.ErrTwoFactorRequired.Error(), http.StatusForbidden)
+		return
+	}
+	if err := utils.VerifySecondFactor(user.ID, req.Code, req.RecoveryCode); err != nil {
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+	if err := utils.DisableTwoFactor(user.ID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled."})
+}
+
+func TwoFactorRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nTwoFactorRecoveryCodesHandler handling request: ", r)
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.VerifySecondFactor(user.ID, req.Code, ""); err != nil {
+		http.Error(w, err.Error(), twoFactorErrorStatus(err))
+		return
+	}
+	recoveryCodes, err := utils.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"recovery_codes": recoveryCodes})
+}
+
+// ResetTwoFactorHandler lets an admin remove a user's 2FA, e.g. after a lost phone. The user's
+// sessions end, so their next login sets 2FA up again where their role requires it.
+func ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nResetTwoFactorHandler handling request: ", r)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := utils.DisableTwoFactor(uint(id)); err != nil {
+		http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := utils.RevokeAllSessions(uint(id)); err != nil {
+		log.Printf("Could not revoke sessions of user %d after 2FA reset: %v", id, err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication of the user was reset."})
+}
@@ -43,12 +43,36 @@ func Init() (*gorm.DB) {
 		&models.UserDetails{},
 		&models.QuizEvent{},
 		&models.EventResult{},
+		&models.Accommodation{},
+		&models.QuizBan{},
+		&models.RoomMessage{},
+		&models.QuizRegrade{},
+		&models.AuthSession{},
+		&models.OTPCode{},
+		&models.TwoFactorAuth{},
+		&models.RecoveryCode{},
+		&models.Invitation{},
+		&models.RoleChange{},
+		&models.ExternalLogin{},
+		&models.ServiceAccount{},
+		&models.APIKey{},
+		&models.SigningKey{},
 	)
 
 	if migrationErr != nil {
 		log.Fatalf("❌ AutoMigration failed: %v", migrationErr)
 	}
 
+	// Results used to be unique per student and per quiz event on their own, which allowed one
+	// result per student overall. AutoMigrate does not drop indexes, so the old ones go here.
+	for _, index := range []string{"idx_event_results_user_id", "idx_event_results_quiz_event_id"} {
+		if DB.Migrator().HasIndex(&models.EventResult{}, index) {
+			if err := DB.Migrator().DropIndex(&models.EventResult{}, index); err != nil {
+				log.Fatalf("❌ Dropping index %s failed: %v", index, err)
+			}
+		}
+	}
+
 	log.Println("✅ AutoMigration complete!")
 
 	return DB
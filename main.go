@@ -1,12 +1,16 @@
 package main
 
 import (
+	"os"
 	"fmt"
+	"log"
+	"time"
 	"net/http"
 	"OnlineQuizSystem/db"
 	"OnlineQuizSystem/api"
 	"OnlineQuizSystem/utils"
 	"OnlineQuizSystem/sockets"
+	"OnlineQuizSystem/socManager"
 
 	"github.com/gorilla/mux"
 )
@@ -16,58 +20,162 @@ import (
 func main() {
 	db.DB = db.Init()
 	fmt.Println("DB Initialized: ", db.DB, db.DB.Config)
+
+	// Rooms are shared between instances through redis when REDIS_URL is set,
+	// otherwise everything stays in this process.
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		bus, err := socManager.NewRedisBus(redisURL)
+		if err != nil {
+			log.Fatal("Failed to connect to the redis room bus: ", err)
+		}
+		socManager.GetManager().SetBus(bus)
+		fmt.Println("Room bus: redis, instance ", socManager.InstanceID)
+
+		// Rate limits and account lockouts have to be shared too, or every instance counts on its own.
+		limiter, err := utils.NewRedisLimiterStore(redisURL)
+		if err != nil {
+			log.Fatal("Failed to connect to the redis rate limiter: ", err)
+		}
+		utils.Limiter = limiter
+	}
+
+	// Single sign-on with an OpenID Connect provider when OIDC_ISSUER is set.
+	if os.Getenv("OIDC_ISSUER") != "" {
+		provider, err := utils.NewOIDCProvider(utils.OIDCConfigFromEnv())
+		if err != nil {
+			log.Fatal("Invalid OIDC configuration: ", err)
+		}
+		api.RegisterAuthProvider(provider)
+		fmt.Println("Single sign-on: ", provider.Name())
+	}
+
+	// JWTs are signed by the key ring in the database, JWT_SIGNING_ALG picks EdDSA (default) or
+	// RS256 for new keys and JWT_KEY_ROTATION_DAYS how often they rotate.
+	if err := utils.Keys.Start(utils.SigningKeyRotationFromEnv()); err != nil {
+		log.Fatal("Failed to load the JWT signing keys: ", err)
+	}
+
+	// OTPs are kept in memory unless OTP_STORE=db, which is needed when running more than one instance.
+	if os.Getenv("OTP_STORE") == "db" {
+		utils.OTP.Store = utils.NewDBOTPStore()
+	}
+
 	router := mux.NewRouter()
 
+	// Every authenticated route goes through api.Require with the permission it needs and, for
+	// single resources, who owns it (see utils.RolePermissions). /ws and /sse check the access
+	// token (header or ?access_token=) and the quiz.join or quiz.run permission themselves, since
+	// they also take display tokens.
+
 	// Auth apis
-	router.HandleFunc("/register", api.RegisterHandler).Methods("POST")
-	router.HandleFunc("/verify-email", api.VerifyEmailHandler).Methods("POST")
-	router.HandleFunc("/login", api.LoginHandler).Methods("POST")
-	router.HandleFunc("/forgot-password", api.ForgotPasswordHandler).Methods("POST")
-	router.HandleFunc("/change-password", api.ChangePasswordHandler).Methods("POST")
+	router.HandleFunc("/register", api.Throttle("register", api.RegisterHandler, api.PerIP(10, time.Hour), api.PerAccount(5, time.Hour))).Methods("POST")
+	router.HandleFunc("/verify-email", api.Throttle("verify-email", api.VerifyEmailHandler, api.PerIP(20, time.Minute))).Methods("POST")
+	router.HandleFunc("/login", api.Throttle("login", api.LoginHandler, api.PerIP(20, time.Minute), api.PerAccount(10, time.Minute))).Methods("POST")
+	router.HandleFunc("/forgot-password", api.Throttle("forgot-password", api.ForgotPasswordHandler, api.PerIP(10, time.Hour), api.PerAccount(3, time.Hour))).Methods("POST")
+	router.HandleFunc("/change-password", api.Throttle("change-password", api.ChangePasswordHandler, api.PerIP(20, time.Minute))).Methods("POST")
+	router.HandleFunc("/token/refresh", api.Throttle("token/refresh", api.RefreshTokenHandler, api.PerIP(60, time.Minute))).Methods("POST")
+	router.HandleFunc("/logout", api.Require(utils.PermAccount, nil, api.LogoutHandler)).Methods("POST")
+	router.HandleFunc("/logout-all", api.Require(utils.PermAccount, nil, api.LogoutAllHandler)).Methods("POST")
+
+	// Single sign-on apis
+	router.HandleFunc("/auth/providers", api.ListAuthProvidersHandler).Methods("GET")
+	router.HandleFunc("/auth/{provider}/login", api.Throttle("auth/login", api.SSOLoginHandler, api.PerIP(30, time.Minute))).Methods("GET")
+	router.HandleFunc("/auth/{provider}/callback", api.Throttle("auth/callback", api.SSOCallbackHandler, api.PerIP(30, time.Minute))).Methods("GET")
+
+	// Two-factor apis, enroll and enable also take the challenge token of a login that has to set 2FA up
+	router.HandleFunc("/2fa/enroll", api.TwoFactorEnrollHandler).Methods("POST")
+	router.HandleFunc("/2fa/enable", api.Throttle("2fa/enable", api.TwoFactorEnableHandler, api.PerIP(20, time.Minute), api.PerAccount(10, time.Minute))).Methods("POST")
+	router.HandleFunc("/2fa/verify", api.Throttle("2fa/verify", api.TwoFactorVerifyHandler, api.PerIP(20, time.Minute), api.PerAccount(10, time.Minute))).Methods("POST")
+	router.HandleFunc("/2fa/disable", api.Require(utils.PermAccount, nil, api.Throttle("2fa/disable", api.TwoFactorDisableHandler, api.PerIP(20, time.Minute), api.PerAccount(10, time.Minute)))).Methods("POST")
+	router.HandleFunc("/2fa/recovery-codes", api.Require(utils.PermAccount, nil, api.Throttle("2fa/recovery-codes", api.TwoFactorRecoveryCodesHandler, api.PerIP(20, time.Minute), api.PerAccount(10, time.Minute)))).Methods("POST")
+	router.HandleFunc("/user/2fa/reset", api.Require(utils.PermTwoFactorReset, nil, api.ResetTwoFactorHandler)).Methods("POST")
+
+	// Invitation apis, the only way to register as an admin
+	router.HandleFunc("/invitations", api.Require(utils.PermInvitationManage, nil, api.CreateInvitationHandler)).Methods("POST")
+	router.HandleFunc("/invitations", api.Require(utils.PermInvitationManage, nil, api.RetrieveInvitationListHandler)).Methods("GET")
+	router.HandleFunc("/invitations/revoke", api.Require(utils.PermInvitationManage, api.OwnsInvitation, api.RevokeInvitationHandler)).Methods("POST")
+	router.HandleFunc("/role-changes", api.Require(utils.PermRoleAuditRead, nil, api.RetrieveRoleChangeListHandler)).Methods("GET")
+
+	// Public keys that verify our JWTs, for other services
+	router.HandleFunc("/.well-known/jwks.json", api.JWKSHandler).Methods("GET")
+	router.HandleFunc("/signing-keys", api.Require(utils.PermSigningKeyManage, nil, api.RetrieveSigningKeyListHandler)).Methods("GET")
+	router.HandleFunc("/signing-keys/rotate", api.Require(utils.PermSigningKeyManage, nil, api.RotateSigningKeyHandler)).Methods("POST")
+	router.HandleFunc("/signing-keys/revoke", api.Require(utils.PermSigningKeyManage, nil, api.RevokeSigningKeyHandler)).Methods("POST")
+
+	// Service accounts and API keys, for scripts and integrations
+	router.HandleFunc("/service-accounts", api.Require(utils.PermServiceAccountManage, nil, api.CreateServiceAccountHandler)).Methods("POST")
+	router.HandleFunc("/service-accounts", api.Require(utils.PermServiceAccountManage, nil, api.RetrieveServiceAccountListHandler)).Methods("GET")
+	router.HandleFunc("/service-accounts/delete", api.Require(utils.PermServiceAccountManage, api.OwnsServiceAccount, api.DeleteServiceAccountHandler)).Methods("DELETE")
+	router.HandleFunc("/api-keys", api.Require(utils.PermAPIKeyManage, nil, api.CreateAPIKeyHandler)).Methods("POST")
+	router.HandleFunc("/api-keys", api.Require(utils.PermAPIKeyManage, nil, api.RetrieveAPIKeyListHandler)).Methods("GET")
+	router.HandleFunc("/api-keys/revoke", api.Require(utils.PermAPIKeyManage, api.OwnsAPIKey, api.RevokeAPIKeyHandler)).Methods("POST")
 
 	// Current User profile
-	router.HandleFunc("/user/profile", api.RetrieveCurrentUserProfileHandler).Methods("GET")
+	router.HandleFunc("/user/profile", api.Require(utils.PermAccount, nil, api.RetrieveCurrentUserProfileHandler)).Methods("GET")
 	
 	// User model apis
-	router.HandleFunc("/user/create", api.CreateUserHandler).Methods("POST")
-	router.HandleFunc("/user/list", api.RetrieveUserListHandler).Methods("GET")
-	router.HandleFunc("/user/detail", api.RetrieveUserDetailHandler).Methods("GET")
-	router.HandleFunc("/user/update", api.UpdateUserPatchHandler).Methods("PATCH")
-	router.HandleFunc("/user/delete", api.SoftDeleteUserHandler).Methods("DELETE")
+	router.HandleFunc("/user/create", api.Require(utils.PermUserCreate, nil, api.CreateUserHandler)).Methods("POST")
+	router.HandleFunc("/user/list", api.Require(utils.PermUserRead, nil, api.RetrieveUserListHandler)).Methods("GET")
+	router.HandleFunc("/user/detail", api.Require(utils.PermUserRead, api.OwnsUser, api.RetrieveUserDetailHandler)).Methods("GET")
+	router.HandleFunc("/user/update", api.Require(utils.PermUserUpdate, api.OwnsUser, api.UpdateUserPatchHandler)).Methods("PATCH")
+	router.HandleFunc("/user/delete", api.Require(utils.PermUserDelete, api.OwnsUser, api.SoftDeleteUserHandler)).Methods("DELETE")
+	router.HandleFunc("/user/restore", api.Require(utils.PermUserDelete, api.OwnsUser, api.RestoreUserHandler)).Methods("POST")
 
 	// UserDetails model apis
-	router.HandleFunc("/user-detail/create", api.CreateUserDetailsHandler).Methods("POST")
-	router.HandleFunc("/user-detail/list", api.RetrieveUserDetailsListHandler).Methods("GET")
-	router.HandleFunc("/user-detail/detail", api.RetrieveUserDetailsDetailHandler).Methods("GET")
-	router.HandleFunc("/user-detail/update", api.UpdateUserDetailsPatchHandler).Methods("PATCH")
-	router.HandleFunc("/user-detail/delete", api.SoftDeleteUserDetailsHandler).Methods("DELETE")
+	router.HandleFunc("/user-detail/create", api.Require(utils.PermUserDetailsCreate, nil, api.CreateUserDetailsHandler)).Methods("POST")
+	router.HandleFunc("/user-detail/list", api.Require(utils.PermUserDetailsRead, nil, api.RetrieveUserDetailsListHandler)).Methods("GET")
+	router.HandleFunc("/user-detail/detail", api.Require(utils.PermUserDetailsRead, api.OwnsUserDetails, api.RetrieveUserDetailsDetailHandler)).Methods("GET")
+	router.HandleFunc("/user-detail/update", api.Require(utils.PermUserDetailsUpdate, api.OwnsUserDetails, api.UpdateUserDetailsPatchHandler)).Methods("PATCH")
+	router.HandleFunc("/user-detail/delete", api.Require(utils.PermUserDetailsDelete, api.OwnsUserDetails, api.SoftDeleteUserDetailsHandler)).Methods("DELETE")
+	router.HandleFunc("/user-detail/restore", api.Require(utils.PermUserDetailsDelete, api.OwnsUserDetails, api.RestoreUserDetailsHandler)).Methods("POST")
 
 
 	// QuizEvent model apis
-	router.HandleFunc("/quiz-event/create", api.CreateQuizEventHandler).Methods("POST")
-	router.HandleFunc("/quiz-event/list", api.RetrieveQuizEventListHandler).Methods("GET")
-	router.HandleFunc("/quiz-event/detail", api.RetrieveQuizEventDetailHandler).Methods("GET")
-	router.HandleFunc("/quiz-event/update", api.UpdateQuizEventPatchHandler).Methods("PATCH")
-	router.HandleFunc("/quiz-event/delete", api.SoftDeleteQuizEventHandler).Methods("DELETE")
+	router.HandleFunc("/quiz-event/create", api.Require(utils.PermQuizEventCreate, nil, api.CreateQuizEventHandler)).Methods("POST")
+	router.HandleFunc("/quiz-event/list", api.Require(utils.PermQuizEventRead, nil, api.RetrieveQuizEventListHandler)).Methods("GET")
+	router.HandleFunc("/quiz-event/detail", api.Require(utils.PermQuizEventRead, api.SeesQuizEvent, api.RetrieveQuizEventDetailHandler)).Methods("GET")
+	router.HandleFunc("/quiz-event/update", api.Require(utils.PermQuizEventUpdate, api.OwnsQuizEvent, api.UpdateQuizEventPatchHandler)).Methods("PATCH")
+	router.HandleFunc("/quiz-event/delete", api.Require(utils.PermQuizEventDelete, api.OwnsQuizEvent, api.SoftDeleteQuizEventHandler)).Methods("DELETE")
+	router.HandleFunc("/quiz-event/restore", api.Require(utils.PermQuizEventDelete, api.OwnsQuizEvent, api.RestoreQuizEventHandler)).Methods("POST")
 
 
 	// EventResult model apis
-	router.HandleFunc("/event-result/create", api.CreateEventResultHandler).Methods("POST")
-	router.HandleFunc("/event-result/list", api.RetrieveEventResultListHandler).Methods("GET")
-	router.HandleFunc("/event-result/detail", api.RetrieveEventResultDetailHandler).Methods("GET")
-	router.HandleFunc("/event-result/update", api.UpdateEventResultPatchHandler).Methods("PATCH")
-	router.HandleFunc("/event-result/delete", api.SoftDeleteEventResultHandler).Methods("DELETE")
+	router.HandleFunc("/event-result/create", api.Require(utils.PermEventResultCreate, nil, api.CreateEventResultHandler)).Methods("POST")
+	router.HandleFunc("/event-result/list", api.Require(utils.PermEventResultRead, nil, api.RetrieveEventResultListHandler)).Methods("GET")
+	router.HandleFunc("/event-result/detail", api.Require(utils.PermEventResultRead, api.SeesEventResult, api.RetrieveEventResultDetailHandler)).Methods("GET")
+	router.HandleFunc("/event-result/update", api.Require(utils.PermEventResultUpdate, api.OwnsEventResult, api.UpdateEventResultPatchHandler)).Methods("PATCH")
+	router.HandleFunc("/event-result/delete", api.Require(utils.PermEventResultDelete, api.OwnsEventResult, api.SoftDeleteEventResultHandler)).Methods("DELETE")
+	router.HandleFunc("/event-result/restore", api.Require(utils.PermEventResultDelete, api.OwnsEventResult, api.RestoreEventResultHandler)).Methods("POST")
+
+
+	// Accommodation model apis
+	router.HandleFunc("/accommodation/create", api.Require(utils.PermAccommodationManage, nil, api.CreateAccommodationHandler)).Methods("POST")
+	router.HandleFunc("/accommodation/list", api.Require(utils.PermAccommodationRead, nil, api.RetrieveAccommodationListHandler)).Methods("GET")
+	router.HandleFunc("/accommodation/detail", api.Require(utils.PermAccommodationRead, api.OwnsAccommodation, api.RetrieveAccommodationDetailHandler)).Methods("GET")
+	router.HandleFunc("/accommodation/update", api.Require(utils.PermAccommodationManage, api.ManagesAccommodation, api.UpdateAccommodationPatchHandler)).Methods("PATCH")
+	router.HandleFunc("/accommodation/delete", api.Require(utils.PermAccommodationManage, api.ManagesAccommodation, api.SoftDeleteAccommodationHandler)).Methods("DELETE")
+	router.HandleFunc("/accommodation/restore", api.Require(utils.PermAccommodationManage, api.ManagesAccommodation, api.RestoreAccommodationHandler)).Methods("POST")
 
 
 	// Teacher events api
-	router.HandleFunc("/quiz", api.CreateQuizEvent).Methods("POST")
-	router.HandleFunc("/quiz/{id}/start", api.StartQuiz).Methods("GET")
-	router.HandleFunc("/quiz/{id}/end", api.EndQuiz).Methods("GET")
+	router.HandleFunc("/quiz", api.Require(utils.PermQuizEventCreate, nil, api.CreateQuizEvent)).Methods("POST")
+	router.HandleFunc("/quiz/{id}/start", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.StartQuiz)).Methods("GET")
+	router.HandleFunc("/quiz/{id}/end", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.EndQuiz)).Methods("GET")
+	router.HandleFunc("/quiz/{id}/display-token", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.GetDisplayToken)).Methods("GET")
+	router.HandleFunc("/quiz/{id}/pause", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.PauseQuiz)).Methods("POST")
+	router.HandleFunc("/quiz/{id}/resume", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.ResumeQuiz)).Methods("POST")
+	router.HandleFunc("/quiz/{id}/extend", api.Require(utils.PermQuizRun, api.OwnsQuiz, api.ExtendQuizTime)).Methods("POST")
+	router.HandleFunc("/quiz/{id}/messages", api.Require(utils.PermQuizReview, api.OwnsQuiz, api.GetQuizMessages)).Methods("GET")
+	router.HandleFunc("/quiz/{id}/regrade", api.Require(utils.PermQuizRegrade, api.OwnsQuiz, api.RegradeQuiz)).Methods("POST")
+	router.HandleFunc("/quiz/{id}/regrades", api.Require(utils.PermQuizReview, api.OwnsQuiz, api.GetQuizRegrades)).Methods("GET")
+	router.HandleFunc("/quiz/{id}/calibration", api.Require(utils.PermQuizReview, api.OwnsQuiz, api.GetQuizCalibration)).Methods("GET")
 
 	// Student Join api
-	router.HandleFunc("/quiz/join", api.JoinQuizEvent).Methods("POST")
+	router.HandleFunc("/quiz/join", api.Require(utils.PermQuizJoin, nil, api.Throttle("quiz/join", api.JoinQuizEvent, api.PerIP(30, time.Minute), api.PerAccount(10, time.Minute)))).Methods("POST")
 
 	router.HandleFunc("/ws", sockets.HandleWS)
+	router.HandleFunc("/sse", sockets.HandleSSE).Methods("GET")
+	router.HandleFunc("/sse/send", api.Require(utils.PermQuizJoin, nil, sockets.HandleSSESend)).Methods("POST")
 
 	println("Server running on http://localhost:8080")
 	http.ListenAndServe(utils.GetServerBaseUrl(), router)
@@ -29,6 +29,7 @@ type UserDetails struct {
 	ProfileImage  *string `json:"profile_image"`
 	Department    *string `gorm:"size:256" json:"department"`
 	ExtraInfoJson *datatypes.JSON `json:"extra_json_info"`
+	DepartmentHead bool `gorm:"not null;default:false" json:"department_head"` // may invite teachers and students to their department
 	UserID        uint  `gorm:"uniqueIndex" json:"user_id"`
 	User          *User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
 }
@@ -44,15 +45,214 @@ type QuizEvent struct {
 
 type EventResult struct {
 	gorm.Model
-	UserID        uint `gorm:"uniqueIndex" json:"user_id"`
-	QuizEventID   uint `gorm:"uniqueIndex" json:"quiz_event_id"`
+	UserID        uint `gorm:"uniqueIndex:idx_user_event" json:"user_id"` // one result per student and quiz event
+	QuizEventID   uint `gorm:"uniqueIndex:idx_user_event;index:idx_event_results_quiz_event" json:"quiz_event_id"`
 	QuizEvent     QuizEvent `json:"-"`
 	ExpScore      int  `json:"exp_score"`
 	ExtraInfoJson *datatypes.JSON `json:"extra_json_info"`
+	TeamName      *string `gorm:"size:256" json:"team_name"` // set when the quiz was played in teams
+	TeamScore     *int `json:"team_score"`
 	User          *User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
 }
 
 
+// AuthSession is one login of a user on one device. Access tokens carry its ID so they stop
+// working as soon as it is revoked, the refresh token is rotated on every use and only its
+// hash is stored.
+type AuthSession struct {
+	gorm.Model
+	UserID            uint       `gorm:"index;not null" json:"user_id"`
+	RefreshTokenHash  string     `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	PreviousTokenHash *string    `gorm:"index;size:64" json:"-"` // last rotated out refresh token, reuse means it leaked
+	ExpiresAt         time.Time  `json:"expires_at"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	RevokedAt         *time.Time `json:"revoked_at"`
+	UserAgent         string     `gorm:"size:512" json:"user_agent"`
+	IPAddress         string     `gorm:"size:64" json:"ip_address"`
+	User              *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// TwoFactorAuth is a user's TOTP second factor. The secret is stored encrypted, it only
+// counts once Enabled is set by confirming a first code.
+type TwoFactorAuth struct {
+	gorm.Model
+	UserID          uint       `gorm:"uniqueIndex;not null" json:"user_id"`
+	EncryptedSecret string     `gorm:"not null;size:256" json:"-"`
+	Enabled         bool       `gorm:"not null;default:false" json:"enabled"`
+	EnabledAt       *time.Time `json:"enabled_at"`
+	LastUsedStep    int64      `json:"-"` // time step of the last accepted code, a code is only good once
+	User            *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the device is lost.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `gorm:"index;not null" json:"user_id"`
+	CodeHash string     `gorm:"not null;size:64" json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+	User     *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// Invitation lets someone register with a preset role (and department), it is the only way to
+// become an admin. Only the hash of the token in the invite link is stored.
+type Invitation struct {
+	gorm.Model
+	TokenHash   string     `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	Email       *string    `gorm:"size:256" json:"email"` // when set, only this email can redeem it
+	Role        string     `gorm:"not null;size:16" json:"role"`
+	Department  *string    `gorm:"size:256" json:"department"`
+	InvitedByID uint       `gorm:"index;not null" json:"invited_by_id"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at"`
+	UsedByID    *uint      `json:"used_by_id"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+
+// RoleChange is the audit trail of every role a user was given, by whom and how.
+type RoleChange struct {
+	gorm.Model
+	UserID       uint    `gorm:"index;not null" json:"user_id"`
+	OldRole      *string `gorm:"size:16" json:"old_role"` // nil for a new account
+	NewRole      string  `gorm:"not null;size:16" json:"new_role"`
+	ChangedByID  *uint   `gorm:"index" json:"changed_by_id"`
+	Source       string  `gorm:"not null;size:32" json:"source"` // invitation, self_registration, user_create, user_update, sso or service_account
+	InvitationID *uint   `json:"invitation_id"`
+}
+
+
+// ExternalLogin links a user to their account at an external identity provider (single sign-on).
+type ExternalLogin struct {
+	gorm.Model
+	UserID     uint       `gorm:"index;not null" json:"user_id"`
+	Provider   string     `gorm:"uniqueIndex:idx_external_login;not null;size:64" json:"provider"`
+	Subject    string     `gorm:"uniqueIndex:idx_external_login;not null;size:256" json:"subject"`
+	Email      string     `gorm:"size:256" json:"email"`
+	LastLogin  *time.Time `json:"last_login"`
+	User       *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// ServiceAccount marks a user as a non-human account for scripts and integrations, e.g. an LMS
+// sync. It has no usable password and only authenticates with its API keys.
+type ServiceAccount struct {
+	gorm.Model
+	UserID      uint    `gorm:"uniqueIndex;not null" json:"user_id"`
+	OwnerID     uint    `gorm:"index;not null" json:"owner_id"` // who created it and manages its keys
+	Name        string  `gorm:"not null;size:256" json:"name"`
+	Description *string `gorm:"type:TEXT" json:"description"`
+	User        *User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user,omitempty"`
+}
+
+
+// APIKey authenticates a user or service account without a login. It can only do what both the
+// user's role and its Scopes allow. Only the key's hash is stored, Prefix identifies it in lists.
+type APIKey struct {
+	gorm.Model
+	UserID      uint            `gorm:"index;not null" json:"user_id"`
+	Name        string          `gorm:"not null;size:256" json:"name"`
+	Prefix      string          `gorm:"not null;size:16" json:"prefix"`
+	KeyHash     string          `gorm:"uniqueIndex;not null;size:64" json:"-"`
+	Scopes      datatypes.JSON  `gorm:"not null" json:"scopes"` // permission names
+	CreatedByID uint            `gorm:"index;not null" json:"created_by_id"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	LastUsedAt  *time.Time      `json:"last_used_at"`
+	LastUsedIP  string          `gorm:"size:64" json:"last_used_ip"`
+	RevokedAt   *time.Time      `json:"revoked_at"`
+	User        *User           `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// SigningKey is a key of the JWT key ring. The newest key that is not retired signs, every key
+// that has not expired verifies, so a rotation logs nobody out. The private key is stored encrypted.
+type SigningKey struct {
+	gorm.Model
+	KID                 string     `gorm:"uniqueIndex;not null;size:64" json:"kid"`
+	Algorithm           string     `gorm:"not null;size:16" json:"algorithm"` // EdDSA or RS256
+	EncryptedPrivateKey string     `gorm:"type:TEXT;not null" json:"-"`
+	RetiredAt           *time.Time `json:"retired_at"` // no longer signs
+	ExpiresAt           *time.Time `gorm:"index" json:"expires_at"` // no longer verifies, once the tokens it signed have expired
+}
+
+
+// OTPCode is a pending one-time password of the database OTP store, only the code's hash is kept.
+type OTPCode struct {
+	gorm.Model
+	Purpose   string    `gorm:"uniqueIndex:idx_otp_code;not null;size:32" json:"purpose"`
+	Email     string    `gorm:"uniqueIndex:idx_otp_code;not null;size:256" json:"email"`
+	CodeHash  string    `gorm:"not null;size:64" json:"-"`
+	Payload   string    `gorm:"type:TEXT" json:"-"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"`
+	SentAt    time.Time `json:"sent_at"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+}
+
+
+// Accommodation is a documented time accommodation of a student. Without a QuizEventID it applies
+// to every quiz the student takes, with one it only applies to (and overrides it for) that quiz.
+type Accommodation struct {
+	gorm.Model
+	UserID         uint    `gorm:"index;not null" json:"user_id"`
+	QuizEventID    *uint   `gorm:"index" json:"quiz_event_id"`
+	TimeMultiplier float64 `gorm:"not null;default:1" json:"time_multiplier"`
+	ExtraSeconds   int     `gorm:"not null;default:0" json:"extra_seconds"`
+	Notes          *string `gorm:"type:TEXT" json:"notes"`
+	User           *User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// QuizBan keeps a student out of a quiz event for good, they can neither join nor rejoin.
+type QuizBan struct {
+	gorm.Model
+	QuizEventID uint    `gorm:"uniqueIndex:idx_quiz_ban;not null" json:"quiz_event_id"`
+	UserID      uint    `gorm:"uniqueIndex:idx_quiz_ban;not null" json:"user_id"`
+	BannedBy    uint    `json:"banned_by"`
+	Reason      *string `gorm:"type:TEXT" json:"reason"`
+	User        *User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// RoomMessage is a clarification question, teacher reply or announcement sent in a quiz room,
+// kept with the quiz event for later review.
+type RoomMessage struct {
+	gorm.Model
+	QuizEventID uint    `gorm:"index;not null" json:"quiz_event_id"`
+	Kind        string  `gorm:"not null;size:16" json:"kind"` // question, reply or announcement
+	SenderID    uint    `gorm:"index;not null" json:"sender_id"`
+	RecipientID *uint   `gorm:"index" json:"recipient_id"` // nil for announcements and questions to the teacher
+	QuestionID  *int    `json:"question_id"`                // quiz question the message is about, if any
+	ReplyToID   *uint   `json:"reply_to_id"`
+	Body        string  `gorm:"type:TEXT;not null" json:"body"`
+	Sender      *User   `gorm:"foreignKey:SenderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"-"`
+}
+
+
+// QuizRegrade records a regrade of an ended quiz: who ran it, why, what changed in the answer
+// key and the score of every student before and after.
+type QuizRegrade struct {
+	gorm.Model
+	QuizEventID uint            `gorm:"index;not null" json:"quiz_event_id"`
+	RegradedBy  uint            `gorm:"not null" json:"regraded_by"`
+	QuestionID  *int            `json:"question_id"` // nil when the whole quiz run was regraded
+	Reason      string          `gorm:"type:TEXT;not null" json:"reason"`
+	KeyChange   *datatypes.JSON `json:"key_change"`
+	Diff        *datatypes.JSON `json:"diff"`
+}
+
+
+// ExtraMillis is how much longer than the quiz duration the student gets.
+func (accommodation *Accommodation) ExtraMillis(durationSecs int64) int64 {
+	extra := int64(float64(durationSecs*1000) * (accommodation.TimeMultiplier - 1))
+	if extra < 0 {
+		extra = 0
+	}
+	return extra + int64(accommodation.ExtraSeconds)*1000
+}
+
+
 
 
 func (quizEvent *QuizEvent) GetQuizJsonFileMap()(map[string]any, error){
@@ -0,0 +1,147 @@
+package socManager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// A RoomBus connects the copies of a room that live on different server instances.
+// Every instance keeps its own Room for the clients connected to it, anything sent to
+// clients that are not local is published on the bus, and the room state (participants,
+// timing, quiz json) is stored on it so that an instance can pick up a room it did not create.
+type RoomBus interface {
+	Publish(msg BusMessage) error
+	// Subscribe calls handler for every message published to the room, including our own.
+	Subscribe(roomID string, handler func(BusMessage)) (unsubscribe func(), err error)
+	SaveState(state RoomState) error
+	// LoadState returns nil, nil when the room is unknown.
+	LoadState(roomID string) (*RoomState, error)
+	DeleteState(roomID string) error
+}
+
+// Kinds of bus messages.
+const (
+	BusBroadcast     = "broadcast"      // to every client of the room
+	BusTeacher       = "teacher"        // to the room's teacher
+	BusStudent       = "student"        // to one student, UserID is set
+	BusSpectators    = "spectators"     // to display connections
+	BusState         = "state"          // Payload is a RoomState snapshot
+	BusCommand       = "command"        // handled by the instance the teacher is connected to
+	BusDisconnect    = "disconnect"     // close the connection of one student, UserID is set
+	BusMembers       = "members"        // Payload is a MemberChange
+	BusClientMessage = "client_message" // sent by one student (SSE posts), run where their stream is, UserID is set
+)
+
+type BusMessage struct {
+	Origin  string          `json:"origin"` // instance that published the message
+	Room    string          `json:"room"`
+	Kind    string          `json:"kind"`
+	UserID  uint            `json:"user_id,omitempty"`
+	Command string          `json:"command,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// RoomState is everything an instance needs to rebuild a room it has not seen yet.
+type RoomState struct {
+	Version         int64          `json:"version"` // stale snapshots (lower version) are ignored
+	Origin          string         `json:"origin"`  // instance that took the snapshot, breaks version ties
+	ID              string         `json:"id"`
+	QuizEventID     uint           `json:"quiz_event_id"`
+	TeacherID       uint           `json:"teacher_id"`
+	TeacherInstance string         `json:"teacher_instance"` // instance the teacher's socket is connected to
+	Participants    []uint         `json:"participants"`
+	Started         bool           `json:"started"`
+	Finished        bool           `json:"finished"`
+	EventStartTime  int64          `json:"start_time"`
+	EventEndTime    int64          `json:"end_time"`
+	PausedAt        int64          `json:"paused_at"`
+	PausedMillis    int64          `json:"paused_millis"`
+	Pauses          []Pause        `json:"pauses"`
+	Extensions      map[uint]int64 `json:"extensions"`
+	Accommodations  map[uint]int64 `json:"accommodations"`
+	QuizJson        map[string]any `json:"quiz_json"`
+	Teams           []Team         `json:"teams"`
+	Lobby           LobbySettings  `json:"lobby"`
+	Waiting         map[uint]int64 `json:"waiting"`
+	Rejected        []uint         `json:"rejected"`
+	AutoEnd         bool           `json:"auto_end"`
+}
+
+// InstanceID identifies this server process on the bus.
+var InstanceID = newInstanceID()
+
+func newInstanceID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// LocalBus is the single instance bus, nothing leaves the process.
+type LocalBus struct {
+	states      map[string]RoomState
+	subscribers map[string]map[int]func(BusMessage)
+	nextID      int
+	sync.Mutex
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{
+		states:      make(map[string]RoomState),
+		subscribers: make(map[string]map[int]func(BusMessage)),
+	}
+}
+
+func (b *LocalBus) Publish(msg BusMessage) error {
+	b.Lock()
+	handlers := make([]func(BusMessage), 0, len(b.subscribers[msg.Room]))
+	for _, handler := range b.subscribers[msg.Room] {
+		handlers = append(handlers, handler)
+	}
+	b.Unlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(roomID string, handler func(BusMessage)) (func(), error) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subscribers[roomID]; !ok {
+		b.subscribers[roomID] = make(map[int]func(BusMessage))
+	}
+	b.nextID++
+	id := b.nextID
+	b.subscribers[roomID][id] = handler
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		delete(b.subscribers[roomID], id)
+	}, nil
+}
+
+func (b *LocalBus) SaveState(state RoomState) error {
+	b.Lock()
+	defer b.Unlock()
+	b.states[state.ID] = state
+	return nil
+}
+
+func (b *LocalBus) LoadState(roomID string) (*RoomState, error) {
+	b.Lock()
+	defer b.Unlock()
+	state, ok := b.states[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (b *LocalBus) DeleteState(roomID string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.states, roomID)
+	return nil
+}
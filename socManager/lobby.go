@@ -0,0 +1,229 @@
+package socManager
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// LobbySettings control who gets into a room before the quiz starts.
+type LobbySettings struct {
+	RequireApproval bool `json:"require_approval"` // joins wait for the teacher to admit them
+	MaxParticipants int  `json:"max_participants"` // 0 = no limit
+	Locked          bool `json:"locked"`           // nobody new can join or ask to
+}
+
+// Outcomes of a join request.
+const (
+	JoinAdmitted = "joined"
+	JoinWaiting  = "waiting"
+)
+
+var (
+	ErrRoomLocked   = errors.New("the room is locked")
+	ErrRoomFull     = errors.New("the room is full")
+	ErrJoinRejected = errors.New("your request to join was rejected by the teacher")
+)
+
+// LobbyState is what the teacher sees of the lobby.
+type LobbyState struct {
+	Settings LobbySettings  `json:"settings"`
+	Waiting  []WaitingEntry `json:"waiting"`
+	Admitted []uint         `json:"admitted"`
+	Rejected []uint         `json:"rejected"`
+}
+
+type WaitingEntry struct {
+	UserID      uint  `json:"user_id"`
+	RequestedAt int64 `json:"requested_at"` // unix millis
+}
+
+// MemberChange is one change to who is in the room. Changes are sent over the bus on their own,
+// every instance merges them into its room instead of taking whole member lists from snapshots.
+type MemberChange struct {
+	Admitted []uint         `json:"admitted,omitempty"` // now participants
+	Removed  []uint         `json:"removed,omitempty"`  // no longer participants or waiting
+	Waiting  map[uint]int64 `json:"waiting,omitempty"`  // userID -> unix millis the join was requested
+	Rejected []uint         `json:"rejected,omitempty"`
+}
+
+// applyMembersLocked merges a change, it must be called with the room lock held.
+func (r *Room) applyMembersLocked(change MemberChange) {
+	for _, userID := range change.Admitted {
+		r.Participants[userID] = true
+		delete(r.Waiting, userID)
+		delete(r.Rejected, userID)
+	}
+	for _, userID := range change.Removed {
+		delete(r.Participants, userID)
+		delete(r.Waiting, userID)
+	}
+	for userID, requestedAt := range change.Waiting {
+		if _, waiting := r.Waiting[userID]; !waiting && !r.Participants[userID] {
+			r.Waiting[userID] = requestedAt
+		}
+	}
+	for _, userID := range change.Rejected {
+		delete(r.Waiting, userID)
+		r.Rejected[userID] = true
+	}
+}
+
+// changeMembers applies the change here and sends it to the other instances.
+func (r *Room) changeMembers(change MemberChange) {
+	r.Lock()
+	r.applyMembersLocked(change)
+	r.Unlock()
+	r.shareMembers(change)
+}
+
+func (r *Room) shareMembers(change MemberChange) {
+	r.SyncState()
+	r.publish(BusMembers, 0, change)
+}
+
+func (r *Room) UpdateLobby(settings LobbySettings) {
+	r.Lock()
+	r.Lobby = settings
+	r.Unlock()
+	r.SyncState()
+}
+
+// RequestJoin admits a student straight away, or puts them in the waiting room when the
+// teacher approves joins. Students that are already in are simply admitted again.
+func (r *Room) RequestJoin(userID uint) (string, error) {
+	r.Lock()
+	if r.Participants[userID] {
+		r.Unlock()
+		return JoinAdmitted, nil
+	}
+	if r.Rejected[userID] {
+		r.Unlock()
+		return "", ErrJoinRejected
+	}
+	if r.Lobby.Locked {
+		r.Unlock()
+		return "", ErrRoomLocked
+	}
+	if r.Lobby.MaxParticipants > 0 && len(r.Participants) >= r.Lobby.MaxParticipants {
+		r.Unlock()
+		return "", ErrRoomFull
+	}
+	outcome := JoinAdmitted
+	change := MemberChange{Admitted: []uint{userID}}
+	if r.Lobby.RequireApproval {
+		requestedAt, waiting := r.Waiting[userID]
+		if !waiting {
+			requestedAt = time.Now().UnixMilli()
+		}
+		change = MemberChange{Waiting: map[uint]int64{userID: requestedAt}}
+		outcome = JoinWaiting
+	}
+	r.applyMembersLocked(change)
+	r.Unlock()
+
+	r.shareMembers(change)
+	return outcome, nil
+}
+
+// Admit lets waiting (or previously rejected) students in, as long as there is room.
+// It returns the students that were admitted.
+func (r *Room) Admit(userIDs []uint) ([]uint, error) {
+	r.Lock()
+	admitted := make([]uint, 0, len(userIDs))
+	var err error
+	for _, userID := range userIDs {
+		if r.Participants[userID] {
+			continue
+		}
+		if r.Lobby.MaxParticipants > 0 && len(r.Participants) >= r.Lobby.MaxParticipants {
+			err = ErrRoomFull
+			break
+		}
+		r.applyMembersLocked(MemberChange{Admitted: []uint{userID}})
+		admitted = append(admitted, userID)
+	}
+	r.Unlock()
+
+	r.shareMembers(MemberChange{Admitted: admitted})
+	return admitted, err
+}
+
+// Reject turns waiting students away, they cannot ask again unless the teacher admits them later.
+// Their connections are closed, on whichever instance they are.
+func (r *Room) Reject(userIDs []uint) {
+	r.Lock()
+	rejected := make([]uint, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if r.Participants[userID] || userID == r.TeacherID {
+			continue
+		}
+		r.applyMembersLocked(MemberChange{Rejected: []uint{userID}})
+		r.closeClient(userID)
+		rejected = append(rejected, userID)
+	}
+	r.Unlock()
+	r.shareMembers(MemberChange{Rejected: rejected})
+	for _, userID := range rejected {
+		r.publish(BusDisconnect, userID, nil)
+	}
+}
+
+// RemoveParticipant takes a student out of the room: they are no longer a participant,
+// their pending join request is dropped and their connection is closed, on whichever
+// instance it is.
+func (r *Room) RemoveParticipant(userID uint) {
+	if userID == r.TeacherID {
+		return
+	}
+	change := MemberChange{Removed: []uint{userID}}
+	r.Lock()
+	r.applyMembersLocked(change)
+	r.closeClient(userID)
+	r.Unlock()
+	r.shareMembers(change)
+	r.publish(BusDisconnect, userID, nil)
+}
+
+// closeClient closes the student's connection to this instance, it must be called with the
+// room lock held.
+func (r *Room) closeClient(userID uint) {
+	if client, ok := r.Clients[userID]; ok && userID != r.TeacherID {
+		client.Conn.Close()
+		delete(r.Clients, userID)
+	}
+}
+
+// IsWaiting is true while the student's join request waits for the teacher.
+func (r *Room) IsWaiting(userID uint) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, waiting := r.Waiting[userID]
+	return waiting
+}
+
+func (r *Room) GetLobbyState() LobbyState {
+	r.RLock()
+	defer r.RUnlock()
+	state := LobbyState{
+		Settings: r.Lobby,
+		Waiting:  make([]WaitingEntry, 0, len(r.Waiting)),
+		Admitted: make([]uint, 0, len(r.Participants)),
+		Rejected: make([]uint, 0, len(r.Rejected)),
+	}
+	for userID, requestedAt := range r.Waiting {
+		state.Waiting = append(state.Waiting, WaitingEntry{UserID: userID, RequestedAt: requestedAt})
+	}
+	for userID, allowed := range r.Participants {
+		if allowed {
+			state.Admitted = append(state.Admitted, userID)
+		}
+	}
+	for userID := range r.Rejected {
+		state.Rejected = append(state.Rejected, userID)
+	}
+	sort.Slice(state.Waiting, func(i, j int) bool { return state.Waiting[i].RequestedAt < state.Waiting[j].RequestedAt })
+	sort.Slice(state.Admitted, func(i, j int) bool { return state.Admitted[i] < state.Admitted[j] })
+	sort.Slice(state.Rejected, func(i, j int) bool { return state.Rejected[i] < state.Rejected[j] })
+	return state
+}
@@ -2,41 +2,83 @@ package socManager
 
 import (
     "log"
+    "time"
 	"sync"
     "sync/atomic"
-	"github.com/gorilla/websocket"
+    "encoding/json"
 )
 
+// Connection is what a client is reached through, a websocket or an SSE stream.
+// Implementations must be safe to write to from several goroutines.
+type Connection interface {
+	WriteJSON(v any) error
+	Close() error
+}
+
 type Client struct {
-	Conn     *websocket.Conn
-	UserID   uint
-	UserType string
+	Conn      Connection
+	UserID    uint
+	UserType  string
+	Spectator bool // read-only projector connection, never a participant
 }
 
 type Room struct {
     ID           string
     Clients      map[uint]*Client  // userID -> Client
+    Spectators   map[*Client]bool  // read-only display connections
     TeacherID    uint
     QuizEventID  uint
     EventStartTime int64
     EventEndTime int64
+    QuizJson     map[string]any    // quiz definition, set once the quiz is started
     StartQuiz    atomic.Bool
+    Finished     atomic.Bool       // set once the end timer fired or the quiz was ended by hand
+    PausedAt     int64             // unix millis the quiz was paused at, 0 while running
+    PausedMillis int64             // total time the quiz spent paused
+    Pauses       []Pause           // finished pauses in order, they shift the question windows after them
+    Extensions   map[uint]int64    // userID -> extra millis on top of EventEndTime
+    Accommodations map[uint]int64  // userID -> extra millis from documented accommodations
+    endTimer     *time.Timer
+    onEnd        func()
+    timerLock    sync.Mutex
     StopRoom     chan bool
     Broadcast    chan any  // Broadcast to all
     TeacherChan  chan any  // Messages only for teacher
     Register     chan *Client
     Unregister   chan *Client
     Participants map[uint]bool     // Track allowed participants
+    Teams        []Team            // set in the lobby when the quiz is played in teams
+    Lobby        LobbySettings
+    Waiting      map[uint]int64    // userID -> unix millis the join was requested, while approval is pending
+    Rejected     map[uint]bool     // join requests the teacher turned down
+    AutoEnd      bool              // end the quiz as soon as every participant has submitted
+    TeacherInstance string         // bus instance the teacher's socket is connected to, "" when offline
+    stateVersion int64             // lamport clock of the room state, guarded by the room lock
+    stateOrigin  string            // instance the current state version came from
+    instance     string            // InstanceID, kept per room so tests can run two instances
+    bus          RoomBus
+    unsubscribe  func()
     sync.RWMutex
 }
 
 type Manager struct {
 	Rooms map[string]*Room
+	Bus   RoomBus
+	// CommandHandler runs bus commands (forwarded answers, end of quiz) on the instance
+	// that has the teacher connected, it is set by the sockets package.
+	CommandHandler func(room *Room, msg BusMessage)
+	// SpectatorView turns a room broadcast into what projectors may show (no answer key),
+	// it is set by the sockets package.
+	SpectatorView func(message any) any
+	// ClientMessageHandler runs a message another instance took for a client connected here
+	// (an SSE post landing away from the stream), it is set by the sockets package.
+	ClientMessageHandler func(room *Room, userID uint, payload json.RawMessage)
 	sync.RWMutex
 }
 
 var manager = &Manager{
 	Rooms: make(map[string]*Room),
+	Bus:   NewLocalBus(),
 }
 
 func GetManager() *Manager {
@@ -44,36 +86,85 @@ func GetManager() *Manager {
 	return manager
 }
 
-func (m *Manager) CreateRoom(quizEventID uint, channelCode string, teacherID uint) *Room {
-    log.Printf("Creating a room - quizEventID: %d  |  channel_code: %s  |  teacherID: %d ", quizEventID, channelCode, teacherID)
-    room := &Room{
+// SetBus replaces the in-process bus, it has to be called before any room is created.
+func (m *Manager) SetBus(bus RoomBus) {
+    m.Lock()
+    m.Bus = bus
+    m.Unlock()
+}
+
+func newRoom(quizEventID uint, channelCode string, teacherID uint, bus RoomBus) *Room {
+    return &Room{
         ID:           channelCode,
         QuizEventID:  quizEventID,
         TeacherID:    teacherID,
         Clients:      make(map[uint]*Client),
+        Spectators:   make(map[*Client]bool),
+        Extensions:   make(map[uint]int64),
+        Accommodations: make(map[uint]int64),
         Participants: make(map[uint]bool),
+        Waiting:      make(map[uint]int64),
+        Rejected:     make(map[uint]bool),
         Broadcast:    make(chan any, 10),
         TeacherChan:  make(chan any, 10),
         StopRoom:     make(chan bool),
         Register:     make(chan *Client),
         Unregister:   make(chan *Client),
+        instance:     InstanceID,
+        bus:          bus,
+    }
+}
+
+// attach subscribes the room to the bus and starts it, must be called with the manager lock held.
+func (m *Manager) attach(room *Room) {
+    unsubscribe, err := room.bus.Subscribe(room.ID, room.handleBusMessage)
+    if err != nil {
+        log.Printf("Room %s could not subscribe to the bus, it will only reach local clients: %v", room.ID, err)
     }
-    
+    room.unsubscribe = unsubscribe
+    m.Rooms[room.ID] = room
+    go room.Run()
+}
+
+func (m *Manager) CreateRoom(quizEventID uint, channelCode string, teacherID uint) *Room {
+    log.Printf("Creating a room - quizEventID: %d  |  channel_code: %s  |  teacherID: %d ", quizEventID, channelCode, teacherID)
     m.Lock()
-    m.Rooms[channelCode] = room
+    room := newRoom(quizEventID, channelCode, teacherID, m.Bus)
+    m.attach(room)
     m.Unlock()
-    
-    go room.Run()
+
+    room.SyncState()
     return room
 }
 
+// GetRoom returns the local room, or rebuilds it from the bus when another instance created it.
 func (m *Manager) GetRoom(channelCode string) (*Room, bool) {
     log.Println("GetRoom method --- ")
 	m.RLock()
-	defer m.RUnlock()
 	room, exists := m.Rooms[channelCode]
-    log.Println("GetRoom method - rooms: ", m.Rooms, "room : ", room)
-	return room, exists
+	m.RUnlock()
+	if exists {
+		return room, true
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if room, exists := m.Rooms[channelCode]; exists {
+		return room, true
+	}
+	state, err := m.Bus.LoadState(channelCode)
+	if err != nil {
+		log.Printf("GetRoom - could not load state of room %s from the bus: %v", channelCode, err)
+		return nil, false
+	}
+	if state == nil {
+		return nil, false
+	}
+	room = newRoom(state.QuizEventID, state.ID, state.TeacherID, m.Bus)
+	room.applyState(*state)
+	m.attach(room)
+    log.Printf("GetRoom method - picked up room %s from the bus", channelCode)
+	return room, true
 }
 
 func (r *Room) Run() {
@@ -82,31 +173,47 @@ func (r *Room) Run() {
         select {
         case client := <-r.Register:
             r.Lock()
-            r.Clients[client.UserID] = client
+            if client.Spectator {
+                r.Spectators[client] = true
+                log.Printf("Spectator joined room %s", r.ID)
+            } else {
+                r.Clients[client.UserID] = client
+                log.Printf("Client %d joined room %s", client.UserID, r.ID)
+            }
+            isTeacher := !client.Spectator && client.UserID == r.TeacherID
+            if isTeacher {
+                r.TeacherInstance = r.instance
+            }
             r.Unlock()
-            log.Printf("Client %d joined room %s", client.UserID, r.ID)
+            if isTeacher {
+                go r.SyncState()
+            }
             
         case client := <-r.Unregister:
             r.Lock()
-            if _, ok := r.Clients[client.UserID]; ok {
+            if client.Spectator {
+                if _, ok := r.Spectators[client]; ok {
+                    client.Conn.Close()
+                    delete(r.Spectators, client)
+                    log.Printf("Spectator left room %s", r.ID)
+                }
+            } else if current, ok := r.Clients[client.UserID]; ok && current == client {
                 client.Conn.Close()
                 delete(r.Clients, client.UserID)
                 log.Printf("Client %d left room %s", client.UserID, r.ID)
             }
+            teacherLeft := !client.Spectator && client.UserID == r.TeacherID && r.TeacherInstance == r.instance
+            if teacherLeft {
+                r.TeacherInstance = ""
+            }
             r.Unlock()
+            if teacherLeft {
+                go r.SyncState()
+            }
             
         case message := <-r.Broadcast:
-            r.Lock()
-            for _, client := range r.Clients {
-                if err := client.Conn.WriteJSON(message); err != nil {
-                    log.Printf("Broadcast error to %d: %v", client.UserID, err)
-                    client.Conn.Close()
-                    delete(r.Clients, client.UserID)
-                }
-            }
-            log.Println("Run() method - sending message data to TeacherChan channel ...")
-            r.Unlock()
-            r.TeacherChan <- message // Forwarding the broadcast to the teacher
+            r.deliverBroadcast(message)
+            r.publish(BusBroadcast, 0, message)
             
         // case message := <-r.TeacherChan:
         //     r.RLock()
@@ -120,6 +227,10 @@ func (r *Room) Run() {
         //     r.RUnlock()
         case IsRoomStop := <-r.StopRoom:
             if (IsRoomStop){
+                if r.unsubscribe != nil {
+                    r.unsubscribe()
+                }
+                r.bus.DeleteState(r.ID)
                 break keepLoop;
             }
         }
@@ -129,45 +240,422 @@ func (r *Room) Run() {
 
 
 
-func (r *Room) BroadcastToTeacher(message any) {
+// Quiz is the quiz json of the room. The map is replaced on every change and never changed in
+// place, so it can be read without holding the lock.
+func (r *Room) Quiz() map[string]any {
     r.RLock()
-    
-    if teacherClient, exists := r.Clients[r.TeacherID]; exists {
+    defer r.RUnlock()
+    return r.QuizJson
+}
+
+// SetQuiz replaces the quiz json of the room.
+func (r *Room) SetQuiz(quizJson map[string]any) {
+    r.Lock()
+    r.QuizJson = quizJson
+    r.Unlock()
+}
+
+// UpdateQuiz replaces the quiz json with what change makes of it, under the lock the whole time
+// so two changes at once cannot overwrite each other.
+func (r *Room) UpdateQuiz(change func(quizJson map[string]any) (map[string]any, error)) error {
+    r.Lock()
+    defer r.Unlock()
+    updated, err := change(r.QuizJson)
+    if err != nil {
+        return err
+    }
+    r.QuizJson = updated
+    return nil
+}
+
+
+
+// deliverBroadcast writes to the teacher and the participants connected to this instance,
+// students still waiting in the lobby (or turned away) get nothing of the quiz.
+func (r *Room) deliverBroadcast(message any) {
+    r.Lock()
+    for _, client := range r.Clients {
+        if client.UserID != r.TeacherID && !r.Participants[client.UserID] {
+            continue
+        }
+        if err := client.Conn.WriteJSON(message); err != nil {
+            log.Printf("Broadcast error to %d: %v", client.UserID, err)
+            client.Conn.Close()
+            delete(r.Clients, client.UserID)
+        }
+    }
+    r.writeToSpectators(message)
+    _, teacherIsLocal := r.Clients[r.TeacherID]
+    r.Unlock()
+    if teacherIsLocal {
+        log.Println("Run() method - sending message data to TeacherChan channel ...")
+        r.TeacherChan <- message // Forwarding the broadcast to the teacher
+    }
+}
+
+
+
+// deliverToTeacher returns false when the teacher is not connected to this instance.
+func (r *Room) deliverToTeacher(message any) bool {
+    r.Lock()
+    teacherClient, exists := r.Clients[r.TeacherID]
+    if exists {
         if err := teacherClient.Conn.WriteJSON(message); err != nil {
             log.Printf("Error sending to teacher %d: %v", r.TeacherID, err)
             teacherClient.Conn.Close()
             delete(r.Clients, r.TeacherID)
         }
     }
-    r.RUnlock()
-    r.TeacherChan <- message
+    r.Unlock()
+    if exists {
+        r.TeacherChan <- message
+    }
+    return exists
 }
 
 
 
-func (r *Room) BroadcastToStudent(userID uint, message any) {
-    r.RLock()
-    
-    if client, exists := r.Clients[userID]; exists {
+func (r *Room) BroadcastToTeacher(message any) {
+    if !r.deliverToTeacher(message) {
+        r.publish(BusTeacher, 0, message)
+    }
+}
+
+
+
+// writeToSpectators must be called with the room lock held.
+func (r *Room) writeToSpectators(message any) {
+    if len(r.Spectators) > 0 && manager.SpectatorView != nil {
+        message = manager.SpectatorView(message)
+    }
+    for spectator := range r.Spectators {
+        if err := spectator.Conn.WriteJSON(message); err != nil {
+            log.Printf("Error sending to spectator in room %s: %v", r.ID, err)
+            spectator.Conn.Close()
+            delete(r.Spectators, spectator)
+        }
+    }
+}
+
+
+
+// BroadcastToSpectators sends projector-only data (countdowns, answer distributions).
+func (r *Room) BroadcastToSpectators(message any) {
+    r.Lock()
+    r.writeToSpectators(message)
+    r.Unlock()
+    r.publish(BusSpectators, 0, message)
+}
+
+
+
+// deliverToStudent returns false when the student is not connected to this instance.
+func (r *Room) deliverToStudent(userID uint, message any) bool {
+    r.Lock()
+    client, exists := r.Clients[userID]
+    if exists {
         if err := client.Conn.WriteJSON(message); err != nil {
             log.Printf("Error sending to student %d: %v", userID, err)
             client.Conn.Close()
             delete(r.Clients, userID)
         }
     }
-    r.RUnlock()
-    r.TeacherChan <- message
+    _, teacherIsLocal := r.Clients[r.TeacherID]
+    r.Unlock()
+    if teacherIsLocal {
+        r.TeacherChan <- message
+    }
+    return exists
 }
 
 
-// func (r *Room) Broadcast(message any) {
-//     r.RLock()
-//     defer r.RUnlock()
-//     for _, client := range r.Clients {
-//         if err := client.Conn.WriteJSON(message); err != nil {
-//             log.Printf("Broadcast error to %d: %v", client.UserID, err)
-//             client.Conn.Close()
-//             delete(r.Clients, client.UserID)
-//         }
-//     }
-// }
\ No newline at end of file
+
+func (r *Room) BroadcastToStudent(userID uint, message any) {
+    if !r.deliverToStudent(userID, message) {
+        r.publish(BusStudent, userID, message)
+    }
+}
+
+
+
+func (r *Room) AddParticipant(userID uint) {
+    r.changeMembers(MemberChange{Admitted: []uint{userID}})
+}
+
+
+
+func (r *Room) SetAutoEnd(enabled bool) {
+    r.Lock()
+    r.AutoEnd = enabled
+    r.Unlock()
+    r.SyncState()
+}
+
+
+
+// ParticipantIDs returns the students admitted to the room.
+func (r *Room) ParticipantIDs() []uint {
+    r.RLock()
+    defer r.RUnlock()
+    userIDs := make([]uint, 0, len(r.Participants))
+    for userID, allowed := range r.Participants {
+        if allowed {
+            userIDs = append(userIDs, userID)
+        }
+    }
+    return userIDs
+}
+
+
+
+func (r *Room) IsParticipant(userID uint) bool {
+    r.RLock()
+    defer r.RUnlock()
+    return r.Participants[userID]
+}
+
+
+
+// TeacherIsRemote is true when the teacher's socket (and with it the quiz timer and
+// answer session) lives on another instance.
+func (r *Room) TeacherIsRemote() bool {
+    r.RLock()
+    defer r.RUnlock()
+    return r.TeacherInstance != "" && r.TeacherInstance != r.instance
+}
+
+
+
+// SendCommand asks the teacher's instance to run a command for this room.
+func (r *Room) SendCommand(command string, userID uint, payload any) error {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    return r.bus.Publish(BusMessage{
+        Origin:  r.instance,
+        Room:    r.ID,
+        Kind:    BusCommand,
+        UserID:  userID,
+        Command: command,
+        Payload: data,
+    })
+}
+
+
+
+// ForwardClientMessage hands a message of the student to the instance their connection lives on.
+func (r *Room) ForwardClientMessage(userID uint, payload json.RawMessage) {
+    r.publish(BusClientMessage, userID, payload)
+}
+
+
+
+func (r *Room) publish(kind string, userID uint, message any) {
+    data, err := json.Marshal(message)
+    if err != nil {
+        log.Printf("Room %s could not encode %s message for the bus: %v", r.ID, kind, err)
+        return
+    }
+    if err := r.bus.Publish(BusMessage{Origin: r.instance, Room: r.ID, Kind: kind, UserID: userID, Payload: data}); err != nil {
+        log.Printf("Room %s could not publish %s message: %v", r.ID, kind, err)
+    }
+}
+
+
+
+// handleBusMessage delivers what other instances published to the clients connected here.
+func (r *Room) handleBusMessage(msg BusMessage) {
+    if msg.Origin == r.instance {
+        return
+    }
+
+    if msg.Kind == BusMembers {
+        var change MemberChange
+        if err := json.Unmarshal(msg.Payload, &change); err != nil {
+            log.Printf("Room %s got an invalid member change from the bus: %v", r.ID, err)
+            return
+        }
+        r.Lock()
+        r.applyMembersLocked(change)
+        r.Unlock()
+        return
+    }
+
+    if msg.Kind == BusState {
+        var state RoomState
+        if err := json.Unmarshal(msg.Payload, &state); err != nil {
+            log.Printf("Room %s got an invalid state from the bus: %v", r.ID, err)
+            return
+        }
+        r.applyState(state)
+        return
+    }
+
+    if msg.Kind == BusDisconnect {
+        r.Lock()
+        r.closeClient(msg.UserID)
+        r.Unlock()
+        return
+    }
+
+    if msg.Kind == BusClientMessage {
+        if manager.ClientMessageHandler != nil {
+            manager.ClientMessageHandler(r, msg.UserID, msg.Payload)
+        }
+        return
+    }
+
+    if msg.Kind == BusCommand {
+        r.RLock()
+        _, teacherIsLocal := r.Clients[r.TeacherID]
+        r.RUnlock()
+        if teacherIsLocal && manager.CommandHandler != nil {
+            manager.CommandHandler(r, msg)
+        }
+        return
+    }
+
+    var message map[string]any
+    if err := json.Unmarshal(msg.Payload, &message); err != nil {
+        log.Printf("Room %s got an invalid %s message from the bus: %v", r.ID, msg.Kind, err)
+        return
+    }
+
+    switch msg.Kind {
+    case BusBroadcast:
+        r.deliverBroadcast(message)
+    case BusTeacher:
+        r.deliverToTeacher(message)
+    case BusStudent:
+        r.deliverToStudent(msg.UserID, message)
+    case BusSpectators:
+        r.Lock()
+        r.writeToSpectators(message)
+        r.Unlock()
+    }
+}
+
+
+
+func (r *Room) snapshot() RoomState {
+    r.Lock()
+    r.stateVersion++
+    r.stateOrigin = r.instance
+    state := RoomState{
+        Version:         r.stateVersion,
+        Origin:          r.instance,
+        ID:              r.ID,
+        QuizEventID:     r.QuizEventID,
+        TeacherID:       r.TeacherID,
+        TeacherInstance: r.TeacherInstance,
+        Participants:    make([]uint, 0, len(r.Participants)),
+        Started:         r.StartQuiz.Load(),
+        Finished:        r.Finished.Load(),
+        QuizJson:        r.QuizJson,
+        Teams:           r.Teams,
+        Lobby:           r.Lobby,
+        AutoEnd:         r.AutoEnd,
+        Waiting:         make(map[uint]int64, len(r.Waiting)),
+        Rejected:        make([]uint, 0, len(r.Rejected)),
+    }
+    for userID, requestedAt := range r.Waiting {
+        state.Waiting[userID] = requestedAt
+    }
+    for userID := range r.Rejected {
+        state.Rejected = append(state.Rejected, userID)
+    }
+    for userID, allowed := range r.Participants {
+        if allowed {
+            state.Participants = append(state.Participants, userID)
+        }
+    }
+    r.Unlock()
+
+    r.timerLock.Lock()
+    state.EventStartTime = r.EventStartTime
+    state.EventEndTime = r.EventEndTime
+    state.PausedAt = r.PausedAt
+    state.PausedMillis = r.PausedMillis
+    state.Pauses = append([]Pause(nil), r.Pauses...)
+    state.Extensions = make(map[uint]int64, len(r.Extensions))
+    for userID, extra := range r.Extensions {
+        state.Extensions[userID] = extra
+    }
+    state.Accommodations = make(map[uint]int64, len(r.Accommodations))
+    for userID, extra := range r.Accommodations {
+        state.Accommodations[userID] = extra
+    }
+    r.timerLock.Unlock()
+    return state
+}
+
+
+
+// SyncState stores the room state on the bus and pushes it to the other instances.
+func (r *Room) SyncState() {
+    state := r.snapshot()
+    if err := r.bus.SaveState(state); err != nil {
+        log.Printf("Room %s could not save its state: %v", r.ID, err)
+    }
+    r.publish(BusState, 0, state)
+}
+
+
+
+// applyState takes over a newer snapshot. Versions are a lamport clock: every instance moves
+// past the versions it has seen, and equal versions are ordered by instance. Who is in the room
+// is only taken from the snapshot a room is rebuilt from, after that it is kept up to date by
+// the member changes, so joins on two instances at once are both kept.
+func (r *Room) applyState(state RoomState) {
+    r.Lock()
+    if state.Version < r.stateVersion || state.Version == r.stateVersion && state.Origin <= r.stateOrigin {
+        r.Unlock()
+        return
+    }
+    rebuilding := r.stateVersion == 0
+    r.stateVersion = state.Version
+    r.stateOrigin = state.Origin
+    r.TeacherInstance = state.TeacherInstance
+    if rebuilding {
+        r.Participants = make(map[uint]bool, len(state.Participants))
+        for _, userID := range state.Participants {
+            r.Participants[userID] = true
+        }
+        r.Waiting = make(map[uint]int64, len(state.Waiting))
+        for userID, requestedAt := range state.Waiting {
+            r.Waiting[userID] = requestedAt
+        }
+        r.Rejected = make(map[uint]bool, len(state.Rejected))
+        for _, userID := range state.Rejected {
+            r.Rejected[userID] = true
+        }
+    }
+    if state.QuizJson != nil {
+        r.QuizJson = state.QuizJson
+    }
+    r.Teams = state.Teams
+    r.Lobby = state.Lobby
+    r.AutoEnd = state.AutoEnd
+    r.Unlock()
+
+    r.timerLock.Lock()
+    r.StartQuiz.Store(state.Started)
+    if state.Finished {
+        r.Finished.Store(true)
+    }
+    r.EventStartTime = state.EventStartTime
+    r.EventEndTime = state.EventEndTime
+    r.PausedAt = state.PausedAt
+    r.PausedMillis = state.PausedMillis
+    r.Pauses = state.Pauses
+    if state.Extensions != nil {
+        r.Extensions = state.Extensions
+    }
+    if state.Accommodations != nil {
+        r.Accommodations = state.Accommodations
+    }
+    // Only the instance that scheduled the end (the teacher's) actually has a timer to move.
+    r.rescheduleLocked()
+    r.timerLock.Unlock()
+}
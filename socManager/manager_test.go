@@ -0,0 +1,199 @@
+package socManager
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn is a client connection that keeps what was written to it.
+type recordingConn struct {
+	mu       sync.Mutex
+	messages []any
+	closed   bool
+}
+
+func (c *recordingConn) WriteJSON(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, v)
+	return nil
+}
+
+func (c *recordingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *recordingConn) received() []any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]any(nil), c.messages...)
+}
+
+// newInstanceRoom is the copy of a room one server instance keeps. Both copies share a LocalBus,
+// which stands in for redis: messages reach the other instance as json just the same.
+func newInstanceRoom(t *testing.T, bus RoomBus, instance string) *Room {
+	t.Helper()
+	room := newRoom(1, "ROOM42", 100, bus)
+	room.instance = instance
+	unsubscribe, err := bus.Subscribe(room.ID, room.handleBusMessage)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	room.unsubscribe = unsubscribe
+	go room.Run()
+	t.Cleanup(func() { room.StopRoom <- true })
+	return room
+}
+
+func connect(room *Room, userID uint) *recordingConn {
+	conn := &recordingConn{}
+	room.Register <- &Client{Conn: conn, UserID: userID, UserType: "student"}
+	return conn
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJoinsOnTwoInstancesAreBothKept(t *testing.T) {
+	bus := NewLocalBus()
+	roomA := newInstanceRoom(t, bus, "instance-a")
+	roomB := newInstanceRoom(t, bus, "instance-b")
+
+	// Instance A moves its state version well ahead of B before B sees a join.
+	for i := 0; i < 5; i++ {
+		roomA.UpdateLobby(LobbySettings{MaxParticipants: 10})
+	}
+	if _, err := roomB.RequestJoin(7); err != nil {
+		t.Fatalf("join on B: %v", err)
+	}
+	if _, err := roomA.RequestJoin(8); err != nil {
+		t.Fatalf("join on A: %v", err)
+	}
+
+	for _, room := range []*Room{roomA, roomB} {
+		for _, userID := range []uint{7, 8} {
+			if !room.IsParticipant(userID) {
+				t.Errorf("%s: student %d is not a participant", room.instance, userID)
+			}
+		}
+	}
+
+	roomA.RemoveParticipant(7)
+	if roomB.IsParticipant(7) {
+		t.Errorf("instance-b: student 7 is still a participant after being removed on A")
+	}
+	if !roomB.IsParticipant(8) {
+		t.Errorf("instance-b: removing student 7 dropped student 8")
+	}
+}
+
+func TestBroadcastReachesParticipantsOnOtherInstances(t *testing.T) {
+	bus := NewLocalBus()
+	roomA := newInstanceRoom(t, bus, "instance-a")
+	roomB := newInstanceRoom(t, bus, "instance-b")
+
+	roomA.UpdateLobby(LobbySettings{RequireApproval: true})
+	if _, err := roomB.RequestJoin(7); err != nil {
+		t.Fatalf("join on B: %v", err)
+	}
+	if _, err := roomB.RequestJoin(9); err != nil {
+		t.Fatalf("join on B: %v", err)
+	}
+	if _, err := roomA.Admit([]uint{7}); err != nil {
+		t.Fatalf("admit on A: %v", err)
+	}
+	admitted := connect(roomB, 7)
+	waiting := connect(roomB, 9)
+	waitFor(t, "both students to connect to B", func() bool {
+		roomB.RLock()
+		defer roomB.RUnlock()
+		return len(roomB.Clients) == 2
+	})
+
+	roomA.Broadcast <- map[string]any{"type": "question", "payload": "hello"}
+
+	waitFor(t, "the broadcast to reach student 7 on B", func() bool { return len(admitted.received()) == 1 })
+	message, ok := admitted.received()[0].(map[string]any)
+	if !ok || message["type"] != "question" || message["payload"] != "hello" {
+		t.Fatalf("student 7 got %#v", admitted.received()[0])
+	}
+	if got := waiting.received(); len(got) != 0 {
+		t.Errorf("waiting student 9 got the broadcast: %#v", got)
+	}
+
+	roomA.Reject([]uint{9})
+	waitFor(t, "the rejected student's connection on B to close", func() bool {
+		waiting.mu.Lock()
+		defer waiting.mu.Unlock()
+		return waiting.closed
+	})
+}
+
+func TestConcurrentQuizUpdatesAreNotLost(t *testing.T) {
+	room := newRoom(1, "ROOM42", 100, NewLocalBus())
+	room.SetQuiz(map[string]any{"edits": 0})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room.UpdateQuiz(func(quizJson map[string]any) (map[string]any, error) {
+				edits, _ := quizJson["edits"].(int)
+				return map[string]any{"edits": edits + 1}, nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if edits := room.Quiz()["edits"]; edits != 50 {
+		t.Fatalf("quiz has %v edits, want 50", edits)
+	}
+}
+
+func TestClientMessagesReachTheInstanceOfTheConnection(t *testing.T) {
+	bus := NewLocalBus()
+	roomA := newInstanceRoom(t, bus, "instance-a")
+	roomB := newInstanceRoom(t, bus, "instance-b")
+
+	type forwarded struct {
+		room    *Room
+		userID  uint
+		payload string
+	}
+	got := make(chan forwarded, 2)
+	previous := manager.ClientMessageHandler
+	manager.ClientMessageHandler = func(room *Room, userID uint, payload json.RawMessage) {
+		got <- forwarded{room, userID, string(payload)}
+	}
+	t.Cleanup(func() { manager.ClientMessageHandler = previous })
+
+	roomA.ForwardClientMessage(7, json.RawMessage(`{"type":"answer"}`))
+
+	select {
+	case msg := <-got:
+		if msg.room != roomB || msg.userID != 7 || msg.payload != `{"type":"answer"}` {
+			t.Fatalf("instance-b got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message never reached instance-b")
+	}
+	select {
+	case msg := <-got:
+		t.Fatalf("the message was also run on %s", msg.room.instance)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,98 @@
+package socManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBus shares rooms between instances with redis pub/sub, room state is kept
+// in a plain key that expires a day after the last change.
+type RedisBus struct {
+	client   *redis.Client
+	prefix   string
+	stateTTL time.Duration
+}
+
+// NewRedisBus connects to a redis url such as redis://localhost:6379/0.
+func NewRedisBus(redisURL string) (*RedisBus, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &RedisBus{client: client, prefix: "quizzer", stateTTL: 24 * time.Hour}, nil
+}
+
+func (b *RedisBus) channel(roomID string) string {
+	return b.prefix + ":room:" + roomID
+}
+
+func (b *RedisBus) stateKey(roomID string) string {
+	return b.prefix + ":room-state:" + roomID
+}
+
+func (b *RedisBus) Publish(msg BusMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel(msg.Room), data).Err()
+}
+
+func (b *RedisBus) Subscribe(roomID string, handler func(BusMessage)) (func(), error) {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.channel(roomID))
+	// Wait for the subscription to be confirmed so no message published right after is missed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	go func() {
+		for redisMsg := range pubsub.Channel() {
+			var msg BusMessage
+			if err := json.Unmarshal([]byte(redisMsg.Payload), &msg); err != nil {
+				log.Printf("Invalid bus message on %s: %v", redisMsg.Channel, err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+
+	return func() { pubsub.Close() }, nil
+}
+
+func (b *RedisBus) SaveState(state RoomState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return b.client.Set(context.Background(), b.stateKey(state.ID), data, b.stateTTL).Err()
+}
+
+func (b *RedisBus) LoadState(roomID string) (*RoomState, error) {
+	data, err := b.client.Get(context.Background(), b.stateKey(roomID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state RoomState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (b *RedisBus) DeleteState(roomID string) error {
+	return b.client.Del(context.Background(), b.stateKey(roomID)).Err()
+}
@@ -0,0 +1,126 @@
+package socManager
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Team is a group of students that submits one answer per question.
+type Team struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Captain uint   `json:"captain"` // defaults to the first member
+	Members []uint `json:"members"`
+}
+
+// SetTeams replaces the teams of the room. Teams can only be formed in the lobby, every
+// member has to be a participant and can only be on one team.
+func (r *Room) SetTeams(teams []Team) error {
+	if r.StartQuiz.Load() {
+		return errors.New("teams can only be changed before the quiz starts")
+	}
+
+	r.Lock()
+	seen := make(map[uint]bool)
+	formed := make([]Team, 0, len(teams))
+	for i, team := range teams {
+		if len(team.Members) == 0 {
+			continue
+		}
+		for _, userID := range team.Members {
+			if !r.Participants[userID] {
+				r.Unlock()
+				return fmt.Errorf("user %d is not a participant", userID)
+			}
+			if seen[userID] {
+				r.Unlock()
+				return fmt.Errorf("user %d is on more than one team", userID)
+			}
+			seen[userID] = true
+		}
+		team.ID = i + 1
+		if team.Name == "" {
+			team.Name = fmt.Sprintf("Team %d", team.ID)
+		}
+		if !containsUser(team.Members, team.Captain) {
+			team.Captain = team.Members[0]
+		}
+		team.Members = append([]uint(nil), team.Members...)
+		formed = append(formed, team)
+	}
+	r.Teams = formed
+	r.Unlock()
+
+	r.SyncState()
+	return nil
+}
+
+// AutoBalanceTeams deals the participants out over count teams of (nearly) equal size.
+func (r *Room) AutoBalanceTeams(count int) ([]Team, error) {
+	if count < 1 {
+		return nil, errors.New("at least one team is needed")
+	}
+
+	r.RLock()
+	userIDs := make([]uint, 0, len(r.Participants))
+	for userID, allowed := range r.Participants {
+		if allowed {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	r.RUnlock()
+	if len(userIDs) == 0 {
+		return nil, errors.New("no participants to put in teams")
+	}
+	if count > len(userIDs) {
+		count = len(userIDs)
+	}
+
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	rand.Shuffle(len(userIDs), func(i, j int) { userIDs[i], userIDs[j] = userIDs[j], userIDs[i] })
+
+	teams := make([]Team, count)
+	for i, userID := range userIDs {
+		teams[i%count].Members = append(teams[i%count].Members, userID)
+	}
+	if err := r.SetTeams(teams); err != nil {
+		return nil, err
+	}
+	return r.GetTeams(), nil
+}
+
+// GetTeams returns a copy of the room's teams.
+func (r *Room) GetTeams() []Team {
+	r.RLock()
+	defer r.RUnlock()
+	teams := make([]Team, len(r.Teams))
+	for i, team := range r.Teams {
+		team.Members = append([]uint(nil), team.Members...)
+		teams[i] = team
+	}
+	return teams
+}
+
+// TeamOf returns the team a student is on.
+func (r *Room) TeamOf(userID uint) (Team, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, team := range r.Teams {
+		if containsUser(team.Members, userID) {
+			team.Members = append([]uint(nil), team.Members...)
+			return team, true
+		}
+	}
+	return Team{}, false
+}
+
+func containsUser(userIDs []uint, userID uint) bool {
+	for _, id := range userIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package socManager
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// The room owns the quiz end timer so that it can be paused, resumed and extended
+// while the quiz is running. EventEndTime is the shared deadline, Extensions hold
+// extra time given to individual students on top of it.
+
+// Pause is one stretch of time the quiz was paused for, At is when it began (unix millis).
+type Pause struct {
+	At     int64 `json:"at"`
+	Millis int64 `json:"millis"`
+}
+
+// ScheduleEnd sets the quiz times when it starts and ends the quiz at endTime.
+func (r *Room) ScheduleEnd(startTime int64, endTime int64, onEnd func()) {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	r.EventStartTime = startTime
+	r.EventEndTime = endTime
+	r.onEnd = onEnd
+	r.rescheduleLocked()
+}
+
+// rescheduleLocked restarts the end timer at the latest deadline of anyone in the room.
+func (r *Room) rescheduleLocked() {
+	if r.endTimer != nil {
+		r.endTimer.Stop()
+	}
+	if r.onEnd == nil || r.Finished.Load() || r.PausedAt != 0 {
+		return
+	}
+	finalEnd := r.EventEndTime
+	for userID := range r.Accommodations {
+		if end := r.studentEndTimeLocked(userID); end > finalEnd {
+			finalEnd = end
+		}
+	}
+	for userID := range r.Extensions {
+		if end := r.studentEndTimeLocked(userID); end > finalEnd {
+			finalEnd = end
+		}
+	}
+	delay := time.Until(time.UnixMilli(finalEnd))
+	log.Printf("Room %s end timer set for %f seconds", r.ID, delay.Seconds())
+	r.endTimer = time.AfterFunc(delay, func() {
+		r.timerLock.Lock()
+		if r.Finished.Load() {
+			r.timerLock.Unlock()
+			return
+		}
+		r.Finished.Store(true)
+		onEnd := r.onEnd
+		r.timerLock.Unlock()
+		onEnd()
+	})
+}
+
+// Pause freezes the clock, answers are not accepted until Resume.
+func (r *Room) Pause() error {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	if r.Finished.Load() || !r.StartQuiz.Load() && r.PausedAt == 0 {
+		return errors.New("quiz is not running")
+	}
+	if r.PausedAt != 0 {
+		return errors.New("quiz is already paused")
+	}
+	r.PausedAt = time.Now().UnixMilli()
+	r.StartQuiz.Store(false)
+	if r.endTimer != nil {
+		r.endTimer.Stop()
+	}
+	return nil
+}
+
+// Resume pushes the deadline back by however long the quiz was paused and returns the new end time.
+func (r *Room) Resume() (int64, error) {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	if r.PausedAt == 0 {
+		return 0, errors.New("quiz is not paused")
+	}
+	pausedFor := time.Now().UnixMilli() - r.PausedAt
+	r.EventEndTime += pausedFor
+	r.PausedMillis += pausedFor
+	r.Pauses = append(r.Pauses, Pause{At: r.PausedAt, Millis: pausedFor})
+	r.PausedAt = 0
+	r.StartQuiz.Store(true)
+	r.rescheduleLocked()
+	return r.EventEndTime, nil
+}
+
+// Extend adds time for everyone, or only for the given students when userIDs is not empty.
+func (r *Room) Extend(extraMillis int64, userIDs []uint) (int64, error) {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	if r.Finished.Load() {
+		return 0, errors.New("quiz has already ended")
+	}
+	if r.EventEndTime == 0 || !r.StartQuiz.Load() && r.PausedAt == 0 {
+		return 0, errors.New("quiz has not started yet")
+	}
+	if len(userIDs) == 0 {
+		r.EventEndTime += extraMillis
+	} else {
+		for _, userID := range userIDs {
+			r.Extensions[userID] += extraMillis
+		}
+	}
+	r.rescheduleLocked()
+	return r.EventEndTime, nil
+}
+
+// StudentEndTime is the deadline of one student, the shared end time plus any extension
+// and accommodation.
+func (r *Room) StudentEndTime(userID uint) int64 {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.studentEndTimeLocked(userID)
+}
+
+// StudentExtraMillis is the extra time one student gets over everyone else.
+func (r *Room) StudentExtraMillis(userID uint) int64 {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.Extensions[userID] + r.Accommodations[userID]
+}
+
+func (r *Room) studentEndTimeLocked(userID uint) int64 {
+	return r.EventEndTime + r.Extensions[userID] + r.Accommodations[userID]
+}
+
+// SetAccommodations replaces the accommodated extra time of students and moves the end timer accordingly.
+func (r *Room) SetAccommodations(extraMillis map[uint]int64) {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	r.Accommodations = extraMillis
+	r.rescheduleLocked()
+}
+
+// RemainingMillis of the shared deadline, frozen while the quiz is paused.
+func (r *Room) RemainingMillis() int64 {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.millisUntilLocked(r.EventEndTime)
+}
+
+// MillisUntil is RemainingMillis for another deadline, e.g. a student's own.
+func (r *Room) MillisUntil(endTime int64) int64 {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.millisUntilLocked(endTime)
+}
+
+func (r *Room) millisUntilLocked(endTime int64) int64 {
+	now := time.Now().UnixMilli()
+	if r.PausedAt != 0 {
+		now = r.PausedAt
+	}
+	if remaining := endTime - now; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// EventTimes returns when the quiz started and when it ends for everyone, in unix millis.
+func (r *Room) EventTimes() (int64, int64) {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.EventStartTime, r.EventEndTime
+}
+
+func (r *Room) IsPaused() bool {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	return r.PausedAt != 0
+}
+
+// FinishTimer stops the end timer when the quiz is ended by hand.
+func (r *Room) FinishTimer() {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	r.Finished.Store(true)
+	if r.endTimer != nil {
+		r.endTimer.Stop()
+	}
+}
+
+// ShiftByPauses moves a point of the quiz schedule (e.g. a question closing) back by the pauses
+// that began before it was reached. A pause after a question closed leaves it closed.
+func (r *Room) ShiftByPauses(at int64) int64 {
+	r.timerLock.Lock()
+	defer r.timerLock.Unlock()
+	for _, pause := range r.Pauses {
+		if pause.At >= at {
+			break
+		}
+		at += pause.Millis
+	}
+	if r.PausedAt != 0 && r.PausedAt < at {
+		at += time.Now().UnixMilli() - r.PausedAt
+	}
+	return at
+}
+
+// EndNow ends the quiz right away as if the end timer had fired, e.g. once every student
+// has submitted. It returns false when the quiz has already ended or was never scheduled.
+func (r *Room) EndNow() bool {
+	r.timerLock.Lock()
+	if r.Finished.Load() || r.onEnd == nil {
+		r.timerLock.Unlock()
+		return false
+	}
+	r.Finished.Store(true)
+	if r.endTimer != nil {
+		r.endTimer.Stop()
+	}
+	onEnd := r.onEnd
+	r.timerLock.Unlock()
+	go onEnd()
+	return true
+}
@@ -0,0 +1,91 @@
+package sockets
+
+import (
+	"log"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+)
+
+const (
+	MsgTypeGetAccommodations = "get_accommodations"
+	MsgTypeAccommodations    = "accommodations"
+)
+
+type accommodationInfo struct {
+	UserID         uint    `json:"user_id"`
+	TimeMultiplier float64 `json:"time_multiplier"`
+	ExtraSeconds   int     `json:"extra_seconds"`
+	EndTime        int64   `json:"end_time"`
+}
+
+// loadAccommodations returns the accommodation of every participant that has one,
+// a quiz specific accommodation wins over the student's general one.
+func loadAccommodations(room *socManager.Room) map[uint]models.Accommodation {
+	room.RLock()
+	userIDs := make([]uint, 0, len(room.Participants))
+	for userID := range room.Participants {
+		userIDs = append(userIDs, userID)
+	}
+	room.RUnlock()
+
+	accommodations := make(map[uint]models.Accommodation)
+	if len(userIDs) == 0 {
+		return accommodations
+	}
+
+	var rows []models.Accommodation
+	if err := db.DB.Where("user_id IN ?", userIDs).Find(&rows).Error; err != nil {
+		log.Printf("Error loading accommodations for room %s: %v", room.ID, err)
+		return accommodations
+	}
+
+	for _, row := range rows {
+		if row.QuizEventID != nil && *row.QuizEventID != room.QuizEventID {
+			continue
+		}
+		if existing, ok := accommodations[row.UserID]; ok && existing.QuizEventID != nil {
+			continue
+		}
+		accommodations[row.UserID] = row
+	}
+	return accommodations
+}
+
+// applyAccommodations gives every accommodated student their own deadline once the quiz starts,
+// tells them about it and sends the teacher the list of students with extended time.
+func applyAccommodations(room *socManager.Room, durationSecs int64) {
+	accommodations := loadAccommodations(room)
+	extraMillis := make(map[uint]int64)
+	for userID, accommodation := range accommodations {
+		if extra := accommodation.ExtraMillis(durationSecs); extra > 0 {
+			extraMillis[userID] = extra
+		}
+	}
+	room.SetAccommodations(extraMillis)
+	room.SyncState()
+
+	for userID := range extraMillis {
+		room.BroadcastToStudent(userID, timeUpdate(room, room.StudentEndTime(userID)))
+	}
+	room.BroadcastToTeacher(accommodationsMessage(room, accommodations))
+}
+
+func accommodationsMessage(room *socManager.Room, accommodations map[uint]models.Accommodation) map[string]any {
+	list := make([]accommodationInfo, 0, len(accommodations))
+	for userID, accommodation := range accommodations {
+		list = append(list, accommodationInfo{
+			UserID:         userID,
+			TimeMultiplier: accommodation.TimeMultiplier,
+			ExtraSeconds:   accommodation.ExtraSeconds,
+			EndTime:        room.StudentEndTime(userID),
+		})
+	}
+	return map[string]any{
+		"type": MsgTypeAccommodations,
+		"payload": map[string]any{
+			"accommodations": list,
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package sockets
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeAnswerAggregates = "answer_aggregates"
+)
+
+// answerAggregateInterval caps how often aggregates are pushed to the teacher, answer
+// distributions to the projectors and, for quizzes without question windows, the leaderboard, answers that come in meanwhile are folded into the next push
+// so big rooms don't flood those sockets.
+const answerAggregateInterval = time.Second
+
+// AnswerUpdate is one accepted answer, the teacher gets them with the next aggregates.
+type AnswerUpdate struct {
+	UserID     uint  `json:"user_id"`
+	QuestionID int   `json:"question_id"`
+	Answer     any   `json:"answer"`
+	Timestamp  int64 `json:"timestamp"`
+}
+
+type aggregateThrottle struct {
+	dirty     map[int]bool   // questions answered since the last push
+	answers   []AnswerUpdate // answers accepted since the last push
+	scheduled bool
+}
+
+var (
+	aggregateThrottles     = make(map[string]*aggregateThrottle) // room ID -> throttle
+	aggregateThrottlesLock sync.Mutex
+)
+
+// queueAnswerAggregates keeps the answer for the next push, marks its question as changed and
+// makes sure a push is scheduled.
+func queueAnswerAggregates(room *socManager.Room, update AnswerUpdate) {
+	aggregateThrottlesLock.Lock()
+	defer aggregateThrottlesLock.Unlock()
+	throttle, exists := aggregateThrottles[room.ID]
+	if !exists {
+		throttle = &aggregateThrottle{dirty: make(map[int]bool)}
+		aggregateThrottles[room.ID] = throttle
+	}
+	throttle.dirty[update.QuestionID] = true
+	throttle.answers = append(throttle.answers, update)
+	if throttle.scheduled {
+		return
+	}
+	throttle.scheduled = true
+	time.AfterFunc(answerAggregateInterval, func() { flushAnswerAggregates(room) })
+}
+
+func flushAnswerAggregates(room *socManager.Room) {
+	aggregateThrottlesLock.Lock()
+	throttle, exists := aggregateThrottles[room.ID]
+	if !exists {
+		aggregateThrottlesLock.Unlock()
+		return
+	}
+	questionIDs := make([]int, 0, len(throttle.dirty))
+	for questionID := range throttle.dirty {
+		questionIDs = append(questionIDs, questionID)
+	}
+	answers := throttle.answers
+	if room.Finished.Load() {
+		delete(aggregateThrottles, room.ID)
+	} else {
+		throttle.dirty = make(map[int]bool)
+		throttle.answers = nil
+		throttle.scheduled = false
+	}
+	aggregateThrottlesLock.Unlock()
+
+	if len(questionIDs) == 0 {
+		return
+	}
+	sort.Ints(questionIDs)
+	room.BroadcastToTeacher(map[string]any{
+		"type": MsgTypeAnswerAggregates,
+		"payload": map[string]any{
+			"questions": answerAggregates(room, questionIDs),
+			"answers":   answers,
+		},
+	})
+	session := getSession(room)
+	for _, questionID := range questionIDs {
+		broadcastAnswerDistribution(room, session, questionID)
+	}
+	if !room.Finished.Load() && leaderboardFollowsAnswers(room) {
+		BroadcastLeaderboard(room, false)
+	}
+}
+
+func answerAggregates(room *socManager.Room, questionIDs []int) []utils.QuestionAggregate {
+	room.RLock()
+	participants := 0
+	for _, allowed := range room.Participants {
+		if allowed {
+			participants++
+		}
+	}
+	room.RUnlock()
+	quizJson := room.Quiz()
+
+	session := getSession(room)
+	session.Lock()
+	defer session.Unlock()
+	aggregates := make([]utils.QuestionAggregate, 0, len(questionIDs))
+	for _, questionID := range questionIDs {
+		question, _ := utils.FindQuestion(quizJson, questionID)
+		aggregates = append(aggregates, session.QuestionAggregate(questionID, question, participants))
+	}
+	return aggregates
+}
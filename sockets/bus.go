@@ -0,0 +1,95 @@
+package sockets
+
+import (
+	"encoding/json"
+	"log"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+// Commands other instances send to the one the teacher is connected to,
+// since that is where the quiz timer and the answer session live.
+const (
+	CommandAnswer  = "answer"
+	CommandEndQuiz = "end_quiz"
+	CommandFlag    = "flag"
+	CommandSubmit  = "submit"
+)
+
+func init() {
+	socManager.GetManager().CommandHandler = handleRoomCommand
+	socManager.GetManager().SpectatorView = spectatorView
+	socManager.GetManager().ClientMessageHandler = handleForwardedSSEMessage
+}
+
+func handleRoomCommand(room *socManager.Room, msg socManager.BusMessage) {
+	switch msg.Command {
+	case CommandAnswer:
+		if room.StartQuiz.Load() {
+			handleAnswerSubmission(room, &socManager.Client{UserID: msg.UserID, UserType: "student"}, msg.Payload)
+		} else {
+			rejectAnswer(room, &socManager.Client{UserID: msg.UserID}, 0, utils.RejectQuizNotRunning)
+		}
+	case CommandFlag:
+		if room.StartQuiz.Load() {
+			handleFlagQuestion(room, msg.UserID, msg.Payload)
+		}
+	case CommandSubmit:
+		handleSubmitQuiz(room, msg.UserID)
+	case CommandEndQuiz:
+		var quizEvent models.QuizEvent
+		if err := db.DB.First(&quizEvent, room.QuizEventID).Error; err != nil {
+			log.Printf("end_quiz command for unknown quiz %d: %v", room.QuizEventID, err)
+			return
+		}
+		var teacher models.User
+		if err := db.DB.First(&teacher, room.TeacherID).Error; err != nil {
+			log.Printf("end_quiz command for unknown teacher %d: %v", room.TeacherID, err)
+			return
+		}
+		if result := FinishQuiz(room, quizEvent, &teacher); result != "Prepared" {
+			log.Printf("end_quiz command failed for room %s: %s", room.ID, result)
+		}
+	default:
+		log.Printf("Unknown bus command %q for room %s", msg.Command, room.ID)
+	}
+}
+
+// FinishQuiz ends the quiz in a room: the timer is stopped, the final leaderboard is sent,
+// results are stored and the teacher is notified. It returns "Prepared" on success,
+// like utils.PrepareEndQuiz.
+func FinishQuiz(room *socManager.Room, quizEvent models.QuizEvent, user *models.User) string {
+	room.FinishTimer()
+	room.SyncState()
+	BroadcastLeaderboard(room, true)
+
+	result := utils.PrepareEndQuiz(quizEvent, user, &activeSessions)
+	if result != "Prepared" {
+		return result
+	}
+	room.BroadcastToTeacher(map[string]any{
+		"type":    MsgTypeEndQuiz,
+		"payload": map[string]bool{"results": true},
+	})
+	return result
+}
+
+// toInt64 reads a number from a message that was either built in this process
+// or decoded from the bus.
+func toInt64(value any) int64 {
+	switch number := value.(type) {
+	case int64:
+		return number
+	case int:
+		return int64(number)
+	case float64:
+		return int64(number)
+	case json.Number:
+		n, _ := number.Int64()
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package sockets
+
+import (
+	"encoding/json"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeFlagQuestion = "flag_question"
+	MsgTypeFlags        = "flags"
+)
+
+type FlagQuestionRequest struct {
+	QuestionID int  `json:"question_id"`
+	Flagged    bool `json:"flagged"`
+}
+
+// handleFlagQuestion marks a question for review, the student gets the list of their flags back.
+func handleFlagQuestion(room *socManager.Room, userID uint, payload json.RawMessage) {
+	var req FlagQuestionRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		rejectAnswer(room, &socManager.Client{UserID: userID}, 0, utils.RejectInvalidPayload)
+		return
+	}
+	if _, exists := utils.FindQuestion(room.Quiz(), req.QuestionID); !exists {
+		rejectAnswer(room, &socManager.Client{UserID: userID}, req.QuestionID, utils.RejectUnknownQuestion)
+		return
+	}
+
+	session := getSession(room)
+	session.Lock()
+	if session.IsSubmitted(userID) {
+		session.Unlock()
+		rejectAnswer(room, &socManager.Client{UserID: userID}, req.QuestionID, utils.RejectAlreadySubmitted)
+		return
+	}
+	session.SetFlag(userID, req.QuestionID, req.Flagged)
+	flagged := session.FlaggedQuestions(userID)
+	session.Unlock()
+
+	room.BroadcastToStudent(userID, map[string]any{
+		"type":    MsgTypeFlags,
+		"payload": map[string]any{"flagged": flagged},
+	})
+}
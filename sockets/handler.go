@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"time"
-	"strconv"
 	"net/http"
 	"encoding/json"
 
@@ -24,7 +23,7 @@ var upgrader = websocket.Upgrader{
 var activeSessions = make(map[uint]*utils.QuizSession) // quizEventID -> session
 
 
-var msg struct {
+type clientMessage struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
@@ -38,6 +37,7 @@ const (
 	MsgTypeGetClients   = "get_clients"
 	MsgTypeRemoveClients = "remove_clients"
 	MsgTypeRemoveClient = "remove_client"
+	MsgTypeAnswerRejected = "answer_rejected"
 )
 
 type BroadcastedData struct {
@@ -52,40 +52,117 @@ func GetActiveSessions() (*map[uint]*utils.QuizSession){
 	return &activeSessions
 }
 
+// HandleWS connects a projector (?display_token=) or the user of the access token to a room.
 func HandleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	var user *models.User
+	if r.URL.Query().Get("display_token") == "" {
+		var err error
+		if user, err = authorizeRoomUser(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket Upgrade Error:", err)
 		return
 	}
-	defer conn.Close()
+	defer wsConn.Close()
+	conn := newWSConnection(wsConn)
 
 	channelCode := r.URL.Query().Get("channel_code")
-	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
-
-	var user models.User
-	if err := db.DB.First(&user, userID).Error; err != nil {
-		conn.WriteJSON(map[string]string{"error": "invalid user"})
+	if displayToken := r.URL.Query().Get("display_token"); displayToken != "" {
+		room, client, ok := joinAsSpectator(conn, channelCode, displayToken)
+		if !ok {
+			return
+		}
+		defer func() { room.Unregister <- client }()
+		for {
+			var incoming clientMessage
+			if err := wsConn.ReadJSON(&incoming); err != nil {
+				log.Printf("Spectator read error: %v", err)
+				return
+			}
+			conn.WriteJSON(map[string]string{"error": "display connections are read-only"})
+		}
+	}
+	rc, ok := joinRoom(conn, channelCode, user)
+	if !ok {
 		return
 	}
+	defer rc.leave()
+
+	for {
+		var msg clientMessage
+		err := wsConn.ReadJSON(&msg)
+		if err != nil {
+			log.Printf("Read error: %v", err)
+			return
+		}
+		log.Println("Inside HandleWS for loop, type of msg got - ", msg.Type)
+		rc.handleMessage(msg)
+	}
+}
+
+
+// roomConnection is a student or teacher connected to a room, whatever the transport (websocket or SSE).
+type roomConnection struct {
+	room          *socManager.Room
+	client        *socManager.Client
+	user          models.User
+	quizEvent     models.QuizEvent
+	isTeacher     bool
+	joinedClients map[uint]models.User
+	clientList    map[string][]uint
+}
+
 
+// authorizeRoomUser is the user of the access token of a websocket or SSE request, who must be
+// allowed to join or run quizzes. Browsers cannot set headers on either, so the token may also
+// come as ?access_token=, access tokens only live for minutes. Revoked sessions are refused like
+// on the REST apis.
+func authorizeRoomUser(r *http.Request) (*models.User, error) {
+	if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	user, _, _, err := utils.AuthorizeSession(r)
+	if err != nil {
+		return nil, err
+	}
+	if utils.PermissionScope(user.UserType, utils.PermQuizJoin) == utils.ScopeNone &&
+		utils.PermissionScope(user.UserType, utils.PermQuizRun) == utils.ScopeNone {
+		return nil, fmt.Errorf("role '%s' can neither join nor run quizzes", user.UserType)
+	}
+	return user, nil
+}
+
+
+// joinRoom validates the user against the room and registers the client. On failure the error
+// has already been written to conn.
+func joinRoom(conn socManager.Connection, channelCode string, user *models.User) (*roomConnection, bool) {
+	userID := user.ID
 	manager := socManager.GetManager()
 	room, exists := manager.GetRoom(channelCode)
 	if !exists {
 		conn.WriteJSON(map[string]string{"error": "room not found"})
-		return
+		return nil, false
 	}
 
 	var quizEvent models.QuizEvent
 	if err := db.DB.First(&quizEvent, "channel_code = ?", channelCode).Error; err != nil {
 		conn.WriteJSON(map[string]string{"error": "QuizEvent record not found! Please first create a quiz Event."})
 		conn.Close()
-		return
+		return nil, false
 	}
 
-	if user.UserType != "teacher" && !room.Participants[uint(userID)] {
+	// Only the room's owner runs it, or a role that may run every quiz. Other teachers are
+	// refused like any other non-participant.
+	canRun := uint(userID) == room.TeacherID || utils.PermissionScope(user.UserType, utils.PermQuizRun) == utils.ScopeAny
+	if !canRun && !room.IsParticipant(uint(userID)) && !room.IsWaiting(uint(userID)) {
 		conn.WriteJSON(map[string]string{"error": "not a participant"})
-		return
+		return nil, false
 	}
 
 	client := &socManager.Client{
@@ -95,140 +172,333 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	room.Register <- client
-	defer func() { room.Unregister <- client }()
 
-	isTeacher := false
+	rc := &roomConnection{
+		room:          room,
+		client:        client,
+		user:          *user,
+		quizEvent:     quizEvent,
+		joinedClients: make(map[uint]models.User),
+		clientList:    make(map[string][]uint),
+	}
+
 	log.Printf("[main] Pointer to startQuiz: %p, value: %v", &room.StartQuiz, room.StartQuiz.Load())
 
 
-	if user.UserType == "teacher" || user.UserType == "admin" && client.UserID == room.TeacherID {
-		isTeacher = true
+	if canRun {
+		rc.isTeacher = true
 		conn.WriteJSON(map[string]string{"message" : "Congrats, You have joined the room you created! You can start the quiz event any time you want. Only those Student's who have already joined this room will be allowed to give quizzes. Other's who did not join will not be allowed to join this event after it starts."})
+		conn.WriteJSON(lobbyStateMessage(room))
+	} else if user.UserType == "student" && room.IsWaiting(uint(userID)) {
+		conn.WriteJSON(map[string]string{"message" : "You are in the waiting room, the teacher has to admit you before you can take part."})
 	} else if user.UserType == "student" {
 		conn.WriteJSON(map[string]string{"message" : "Congrats, You have joined the room! Please wait for quiz event to start."})
 	}
 
-	// Auto-Ending event
-	// delay
-	// time.AfterFunc()
-
-
-	joinedClients := make(map[uint]models.User)
-	clientList := make(map[string][]uint)
-	if (isTeacher){
-		go func(){
-			routineLoop: for {
-				message := <-room.TeacherChan
-				log.Println("message from Teacher channel: ", message.(map[string]any))
-				log.Println("IsTeacher: ", isTeacher)
-				if (isTeacher && MsgTypeQuizStarted == message.(map[string]any)["type"].(string)){
-					// var broadcastedData BroadcastedData;
-					// _ := payload["quiz_id"].(uint)
-					// _ := payload["quiz_json"].(map[string]any)
-					// if err := json.Unmarshal(payload, &broadcastedData); err != nil {
-						// 	fmt.Println("Some error in unmarshalling Broadcasted data of the payload : "+err.Error())
-						// }
-					payload:=message.(map[string]any)["payload"].(map[string]any)
-					EventStartTime := payload["start_time"].(int64)
-					EventEndTime := payload["end_time"].(int64)
-					log.Printf("Received EventStartTime: %v", EventStartTime)
-					log.Printf("Received EventEndTime: %v", EventEndTime)
-					room.EventStartTime = EventStartTime
-					room.EventEndTime = EventEndTime
-					targetUnixMillis := room.EventEndTime
-					log.Printf("room.EventStartTime: %d, room.EventEndTime: %d, targetUnixMillis %d", room.EventStartTime, room.EventEndTime, targetUnixMillis)
-					delay := time.Until(time.UnixMilli(targetUnixMillis))
-					log.Printf("Delay is set for %f seconds", delay.Seconds())
-					if delay > 0 {
-						time.AfterFunc(delay, func(){
-							log.Printf("Auto-scheduled function executed after %f seconds", delay.Seconds())
-							utils.PrepareEndQuiz(quizEvent, &user, &activeSessions);
-							room.BroadcastToTeacher( map[string]any{ 
-								"type": "end_quiz_event", 
-								"payload" : map[string]bool{"results" : true} }, );
-						})
-					}
-					log.Printf("[goroutine] Pointer to startQuiz: %p", &room.StartQuiz)
-				    log.Println("[goroutine] Setting startQuiz to true")
-					room.StartQuiz.Store(true)
-					log.Printf("[goroutine] After Store, startQuiz: %v", room.StartQuiz.Load())
-				} else if(isTeacher && MsgTypeEndQuiz == message.(map[string]any)["type"].(string)){
-					log.Printf("Creating Teacher's EventResult 1 - ")
-					result := models.EventResult{
-						UserID:        room.TeacherID,
-						QuizEventID:   room.QuizEventID,
-						ExpScore:      50,
-					}
-					log.Printf("Creating Teacher's EventResult 2 - ")
-					if err := db.DB.FirstOrCreate(&result).Error; err != nil {
-						log.Printf("Error saving final result: %v", err)
-					}
-					room.StopRoom <- true
-					room = &socManager.Room{}
-					break routineLoop
-				} else if (MsgTypeRemoveClient == message.(map[string]any)["type"].(string)){
-					log.Printf("client %d, Just got removed\n", userID)
-					break routineLoop
-				}
-			}
-		}()
+	if (rc.isTeacher){
+		go rc.runTeacherRoutine()
 	}
+	return rc, true
+}
 
-	outerLoop: for {
-		
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Read error: %v", err)
-			break outerLoop
+
+func (rc *roomConnection) leave() {
+	rc.room.Unregister <- rc.client
+}
+
+
+// runTeacherRoutine drains TeacherChan and drives the quiz lifecycle (start, auto-end, end).
+func (rc *roomConnection) runTeacherRoutine() {
+	room := rc.room
+	isTeacher := rc.isTeacher
+	quizEvent := rc.quizEvent
+	user := rc.user
+	userID := rc.client.UserID
+	routineLoop: for {
+		message := <-room.TeacherChan
+		log.Println("message from Teacher channel: ", message.(map[string]any))
+		log.Println("IsTeacher: ", isTeacher)
+		if (isTeacher && MsgTypeQuizStarted == message.(map[string]any)["type"].(string)){
+			// var broadcastedData BroadcastedData;
+			// _ := payload["quiz_id"].(uint)
+			// _ := payload["quiz_json"].(map[string]any)
+			// if err := json.Unmarshal(payload, &broadcastedData); err != nil {
+				// 	fmt.Println("Some error in unmarshalling Broadcasted data of the payload : "+err.Error())
+				// }
+			payload:=message.(map[string]any)["payload"].(map[string]any)
+			// int64 when broadcast by this instance, float64 when it came over the bus as json
+			EventStartTime := toInt64(payload["start_time"])
+			EventEndTime := toInt64(payload["end_time"])
+			log.Printf("Received EventStartTime: %v", EventStartTime)
+			log.Printf("Received EventEndTime: %v", EventEndTime)
+			if quizJson, ok := payload["quiz_json"].(map[string]any); ok {
+				room.SetQuiz(quizJson)
+			}
+			// The room owns the end timer so it can be paused, resumed and extended later on.
+			room.ScheduleEnd(EventStartTime, EventEndTime, func(){
+				log.Printf("Auto-scheduled end of quiz executed for room %s", room.ID)
+				FinishQuiz(room, quizEvent, &user)
+			})
+			ensureTeams(room)
+			log.Printf("[goroutine] Pointer to startQuiz: %p", &room.StartQuiz)
+		    log.Println("[goroutine] Setting startQuiz to true")
+			room.StartQuiz.Store(true)
+			log.Printf("[goroutine] After Store, startQuiz: %v", room.StartQuiz.Load())
+			durationSecs, _ := room.Quiz()["duration"].(float64)
+			// Not run inline, it sends to TeacherChan which this goroutine is draining.
+			go applyAccommodations(room, int64(durationSecs))
+			room.SyncState()
+			startLeaderboardTicker(room)
+			startSpectatorCountdown(room)
+		} else if(isTeacher && MsgTypeEndQuiz == message.(map[string]any)["type"].(string)){
+			log.Printf("Creating Teacher's EventResult 1 - ")
+			result := models.EventResult{
+				UserID:        room.TeacherID,
+				QuizEventID:   room.QuizEventID,
+				ExpScore:      50,
+			}
+			log.Printf("Creating Teacher's EventResult 2 - ")
+			if err := db.DB.FirstOrCreate(&result).Error; err != nil {
+				log.Printf("Error saving final result: %v", err)
+			}
+			room.StopRoom <- true
+			room = &socManager.Room{}
+			break routineLoop
+		} else if (MsgTypeRemoveClient == message.(map[string]any)["type"].(string)){
+			// A copy of what was sent to the removed student, the teacher stays in the room.
+			log.Printf("Teacher %d removed a client from room %s\n", userID, room.ID)
 		}
-		log.Println("Inside HandleWS for loop, type of msg got - ", msg.Type)
-		
-		switch msg.Type {
-			case MsgTypeGetClients:
-				if(isTeacher){
-					for _, client := range room.Clients {
-						var tmpUser models.User
-						if err := db.DB.First(&tmpUser, client.UserID).Error; err != nil {
-							log.Printf("Joined client do not exists in the database - %d: %v", client.UserID, err);
-							client.Conn.Close()
-							delete(room.Clients, client.UserID)
-							continue
-						}
-						joinedClients[client.UserID] = tmpUser
+	}
+}
+
+
+// handleMessage handles one message sent by the client, over the websocket or an SSE POST.
+func (rc *roomConnection) handleMessage(msg clientMessage) {
+	room := rc.room
+	client := rc.client
+	switch msg.Type {
+		case MsgTypeGetClients:
+			if(rc.isTeacher){
+				for _, client := range room.Clients {
+					var tmpUser models.User
+					if err := db.DB.First(&tmpUser, client.UserID).Error; err != nil {
+						log.Printf("Joined client do not exists in the database - %d: %v", client.UserID, err);
+						client.Conn.Close()
+						delete(room.Clients, client.UserID)
+						continue
 					}
-					conn.WriteJSON(map[string]any{"JoinedStudents" : joinedClients})
+					rc.joinedClients[client.UserID] = tmpUser
+				}
+				rc.client.Conn.WriteJSON(map[string]any{"JoinedStudents" : rc.joinedClients})
+			}
+		case MsgTypeRemoveClients:
+			if(rc.isTeacher){
+				json.Unmarshal(msg.Payload, &rc.clientList)
+				log.Println("clientList: ", rc.clientList)
+				for _, clientId := range rc.clientList["client_list"] {
+					rc.client.Conn.WriteJSON(map[string]string{"message" : fmt.Sprintf("Removing client/user %d", clientId) })
+				}
+				// Removed students are no longer participants, they have to ask to join again.
+				KickClients(room, rc.clientList["client_list"])
+			}
+		case MsgTypeGetLobby:
+			if(rc.isTeacher){
+				rc.client.Conn.WriteJSON(lobbyStateMessage(room))
+			}
+		case MsgTypeUpdateLobby:
+			if(rc.isTeacher){
+				var lobbyReq UpdateLobbyRequest
+				if err := json.Unmarshal(msg.Payload, &lobbyReq); err != nil {
+					rc.client.Conn.WriteJSON(lobbyClientsError(msg.Type))
+					return
 				}
-			case MsgTypeRemoveClients:
-				if(isTeacher){
-					fmt.Println(msg.Payload)
-					fmt.Printf("Type of msg.Payload - %T:\n", msg.Payload)
-					json.Unmarshal(msg.Payload, &clientList)
-					log.Println("clientList: ", clientList)
-					for _, clientId := range clientList["client_list"] {
-						innerLoop: for _, client := range room.Clients {
-							if client.UserID == uint(clientId){
-								conn.WriteJSON(map[string]string{"message" : fmt.Sprintf("Removing client/user %d", client.UserID) })
-								client.Conn.WriteJSON(map[string]string{"message":"WARNING: You are being removed by the teacher, Sorry ¯\\_(ツ)_/¯"})
-								room.BroadcastToStudent(client.UserID, map[string]any{"type" : "remove_client", "payload" : make(map[string]any) })
-								client.Conn.Close()
-								delete(room.Clients, client.UserID)
-								break innerLoop
-							}
-						}
+				UpdateLobby(room, lobbyReq)
+			}
+		case MsgTypeLockRoom:
+			if(rc.isTeacher){
+				var lockReq struct {
+					Locked bool `json:"locked"`
+				}
+				if err := json.Unmarshal(msg.Payload, &lockReq); err != nil {
+					rc.client.Conn.WriteJSON(lobbyClientsError(msg.Type))
+					return
+				}
+				UpdateLobby(room, UpdateLobbyRequest{Locked: &lockReq.Locked})
+			}
+		case MsgTypeAdmitClients, MsgTypeRejectClients, MsgTypeBanClients, MsgTypeUnbanClients:
+			if(rc.isTeacher){
+				var clientsReq LobbyClientsRequest
+				if err := json.Unmarshal(msg.Payload, &clientsReq); err != nil {
+					rc.client.Conn.WriteJSON(lobbyClientsError(msg.Type))
+					return
+				}
+				switch msg.Type {
+				case MsgTypeAdmitClients:
+					if err := AdmitClients(room, clientsReq.ClientList); err != nil {
+						rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
 					}
+				case MsgTypeRejectClients:
+					RejectClients(room, clientsReq.ClientList)
+				case MsgTypeBanClients:
+					BanClients(room, rc.user.ID, clientsReq.ClientList, clientsReq.Reason)
+				case MsgTypeUnbanClients:
+					UnbanClients(room, clientsReq.ClientList)
 				}
-			case MsgTypeAnswer:
-				log.Println("startquiz while msg is of type 'answer' : ", room.StartQuiz.Load())
-				log.Printf("[MsgTypeAnswer] Pointer to startQuiz: %p", &room.StartQuiz)
-				if (room.StartQuiz.Load()){
-					handleAnswerSubmission(room, client, msg.Payload)
+			}
+		case MsgTypeGetAccommodations:
+			if(rc.isTeacher){
+				rc.client.Conn.WriteJSON(accommodationsMessage(room, loadAccommodations(room)))
+			}
+		case MsgTypePauseQuiz:
+			if(rc.isTeacher){
+				if err := PauseQuiz(room); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
 				}
-			default:
-				log.Printf("Unknown message type: %s", msg.Type)
-		}
+			}
+		case MsgTypeResumeQuiz:
+			if(rc.isTeacher){
+				if _, err := ResumeQuiz(room); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeExtendTime:
+			if(rc.isTeacher){
+				var extendReq ExtendTimeRequest
+				if err := json.Unmarshal(msg.Payload, &extendReq); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : "invalid extend_time payload"})
+					return
+				}
+				if _, err := ExtendQuiz(room, extendReq); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeSetTeams:
+			if(rc.isTeacher){
+				var teamsReq SetTeamsRequest
+				if err := json.Unmarshal(msg.Payload, &teamsReq); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : "invalid set_teams payload"})
+					return
+				}
+				if err := room.SetTeams(teamsReq.Teams); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+					return
+				}
+				room.Broadcast <- teamsMessage(room)
+			}
+		case MsgTypeAutoTeams:
+			if(rc.isTeacher){
+				var autoReq AutoTeamsRequest
+				json.Unmarshal(msg.Payload, &autoReq)
+				if autoReq.Count == 0 {
+					autoReq.Count = utils.GetTeamOptions(room.Quiz()).Count
+				}
+				if room.StartQuiz.Load() {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : "teams can only be changed before the quiz starts"})
+					return
+				}
+				if _, err := room.AutoBalanceTeams(autoReq.Count); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+					return
+				}
+				room.Broadcast <- teamsMessage(room)
+			}
+		case MsgTypeEditQuestion, MsgTypeVoidQuestion, MsgTypeAcceptAnswers:
+			if(rc.isTeacher){
+				var err error
+				switch msg.Type {
+				case MsgTypeEditQuestion:
+					err = EditQuestion(room, rc.quizEvent, msg.Payload)
+				case MsgTypeVoidQuestion:
+					err = VoidQuestion(room, rc.quizEvent, msg.Payload)
+				case MsgTypeAcceptAnswers:
+					err = AcceptAnswers(room, rc.quizEvent, msg.Payload)
+				}
+				if err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeSubmitQuiz, MsgTypeExitEvent:
+			if (!rc.isTeacher && !room.IsParticipant(client.UserID)){
+				return
+			} else if (!rc.isTeacher && room.StartQuiz.Load() && room.TeacherIsRemote()){
+				if err := room.SendCommand(CommandSubmit, client.UserID, nil); err != nil {
+					log.Printf("Could not forward submit of %d: %v", client.UserID, err)
+				}
+			} else if (!rc.isTeacher){
+				handleSubmitQuiz(room, client.UserID)
+			}
+		case MsgTypeSetAutoEnd:
+			if(rc.isTeacher){
+				var autoEndReq struct {
+					Enabled bool `json:"enabled"`
+				}
+				if err := json.Unmarshal(msg.Payload, &autoEndReq); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : "invalid set_auto_end payload"})
+					return
+				}
+				room.SetAutoEnd(autoEndReq.Enabled)
+				if autoEndReq.Enabled && room.StartQuiz.Load() {
+					submitted, participants := completionCounts(room, getSession(room))
+					if participants > 0 && len(submitted) >= participants {
+						room.EndNow()
+					}
+				}
+			}
+		case MsgTypeFlagQuestion:
+			if (!rc.isTeacher && room.StartQuiz.Load() && room.TeacherIsRemote()){
+				if err := room.SendCommand(CommandFlag, client.UserID, msg.Payload); err != nil {
+					log.Printf("Could not forward flag of %d: %v", client.UserID, err)
+				}
+			} else if (!rc.isTeacher && room.StartQuiz.Load()){
+				handleFlagQuestion(room, client.UserID, msg.Payload)
+			}
+		case MsgTypeAskTeacher:
+			if(!rc.isTeacher){
+				if err := AskTeacher(room, client.UserID, msg.Payload); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeReplyStudent:
+			if(rc.isTeacher){
+				if err := ReplyToStudent(room, rc.user.ID, msg.Payload); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeAnnounce:
+			if(rc.isTeacher){
+				if err := Announce(room, rc.user.ID, msg.Payload); err != nil {
+					rc.client.Conn.WriteJSON(map[string]string{"error" : err.Error()})
+				}
+			}
+		case MsgTypeGetMessages:
+			rc.client.Conn.WriteJSON(messagesFor(room, client.UserID, rc.isTeacher))
+		case MsgTypeAnswer:
+			log.Println("startquiz while msg is of type 'answer' : ", room.StartQuiz.Load())
+			log.Printf("[MsgTypeAnswer] Pointer to startQuiz: %p", &room.StartQuiz)
+			if (!rc.isTeacher && !room.IsParticipant(client.UserID)){
+				rejectAnswer(room, client, 0, utils.RejectNotAdmitted)
+			} else if (room.StartQuiz.Load() && room.TeacherIsRemote()){
+				// The answer session lives with the teacher's instance.
+				if err := room.SendCommand(CommandAnswer, client.UserID, msg.Payload); err != nil {
+					log.Printf("Could not forward answer of %d: %v", client.UserID, err)
+				}
+			} else if (room.StartQuiz.Load()){
+				handleAnswerSubmission(room, client, msg.Payload)
+			} else {
+				rejectAnswer(room, client, 0, utils.RejectQuizNotRunning)
+			}
+		default:
+			log.Printf("Unknown message type: %s", msg.Type)
 	}
+}
 
 
+func rejectAnswer(room *socManager.Room, client *socManager.Client, questionID int, reason string) {
+	log.Printf("Answer of user %d for question %d rejected in room %s: %s", client.UserID, questionID, room.ID, reason)
+	room.BroadcastToStudent(client.UserID, map[string]any{
+		"type" : MsgTypeAnswerRejected,
+		"payload" : map[string]any{"question_id" : questionID, "reason" : reason},
+	})
 }
 
 
@@ -236,33 +506,89 @@ func handleAnswerSubmission(room *socManager.Room, client *socManager.Client, pa
 	var answer utils.QuizAnswer
 	if err := json.Unmarshal(payload, &answer); err != nil {
 		log.Printf("Error decoding answer: %v", err)
+		rejectAnswer(room, client, 0, utils.RejectInvalidPayload)
 		return
 	}
 	answer.Timestamp = time.Now().UnixMilli()
+	if !utils.ValidConfidence(answer.Confidence) {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectInvalidPayload)
+		return
+	}
 
-	if _, exists := activeSessions[room.QuizEventID]; !exists {
-		activeSessions[room.QuizEventID] = &utils.QuizSession{
-			Answers: make(map[uint]map[int]utils.QuizAnswer),
-		}
+	quizJson := room.Quiz()
+	question, exists := utils.FindQuestion(quizJson, answer.QuestionID)
+	if !exists {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectUnknownQuestion)
+		return
+	}
+	if utils.IsVoided(question) {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectQuestionVoided)
+		return
 	}
 
-	session := activeSessions[room.QuizEventID]
-	session.Lock()
-	defer session.Unlock()
+	// Every student has their own deadline (extensions, accommodations), the room stays open until the last one.
+	if answer.Timestamp > room.StudentEndTime(client.UserID) {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectDeadlinePassed)
+		return
+	}
+
+	startTime, _ := room.EventTimes()
+	opensAt, closesAt := utils.QuestionWindow(question, startTime)
+	if opensAt != 0 {
+		opensAt = room.ShiftByPauses(opensAt)
+	}
+	if closesAt != 0 {
+		closesAt = room.ShiftByPauses(closesAt)
+	}
+	answer.OpenedAt = opensAt
+	if opensAt == 0 {
+		answer.OpenedAt = startTime
+	}
+	if opensAt != 0 && answer.Timestamp < opensAt {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectQuestionNotOpen)
+		return
+	}
+	if closesAt != 0 && answer.Timestamp > closesAt + room.StudentExtraMillis(client.UserID) {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectQuestionClosed)
+		return
+	}
 
-	if _, exists := session.Answers[client.UserID]; !exists {
-		session.Answers[client.UserID] = make(map[int]utils.QuizAnswer)
+	teamOptions := utils.GetTeamOptions(quizJson)
+	team, inTeam := room.TeamOf(client.UserID)
+	if teamOptions.Enabled && !inTeam {
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectNotInTeam)
+		return
 	}
 
-	session.Answers[client.UserID][answer.QuestionID] = answer
+	session := getSession(room)
+	session.Lock()
+	if session.IsSubmitted(client.UserID) {
+		session.Unlock()
+		rejectAnswer(room, client, answer.QuestionID, utils.RejectAlreadySubmitted)
+		return
+	}
+	if reason := session.CheckAnswerChange(client.UserID, answer.QuestionID, utils.GetAnswerPolicy(quizJson)); reason != "" {
+		session.Unlock()
+		rejectAnswer(room, client, answer.QuestionID, reason)
+		return
+	}
+	if teamOptions.Enabled {
+		if reason := session.CheckTeamAnswer(client.UserID, team, answer.QuestionID, teamOptions.Rule); reason != "" {
+			session.Unlock()
+			rejectAnswer(room, client, answer.QuestionID, reason)
+			return
+		}
+	}
+	points := session.RecordAnswer(client.UserID, answer, question)
+	session.Unlock()
 
-	log.Printf("Student's answer is submitted - client.UserID: %d,  answer.QuestionID: %d \n", client.UserID, answer.QuestionID)
+	log.Printf("Student's answer is submitted - client.UserID: %d,  answer.QuestionID: %d, points: %d \n", client.UserID, answer.QuestionID, points)
 
-	room.BroadcastToTeacher(map[string]any{
-		"type":        "answer_update",
-		"user_id":     client.UserID,
-		"question_id": answer.QuestionID,
-		"timestamp":   answer.Timestamp,
+	queueAnswerAggregates(room, AnswerUpdate{
+		UserID:     client.UserID,
+		QuestionID: answer.QuestionID,
+		Answer:     answer.Answer,
+		Timestamp:  answer.Timestamp,
 	})
 }
 
@@ -282,16 +608,90 @@ websocket special msg
 
 from teacher
 - { "type" : "get_clients", "payload" : {} } // to get all the joined students
-- { "type" : "remove_clients", "payload" : { "client_list" : [1, 2, 3, 4] } } // payload is the list of userId's of client to remove
+- { "type" : "remove_clients", "payload" : { "client_list" : [1, 2, 3, 4] } } // payload is the list of userId's of client to remove, they can ask to join again
+
+
+from teacher (fixing a question of the running quiz, submitted answers are graded again)
+- { "type" : "edit_question", "payload" : { "question_id" : 3, "text" : "...", "options" : [{"option", "correct"}], "correct_answer" : 23.5, "points" : 2 } } // fields are optional
+- { "type" : "void_question", "payload" : { "question_id" : 3 } } // dropped from scoring, "voided" : false restores it
+- { "type" : "accept_answers", "payload" : { "question_id" : 3, "answers" : [["Paris"], ["London"]] } } // accepted on top of the answer key
+
+
+from teacher (Q&A)
+- { "type" : "reply_student", "payload" : { "user_id" : 3, "body" : "Yes, Q3 should say Paris", "reply_to_id" : 12, "question_id" : 3 } } // private to one student
+- { "type" : "announce", "payload" : { "body" : "Q3 has a typo, read 'Paris'", "question_id" : 3 } } // to everyone, displays included
+
+
+from teacher (lobby, quiz json "lobby" : { "require_approval" : true, "max_participants" : 30 } sets the initial settings)
+- { "type" : "get_lobby", "payload" : {} }
+- { "type" : "update_lobby", "payload" : { "require_approval" : true, "max_participants" : 30, "locked" : false } } // fields are optional
+- { "type" : "lock_room", "payload" : { "locked" : true } }
+- { "type" : "admit_clients", "payload" : { "client_list" : [5, 6] } }
+- { "type" : "reject_clients", "payload" : { "client_list" : [7] } }
+- { "type" : "ban_clients", "payload" : { "client_list" : [8], "reason" : "optional" } } // persists for the quiz event
+- { "type" : "unban_clients", "payload" : { "client_list" : [8] } }
+
+
+from teacher (team mode, quiz json "teams" : { "enabled" : true, "rule" : "captain|majority|first_answer", "count" : 2 })
+- { "type" : "set_teams", "payload" : { "teams" : [ { "name" : "Red", "captain" : 3, "members" : [3, 4] } ] } } // lobby only
+- { "type" : "auto_teams", "payload" : { "count" : 4 } } // lobby only, deals the participants out over count teams
+
+
+from display (projector, connect with /ws?channel_code=<code>&display_token=<token>)
+- read-only, anything sent is rejected
+
+
+to display only
+- { "type" : "quiz_state", "payload" : {"quiz_id", "start_time", "end_time", "quiz_json"}} // when connecting to a running quiz, quiz_json without the answer key
+- { "type" : "countdown", "payload" : {"end_time", "remaining_ms"}}
+- { "type" : "answer_distribution", "payload" : {"question_id" : 1, "distribution" : {"london" : 3, "paris" : 12}}}
+
+
+from teacher (timer control, also available as POST /quiz/{id}/pause, /resume and /extend)
+- { "type" : "pause_quiz", "payload" : {} }
+- { "type" : "resume_quiz", "payload" : {} }
+- { "type" : "extend_time", "payload" : { "seconds" : 60, "user_ids" : [3, 4] } } // user_ids optional, empty = everyone
+- { "type" : "set_auto_end", "payload" : { "enabled" : true } } // end the quiz once everyone submitted, quiz json "submission" : { "auto_end" : true } sets the default
+- { "type" : "get_accommodations", "payload" : {} } // students with extended time and their own end_time, also pushed when the quiz starts
 
 
 from broadcast
 - { "type" : "start_quiz_event", payload : {"quiz_id", "start_time", "end_time", "quiz_json"}}
+- { "type" : "time_update", payload : {"end_time", "paused", "remaining_ms"}} // after pause, resume or extend (sent only to affected students for individual extensions)
+- { "type" : "leaderboard", payload : {"final" : false, "anonymized" : false, "leaderboard" : [{"rank", "user_id", "nickname", "score", "answered", "response_time"}], "teams" : [{"rank", "team_id", "name", "score", "answered", "members"}]}} // teams only in team mode
+- { "type" : "question_updated", payload : {"question_id", "question", "voided"}} // after edit_question, void_question or accept_answers
+- { "type" : "teams", payload : {"teams" : [{"id", "name", "captain", "members"}]}} // after set_teams / auto_teams, or auto-balanced at start
 
 
 from student
-- { "type" : "answer", "payload" : { "question_id" : 1, "answer" : <["London", "Paris"](string array) | 23.0(float64)> } }
-- { "type" : "exit_event", "payload" : {}}
+- { "type" : "answer", "payload" : { "question_id" : 1, "answer" : <["London", "Paris"](string array) | 23.0(float64)>, "confidence" : 4, "flagged" : false } } // confidence 1-5 and flagged are optional
+- { "type" : "flag_question", "payload" : { "question_id" : 1, "flagged" : true } } // mark for review, answered or not
+- { "type" : "submit_quiz", "payload" : {}} // done early, no more answers are taken (exit_event does the same)
+- { "type" : "ask_teacher", "payload" : { "body" : "Q3 has a typo?", "question_id" : 3 } } // private to the teacher, question_id optional
+
+
+from anyone
+- { "type" : "get_messages", "payload" : {} } // teacher gets every message, a student their own thread and the announcements
+
+
+to teacher
+- { "type" : "completion_progress", "payload" : { "submitted", "participants", "submitted_by" } } // after every submit_quiz
+- { "type" : "answer_aggregates", "payload" : { "questions" : [{"question_id", "option_counts", "answered", "unanswered", "correct", "percent_correct", "median_response_ms"}], "answers" : [{"user_id", "question_id", "answer", "timestamp"}] } } // at most once a second, only questions and answers since the last one
+- { "type" : "lobby_state", "payload" : { "settings", "waiting" : [{"user_id", "requested_at"}], "admitted", "rejected", "banned" } } // after every lobby change
+
+
+to everyone concerned
+- { "type" : "room_message", "payload" : {"ID", "kind" : "question|reply|announcement", "sender_id", "recipient_id", "question_id", "reply_to_id", "body"} }
+
+
+to student
+- { "type" : "quiz_submitted", "payload" : { "submitted_at", "score", "analytics" } } // score and analytics only with quiz json "submission" : { "show_result" : true }
+- { "type" : "flags", "payload" : { "flagged" : [1, 4] } } // after flag_question
+- { "type" : "lobby_admitted" | "lobby_rejected" | "banned" | "remove_client", "payload" : { "message" } }
+- { "type" : "answer_rejected", "payload" : { "question_id" : 1, "reason" : "deadline_passed" } }
+  reasons: invalid_payload, quiz_not_running, unknown_question, deadline_passed, question_not_open,
+           question_closed, answer_locked, change_limit_reached, already_submitted, question_voided, not_admitted, not_in_team, not_team_captain,
+           team_already_answered
 
 
 
@@ -333,11 +733,14 @@ from student
             "text": "What is 7x3 ?",
             "type": "numeric",
             "correct_answer" : 27,
-            "points": 5
+            "points": 5,
+            "window": { "open": 0, "close": 20 }  // optional, seconds after the quiz start the question takes answers
         }
     ],
     "duration": 30,
-    "status": "pending"
+    "status": "pending",
+    "leaderboard": { "enabled": true, "interval": 0, "anonymize": false, "top_n": 10 },  // optional, interval in seconds (0 = when a question window closes or opens)
+    "answer_policy": { "mode": "limit", "max_changes": 2 }  // optional, mode: allow (default) | first_answer_locks | limit
   }
 }
 
@@ -0,0 +1,157 @@
+package sockets
+
+import (
+	"log"
+	"time"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeLeaderboard = "leaderboard"
+)
+
+// getSession returns the running session of the room's quiz, creating it on first use.
+func getSession(room *socManager.Room) *utils.QuizSession {
+	utils.SessionsLock.Lock()
+	defer utils.SessionsLock.Unlock()
+	session, exists := activeSessions[room.QuizEventID]
+	if !exists {
+		startTime, _ := room.EventTimes()
+		session = utils.NewQuizSession(startTime)
+		activeSessions[room.QuizEventID] = session
+	}
+	return session
+}
+
+// BroadcastLeaderboard sends the current standings of the room to everyone in it.
+// final is set when the quiz is over, clients use it to show the podium.
+func BroadcastLeaderboard(room *socManager.Room, final bool) {
+	if room == nil || room.Quiz() == nil {
+		return
+	}
+	options := utils.GetLeaderboardOptions(room.Quiz())
+	if !options.Enabled {
+		return
+	}
+
+	utils.SessionsLock.Lock()
+	session, exists := activeSessions[room.QuizEventID]
+	utils.SessionsLock.Unlock()
+	if !exists {
+		return
+	}
+
+	session.Lock()
+	entries := session.BuildLeaderboard(room.QuizEventID, options)
+	session.Unlock()
+
+	payload := map[string]any{
+		"final":       final,
+		"anonymized":  options.Anonymize,
+		"leaderboard": entries,
+	}
+	if teams := teamLeaderboard(room, session); teams != nil {
+		payload["teams"] = teams
+	}
+	room.Broadcast <- map[string]any{
+		"type":    MsgTypeLeaderboard,
+		"payload": payload,
+	}
+}
+
+// startLeaderboardTicker broadcasts the standings every Interval seconds until the quiz ends.
+// With no interval configured the leaderboard is sent whenever a question closes or the next
+// one opens instead, and for a quiz without question windows as answers are graded (see
+// leaderboardFollowsAnswers).
+func startLeaderboardTicker(room *socManager.Room) {
+	options := utils.GetLeaderboardOptions(room.Quiz())
+	if !options.Enabled {
+		return
+	}
+	if options.Interval <= 0 {
+		watchQuestionWindows(room)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(options.Interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if room.Finished.Load() {
+				log.Printf("Leaderboard ticker stopped for room %s", room.ID)
+				return
+			}
+			if !room.IsPaused() {
+				BroadcastLeaderboard(room, false)
+			}
+		}
+	}()
+}
+
+// watchQuestionWindows sends the leaderboard once for every question window that opened or
+// closed, checking every second so pauses (which move the windows) are followed.
+func watchQuestionWindows(room *socManager.Room) {
+	bounds := questionWindowBounds(room)
+	if len(bounds) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		announced := make([]bool, len(bounds))
+		for range ticker.C {
+			if room.Finished.Load() {
+				return
+			}
+			now := time.Now().UnixMilli()
+			changed, pending := false, false
+			for i, bound := range bounds {
+				if announced[i] {
+					continue
+				}
+				if now >= room.ShiftByPauses(bound) {
+					announced[i], changed = true, true
+				} else {
+					pending = true
+				}
+			}
+			if changed {
+				BroadcastLeaderboard(room, false)
+			}
+			if !pending {
+				return
+			}
+		}
+	}()
+}
+
+// leaderboardFollowsAnswers is true for a quiz with neither an interval nor question windows, its
+// leaderboard goes out with the throttled answer aggregates.
+func leaderboardFollowsAnswers(room *socManager.Room) bool {
+	options := utils.GetLeaderboardOptions(room.Quiz())
+	return options.Enabled && options.Interval <= 0 && len(questionWindowBounds(room)) == 0
+}
+
+// questionWindowBounds are the times question windows open (later than the start) or close.
+func questionWindowBounds(room *socManager.Room) []int64 {
+	questions, _ := room.Quiz()["questions"].([]any)
+	startTime, _ := room.EventTimes()
+	var bounds []int64
+	for _, q := range questions {
+		question, ok := q.(map[string]any)
+		if !ok {
+			continue
+		}
+		opensAt, closesAt := utils.QuestionWindow(question, startTime)
+		// A question open from the start has nothing to announce when it opens.
+		if opensAt > startTime {
+			bounds = append(bounds, opensAt)
+		}
+		if closesAt != 0 {
+			bounds = append(bounds, closesAt)
+		}
+	}
+	return bounds
+}
@@ -0,0 +1,148 @@
+package sockets
+
+import (
+	"fmt"
+	"log"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeGetLobby      = "get_lobby"
+	MsgTypeLobbyState    = "lobby_state"
+	MsgTypeUpdateLobby   = "update_lobby"
+	MsgTypeLockRoom      = "lock_room"
+	MsgTypeAdmitClients  = "admit_clients"
+	MsgTypeRejectClients = "reject_clients"
+	MsgTypeBanClients    = "ban_clients"
+	MsgTypeUnbanClients  = "unban_clients"
+	MsgTypeLobbyAdmitted = "lobby_admitted"
+	MsgTypeLobbyRejected = "lobby_rejected"
+	MsgTypeBanned        = "banned"
+)
+
+// UpdateLobbyRequest only changes the settings that are set.
+type UpdateLobbyRequest struct {
+	RequireApproval *bool `json:"require_approval"`
+	MaxParticipants *int  `json:"max_participants"`
+	Locked          *bool `json:"locked"`
+}
+
+type LobbyClientsRequest struct {
+	ClientList []uint  `json:"client_list"`
+	Reason     *string `json:"reason"` // ban_clients only
+}
+
+func lobbyStateMessage(room *socManager.Room) map[string]any {
+	var bans []models.QuizBan
+	if err := db.DB.Where("quiz_event_id = ?", room.QuizEventID).Find(&bans).Error; err != nil {
+		log.Printf("Error loading bans of quiz %d: %v", room.QuizEventID, err)
+	}
+	banned := make([]uint, 0, len(bans))
+	for _, ban := range bans {
+		banned = append(banned, ban.UserID)
+	}
+
+	state := room.GetLobbyState()
+	return map[string]any{
+		"type": MsgTypeLobbyState,
+		"payload": map[string]any{
+			"settings": state.Settings,
+			"waiting":  state.Waiting,
+			"admitted": state.Admitted,
+			"rejected": state.Rejected,
+			"banned":   banned,
+		},
+	}
+}
+
+// PushLobbyState sends the teacher the current lobby, after every change to it.
+func PushLobbyState(room *socManager.Room) {
+	room.BroadcastToTeacher(lobbyStateMessage(room))
+}
+
+func UpdateLobby(room *socManager.Room, req UpdateLobbyRequest) {
+	settings := room.GetLobbyState().Settings
+	if req.RequireApproval != nil {
+		settings.RequireApproval = *req.RequireApproval
+	}
+	if req.MaxParticipants != nil && *req.MaxParticipants >= 0 {
+		settings.MaxParticipants = *req.MaxParticipants
+	}
+	if req.Locked != nil {
+		settings.Locked = *req.Locked
+	}
+	room.UpdateLobby(settings)
+	PushLobbyState(room)
+}
+
+func AdmitClients(room *socManager.Room, userIDs []uint) error {
+	admitted, err := room.Admit(userIDs)
+	for _, userID := range admitted {
+		room.BroadcastToStudent(userID, map[string]any{
+			"type":    MsgTypeLobbyAdmitted,
+			"payload": map[string]any{"message": "You have been admitted, please wait for the quiz event to start."},
+		})
+	}
+	PushLobbyState(room)
+	return err
+}
+
+func RejectClients(room *socManager.Room, userIDs []uint) {
+	for _, userID := range userIDs {
+		if room.IsParticipant(userID) {
+			continue
+		}
+		room.BroadcastToStudent(userID, map[string]any{
+			"type":    MsgTypeLobbyRejected,
+			"payload": map[string]any{"message": "Your request to join was rejected by the teacher."},
+		})
+	}
+	// Closes the rejected students' connections, after they were told why.
+	room.Reject(userIDs)
+	PushLobbyState(room)
+}
+
+// KickClients removes students from the room, they can ask to join again.
+func KickClients(room *socManager.Room, userIDs []uint) {
+	for _, userID := range userIDs {
+		room.BroadcastToStudent(userID, map[string]any{"type": MsgTypeRemoveClient, "payload": make(map[string]any)})
+		room.RemoveParticipant(userID)
+	}
+	PushLobbyState(room)
+}
+
+// BanClients removes students from the room and keeps them out of this quiz event for good.
+func BanClients(room *socManager.Room, bannedBy uint, userIDs []uint, reason *string) {
+	for _, userID := range userIDs {
+		if userID == room.TeacherID {
+			continue
+		}
+		if err := utils.BanUser(db.DB, room.QuizEventID, userID, bannedBy, reason); err != nil {
+			log.Printf("Error banning user %d from quiz %d: %v", userID, room.QuizEventID, err)
+			continue
+		}
+		room.BroadcastToStudent(userID, map[string]any{
+			"type":    MsgTypeBanned,
+			"payload": map[string]any{"message": "You have been banned from this quiz event."},
+		})
+		room.RemoveParticipant(userID)
+	}
+	PushLobbyState(room)
+}
+
+func UnbanClients(room *socManager.Room, userIDs []uint) {
+	if len(userIDs) > 0 {
+		if err := utils.UnbanUsers(db.DB, room.QuizEventID, userIDs); err != nil {
+			log.Printf("Error unbanning users from quiz %d: %v", room.QuizEventID, err)
+		}
+	}
+	PushLobbyState(room)
+}
+
+func lobbyClientsError(msgType string) map[string]string {
+	return map[string]string{"error": fmt.Sprintf("invalid %s payload", msgType)}
+}
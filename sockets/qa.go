@@ -0,0 +1,141 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+)
+
+const (
+	MsgTypeAskTeacher   = "ask_teacher"
+	MsgTypeReplyStudent = "reply_student"
+	MsgTypeAnnounce     = "announce"
+	MsgTypeGetMessages  = "get_messages"
+	MsgTypeRoomMessage  = "room_message"
+	MsgTypeMessages     = "messages"
+)
+
+const (
+	RoomMessageQuestion     = "question"
+	RoomMessageReply        = "reply"
+	RoomMessageAnnouncement = "announcement"
+)
+
+const maxRoomMessageLength = 2000
+
+type RoomMessageRequest struct {
+	Body       string `json:"body"`
+	QuestionID *int   `json:"question_id"`
+	UserID     uint   `json:"user_id"`     // reply_student only
+	ReplyToID  *uint  `json:"reply_to_id"` // reply_student only
+}
+
+func roomMessage(message models.RoomMessage) map[string]any {
+	return map[string]any{
+		"type":    MsgTypeRoomMessage,
+		"payload": message,
+	}
+}
+
+func saveRoomMessage(message *models.RoomMessage) error {
+	message.Body = strings.TrimSpace(message.Body)
+	if message.Body == "" {
+		return errors.New("message is empty")
+	}
+	if len(message.Body) > maxRoomMessageLength {
+		return errors.New("message is too long")
+	}
+	if err := db.DB.Create(message).Error; err != nil {
+		log.Printf("Error saving room message: %v", err)
+		return errors.New("message could not be saved")
+	}
+	return nil
+}
+
+// AskTeacher sends a student's question privately to the teacher, students never reach each other.
+func AskTeacher(room *socManager.Room, studentID uint, payload json.RawMessage) error {
+	var req RoomMessageRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.New("invalid ask_teacher payload")
+	}
+	message := models.RoomMessage{
+		QuizEventID: room.QuizEventID,
+		Kind:        RoomMessageQuestion,
+		SenderID:    studentID,
+		QuestionID:  req.QuestionID,
+		Body:        req.Body,
+	}
+	if err := saveRoomMessage(&message); err != nil {
+		return err
+	}
+	room.BroadcastToTeacher(roomMessage(message))
+	room.BroadcastToStudent(studentID, roomMessage(message))
+	return nil
+}
+
+// ReplyToStudent answers one student privately.
+func ReplyToStudent(room *socManager.Room, teacherID uint, payload json.RawMessage) error {
+	var req RoomMessageRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.New("invalid reply_student payload")
+	}
+	if req.UserID == 0 {
+		return errors.New("user_id is required")
+	}
+	message := models.RoomMessage{
+		QuizEventID: room.QuizEventID,
+		Kind:        RoomMessageReply,
+		SenderID:    teacherID,
+		RecipientID: &req.UserID,
+		QuestionID:  req.QuestionID,
+		ReplyToID:   req.ReplyToID,
+		Body:        req.Body,
+	}
+	if err := saveRoomMessage(&message); err != nil {
+		return err
+	}
+	room.BroadcastToStudent(req.UserID, roomMessage(message))
+	return nil
+}
+
+// Announce broadcasts a correction or notice to everyone in the room, displays included.
+func Announce(room *socManager.Room, teacherID uint, payload json.RawMessage) error {
+	var req RoomMessageRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.New("invalid announce payload")
+	}
+	message := models.RoomMessage{
+		QuizEventID: room.QuizEventID,
+		Kind:        RoomMessageAnnouncement,
+		SenderID:    teacherID,
+		QuestionID:  req.QuestionID,
+		Body:        req.Body,
+	}
+	if err := saveRoomMessage(&message); err != nil {
+		return err
+	}
+	room.Broadcast <- roomMessage(message)
+	return nil
+}
+
+// messagesFor returns the teacher every message of the quiz, and a student their own
+// questions, the replies to them and the announcements.
+func messagesFor(room *socManager.Room, userID uint, isTeacher bool) map[string]any {
+	var messages []models.RoomMessage
+	query := db.DB.Where("quiz_event_id = ?", room.QuizEventID)
+	if !isTeacher {
+		query = query.Where("sender_id = ? OR recipient_id = ? OR kind = ?", userID, userID, RoomMessageAnnouncement)
+	}
+	if err := query.Order("created_at").Find(&messages).Error; err != nil {
+		log.Printf("Error loading room messages of quiz %d: %v", room.QuizEventID, err)
+	}
+	return map[string]any{
+		"type":    MsgTypeMessages,
+		"payload": map[string]any{"messages": messages},
+	}
+}
@@ -0,0 +1,109 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeEditQuestion    = "edit_question"
+	MsgTypeVoidQuestion    = "void_question"
+	MsgTypeAcceptAnswers   = "accept_answers"
+	MsgTypeQuestionUpdated = "question_updated"
+)
+
+type VoidQuestionRequest struct {
+	QuestionID int   `json:"question_id"`
+	Voided     *bool `json:"voided"` // defaults to true, false restores the question
+}
+
+type AcceptAnswersRequest struct {
+	QuestionID int   `json:"question_id"`
+	Answers    []any `json:"answers"` // accepted on top of the answer key, e.g. [["Paris"], ["London"]] or [23.5]
+}
+
+// changeQuestion applies a teacher's fix to a question of the running quiz: the quiz json of the
+// room and on disk is updated, answers already submitted are graded again and everyone gets the
+// new question, without its answer key.
+func changeQuestion(room *socManager.Room, quizEvent models.QuizEvent, questionID int, change func(question map[string]any) error) error {
+	if !room.StartQuiz.Load() || room.Finished.Load() {
+		return errors.New("questions can only be changed while the quiz is running")
+	}
+
+	var updated, question map[string]any
+	err := room.UpdateQuiz(func(quizJson map[string]any) (map[string]any, error) {
+		var err error
+		updated, question, err = utils.UpdateQuestion(quizJson, questionID, change)
+		if err != nil {
+			return nil, err
+		}
+		// Saved under the room lock too, so the file ends up with the last change.
+		if _, err := quizEvent.SetQuizJsonFileMap(updated); err != nil {
+			log.Printf("Could not save the changed question %d of quiz %d: %v", questionID, quizEvent.ID, err)
+		}
+		return updated, nil
+	})
+	if err != nil {
+		return err
+	}
+	room.SyncState()
+
+	// Graded against the question as it is now, a later change may have landed meanwhile.
+	session := getSession(room)
+	session.Lock()
+	current, _ := utils.FindQuestion(room.Quiz(), questionID)
+	regraded := session.Regrade(questionID, current)
+	session.Unlock()
+	log.Printf("Question %d of room %s changed, %d answers regraded", questionID, room.ID, regraded)
+
+	room.Broadcast <- map[string]any{
+		"type": MsgTypeQuestionUpdated,
+		"payload": map[string]any{
+			"question_id": questionID,
+			"question":    utils.PublicQuizJson(question),
+			"voided":      utils.IsVoided(question),
+		},
+	}
+	BroadcastLeaderboard(room, false)
+	return nil
+}
+
+func EditQuestion(room *socManager.Room, quizEvent models.QuizEvent, payload json.RawMessage) error {
+	var edit utils.QuestionEdit
+	if err := json.Unmarshal(payload, &edit); err != nil {
+		return errors.New("invalid edit_question payload")
+	}
+	return changeQuestion(room, quizEvent, edit.QuestionID, edit.Apply)
+}
+
+func VoidQuestion(room *socManager.Room, quizEvent models.QuizEvent, payload json.RawMessage) error {
+	var req VoidQuestionRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.New("invalid void_question payload")
+	}
+	voided := req.Voided == nil || *req.Voided
+	return changeQuestion(room, quizEvent, req.QuestionID, func(question map[string]any) error {
+		question["voided"] = voided
+		return nil
+	})
+}
+
+func AcceptAnswers(room *socManager.Room, quizEvent models.QuizEvent, payload json.RawMessage) error {
+	var req AcceptAnswersRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.New("invalid accept_answers payload")
+	}
+	if len(req.Answers) == 0 {
+		return errors.New("no answers to accept")
+	}
+	return changeQuestion(room, quizEvent, req.QuestionID, func(question map[string]any) error {
+		accepted, _ := question["accepted_answers"].([]any)
+		question["accepted_answers"] = append(accepted, req.Answers...)
+		return nil
+	})
+}
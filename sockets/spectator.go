@@ -0,0 +1,123 @@
+package sockets
+
+import (
+	"maps"
+	"time"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeCountdown          = "countdown"
+	MsgTypeAnswerDistribution = "answer_distribution"
+	MsgTypeQuizState          = "quiz_state"
+)
+
+// joinAsSpectator registers a read-only projector connection. Spectators get everything that is
+// broadcast to the room (without the answer key, see spectatorView) plus countdowns and answer distributions, but can never answer
+// and are not tracked in room.Participants.
+func joinAsSpectator(conn socManager.Connection, channelCode string, displayToken string) (*socManager.Room, *socManager.Client, bool) {
+	if err := utils.ValidateDisplayToken(displayToken, channelCode); err != nil {
+		conn.WriteJSON(map[string]string{"error": err.Error()})
+		return nil, nil, false
+	}
+
+	room, exists := socManager.GetManager().GetRoom(channelCode)
+	if !exists {
+		conn.WriteJSON(map[string]string{"error": "room not found"})
+		return nil, nil, false
+	}
+
+	client := &socManager.Client{
+		Conn:      conn,
+		Spectator: true,
+	}
+
+	room.Register <- client
+
+	conn.WriteJSON(map[string]string{"message": "Display connected. The quiz will appear here once the teacher starts it."})
+	if room.StartQuiz.Load() {
+		startTime, endTime := room.EventTimes()
+		conn.WriteJSON(map[string]any{
+			"type": MsgTypeQuizState,
+			"payload": map[string]any{
+				"quiz_id":    room.QuizEventID,
+				"start_time": startTime,
+				"end_time":   endTime,
+				"quiz_json":  utils.PublicQuizJson(room.Quiz()),
+			},
+		})
+	}
+	return room, client, true
+}
+
+// spectatorView drops the answer key from the broadcasts that carry the quiz or a question, the
+// projector is seen by the whole class.
+func spectatorView(message any) any {
+	msg, ok := message.(map[string]any)
+	if !ok {
+		return message
+	}
+	payload, ok := msg["payload"].(map[string]any)
+	if !ok {
+		return message
+	}
+
+	var field string
+	switch msg["type"] {
+	case MsgTypeQuizStarted:
+		field = "quiz_json"
+	case MsgTypeQuestionUpdated:
+		field = "question"
+	default:
+		return message
+	}
+	content, ok := payload[field].(map[string]any)
+	if !ok {
+		return message
+	}
+
+	public := maps.Clone(payload)
+	public[field] = utils.PublicQuizJson(content)
+	view := maps.Clone(msg)
+	view["payload"] = public
+	return view
+}
+
+// startSpectatorCountdown pushes the remaining time to projectors every second until the quiz ends.
+func startSpectatorCountdown(room *socManager.Room) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			remaining := room.RemainingMillis()
+			_, endTime := room.EventTimes()
+			room.BroadcastToSpectators(map[string]any{
+				"type": MsgTypeCountdown,
+				"payload": map[string]any{
+					"end_time":     endTime,
+					"remaining_ms": remaining,
+					"paused":       room.IsPaused(),
+				},
+			})
+			if room.Finished.Load() {
+				return
+			}
+		}
+	}()
+}
+
+func broadcastAnswerDistribution(room *socManager.Room, session *utils.QuizSession, questionID int) {
+	session.Lock()
+	distribution := session.AnswerDistribution(questionID)
+	session.Unlock()
+
+	room.BroadcastToSpectators(map[string]any{
+		"type": MsgTypeAnswerDistribution,
+		"payload": map[string]any{
+			"question_id":  questionID,
+			"distribution": distribution,
+		},
+	})
+}
@@ -0,0 +1,164 @@
+package sockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const ssePingInterval = 15 * time.Second
+
+// SSE clients receive over the event stream and send over plain POSTs, the POST handler
+// finds the stream's roomConnection here.
+var (
+	sseConnections     = make(map[string]*roomConnection) // channel code + user id -> connection
+	sseConnectionsLock sync.Mutex
+)
+
+func sseKey(channelCode string, userID uint) string {
+	return fmt.Sprintf("%s:%d", channelCode, userID)
+}
+
+// HandleSSE is the Server-Sent Events counterpart of HandleWS for networks that block websockets.
+// Takes the same query parameters, the messages pushed are identical. Without a display token the
+// stream belongs to the user of the access token, see authorizeRoomUser.
+func HandleSSE(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nHandleSSE handling request: ", r.Method, r.URL.Path)
+
+	channelCode := r.URL.Query().Get("channel_code")
+	if displayToken := r.URL.Query().Get("display_token"); displayToken != "" {
+		conn, err := newSSEConnection(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+
+		room, client, ok := joinAsSpectator(conn, channelCode, displayToken)
+		if !ok {
+			return
+		}
+		defer func() { room.Unregister <- client }()
+		keepAlive(r, conn)
+		return
+	}
+
+	// Refused before the stream opens, so EventSource sees the status and does not retry blindly.
+	user, err := authorizeRoomUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := newSSEConnection(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	rc, ok := joinRoom(conn, channelCode, user)
+	if !ok {
+		return
+	}
+	defer rc.leave()
+
+	key := sseKey(channelCode, rc.user.ID)
+	sseConnectionsLock.Lock()
+	if previous, exists := sseConnections[key]; exists {
+		previous.client.Conn.Close()
+	}
+	sseConnections[key] = rc
+	sseConnectionsLock.Unlock()
+	defer func() {
+		sseConnectionsLock.Lock()
+		if sseConnections[key] == rc {
+			delete(sseConnections, key)
+		}
+		sseConnectionsLock.Unlock()
+	}()
+
+	keepAlive(r, conn)
+}
+
+// keepAlive blocks until the client goes away or the connection is closed, pinging meanwhile.
+func keepAlive(r *http.Request, conn *sseConnection) {
+	ticker := time.NewTicker(ssePingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+			if err := conn.ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleSSESend takes a message from an SSE client, the body is what would be sent over the websocket.
+func HandleSSESend(w http.ResponseWriter, r *http.Request) {
+	log.Println("\n\nHandleSSESend handling request: ", r)
+
+	user, _, err := utils.AuthorizeUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var body json.RawMessage
+	var msg clientMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || json.Unmarshal(body, &msg) != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	channelCode := r.URL.Query().Get("channel_code")
+	if rc, exists := sseRoomConnection(channelCode, user.ID); exists {
+		rc.handleMessage(msg)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Behind a load balancer the stream may be open on another instance, it runs the message there.
+	manager := socManager.GetManager()
+	_, singleInstance := manager.Bus.(*socManager.LocalBus)
+	room, exists := manager.GetRoom(channelCode)
+	if !exists || singleInstance {
+		http.Error(w, "No open event stream for this room", http.StatusNotFound)
+		return
+	}
+	room.ForwardClientMessage(user.ID, body)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func sseRoomConnection(channelCode string, userID uint) (*roomConnection, bool) {
+	sseConnectionsLock.Lock()
+	defer sseConnectionsLock.Unlock()
+	rc, exists := sseConnections[sseKey(channelCode, userID)]
+	return rc, exists
+}
+
+// handleForwardedSSEMessage runs a message another instance took from an SSE client whose stream
+// is open here.
+func handleForwardedSSEMessage(room *socManager.Room, userID uint, payload json.RawMessage) {
+	rc, exists := sseRoomConnection(room.ID, userID)
+	if !exists {
+		return
+	}
+	var msg clientMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("Invalid forwarded message for user %d in room %s: %v", userID, room.ID, err)
+		return
+	}
+	rc.handleMessage(msg)
+}
@@ -0,0 +1,87 @@
+package sockets
+
+import (
+	"log"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeSubmitQuiz         = "submit_quiz"
+	MsgTypeExitEvent          = "exit_event"
+	MsgTypeQuizSubmitted      = "quiz_submitted"
+	MsgTypeSubmitRejected     = "submit_rejected"
+	MsgTypeCompletionProgress = "completion_progress"
+	MsgTypeSetAutoEnd         = "set_auto_end"
+)
+
+// handleSubmitQuiz finalizes one student's attempt before the timer runs out. The student gets
+// their result right away when the quiz shows results on submit, the teacher gets the completion
+// progress and, with auto end on, the quiz ends once everyone is done.
+func handleSubmitQuiz(room *socManager.Room, userID uint) {
+	if !room.StartQuiz.Load() || room.Finished.Load() {
+		room.BroadcastToStudent(userID, map[string]any{
+			"type":    MsgTypeSubmitRejected,
+			"payload": map[string]any{"reason": utils.RejectQuizNotRunning},
+		})
+		return
+	}
+
+	options := utils.GetSubmissionOptions(room.Quiz())
+	session := getSession(room)
+	session.Lock()
+	submittedAt, firstSubmit := session.MarkSubmitted(userID)
+	payload := map[string]any{"submitted_at": submittedAt}
+	if options.ShowResult {
+		score, analytics := session.AttemptResult(userID, room.Quiz())
+		payload["score"] = score
+		payload["analytics"] = analytics
+	}
+	session.Unlock()
+
+	room.BroadcastToStudent(userID, map[string]any{
+		"type":    MsgTypeQuizSubmitted,
+		"payload": payload,
+	})
+	if !firstSubmit {
+		return
+	}
+	log.Printf("Student %d submitted quiz in room %s", userID, room.ID)
+
+	submitted, participants := completionCounts(room, session)
+	room.BroadcastToTeacher(completionProgressMessage(submitted, participants))
+
+	room.RLock()
+	autoEnd := room.AutoEnd
+	room.RUnlock()
+	if autoEnd && participants > 0 && len(submitted) >= participants {
+		log.Printf("Every participant of room %s submitted, ending the quiz", room.ID)
+		room.EndNow()
+	}
+}
+
+// completionCounts returns the participants that submitted and how many participants there are.
+func completionCounts(room *socManager.Room, session *utils.QuizSession) ([]uint, int) {
+	participants := room.ParticipantIDs()
+	session.Lock()
+	defer session.Unlock()
+	submitted := make([]uint, 0, len(participants))
+	for _, userID := range participants {
+		if session.IsSubmitted(userID) {
+			submitted = append(submitted, userID)
+		}
+	}
+	return submitted, len(participants)
+}
+
+func completionProgressMessage(submitted []uint, participants int) map[string]any {
+	return map[string]any{
+		"type": MsgTypeCompletionProgress,
+		"payload": map[string]any{
+			"submitted":    len(submitted),
+			"participants": participants,
+			"submitted_by": submitted,
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package sockets
+
+import (
+	"log"
+
+	"OnlineQuizSystem/socManager"
+	"OnlineQuizSystem/utils"
+)
+
+const (
+	MsgTypeSetTeams  = "set_teams"
+	MsgTypeAutoTeams = "auto_teams"
+	MsgTypeTeams     = "teams"
+)
+
+type SetTeamsRequest struct {
+	Teams []socManager.Team `json:"teams"`
+}
+
+type AutoTeamsRequest struct {
+	Count int `json:"count"`
+}
+
+func teamsMessage(room *socManager.Room) map[string]any {
+	return map[string]any{
+		"type": MsgTypeTeams,
+		"payload": map[string]any{
+			"teams": room.GetTeams(),
+		},
+	}
+}
+
+// ensureTeams auto-balances the participants when a team quiz is started without teams
+// formed in the lobby. Must run before StartQuiz is set, teams are locked afterwards.
+func ensureTeams(room *socManager.Room) {
+	options := utils.GetTeamOptions(room.Quiz())
+	if !options.Enabled || len(room.GetTeams()) > 0 {
+		return
+	}
+	if _, err := room.AutoBalanceTeams(options.Count); err != nil {
+		log.Printf("Could not auto-balance teams of room %s: %v", room.ID, err)
+		return
+	}
+	room.Broadcast <- teamsMessage(room)
+}
+
+// teamLeaderboard ranks the room's teams, nil when the quiz is not played in teams.
+func teamLeaderboard(room *socManager.Room, session *utils.QuizSession) []utils.TeamLeaderboardEntry {
+	options := utils.GetTeamOptions(room.Quiz())
+	if !options.Enabled {
+		return nil
+	}
+	teams := room.GetTeams()
+	session.Lock()
+	defer session.Unlock()
+	return session.BuildTeamLeaderboard(teams, room.Quiz(), options.Rule)
+}
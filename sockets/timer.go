@@ -0,0 +1,79 @@
+package sockets
+
+import (
+	"errors"
+	"log"
+
+	"OnlineQuizSystem/socManager"
+)
+
+const (
+	MsgTypePauseQuiz  = "pause_quiz"
+	MsgTypeResumeQuiz = "resume_quiz"
+	MsgTypeExtendTime = "extend_time"
+	MsgTypeTimeUpdate = "time_update"
+)
+
+type ExtendTimeRequest struct {
+	Seconds int64  `json:"seconds"`
+	UserIDs []uint `json:"user_ids"` // empty = everyone
+}
+
+func timeUpdate(room *socManager.Room, endTime int64) map[string]any {
+	remaining := room.MillisUntil(endTime)
+	return map[string]any{
+		"type": MsgTypeTimeUpdate,
+		"payload": map[string]any{
+			"end_time":     endTime,
+			"paused":       room.IsPaused(),
+			"remaining_ms": remaining,
+		},
+	}
+}
+
+func PauseQuiz(room *socManager.Room) error {
+	if err := room.Pause(); err != nil {
+		return err
+	}
+	log.Printf("Quiz paused in room %s", room.ID)
+	room.SyncState()
+	_, endTime := room.EventTimes()
+	room.Broadcast <- timeUpdate(room, endTime)
+	return nil
+}
+
+// ResumeQuiz returns the end time the pause pushed the quiz to.
+func ResumeQuiz(room *socManager.Room) (int64, error) {
+	endTime, err := room.Resume()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Quiz resumed in room %s, new end time %d", room.ID, endTime)
+	room.SyncState()
+	room.Broadcast <- timeUpdate(room, endTime)
+	return endTime, nil
+}
+
+// ExtendQuiz adds time to the quiz and returns the end time for everyone. Everyone gets the new
+// end time when it applies to the whole room, otherwise only the affected students are told
+// their own deadline.
+func ExtendQuiz(room *socManager.Room, req ExtendTimeRequest) (int64, error) {
+	if req.Seconds <= 0 {
+		return 0, errors.New("seconds must be a positive number")
+	}
+	endTime, err := room.Extend(req.Seconds*1000, req.UserIDs)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Quiz extended by %d seconds in room %s for %v", req.Seconds, room.ID, req.UserIDs)
+	room.SyncState()
+
+	if len(req.UserIDs) == 0 {
+		room.Broadcast <- timeUpdate(room, endTime)
+		return endTime, nil
+	}
+	for _, userID := range req.UserIDs {
+		room.BroadcastToStudent(userID, timeUpdate(room, room.StudentEndTime(userID)))
+	}
+	return endTime, nil
+}
@@ -0,0 +1,98 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConnection serializes writes to a websocket, gorilla allows only one concurrent writer.
+type wsConnection struct {
+	conn *websocket.Conn
+	sync.Mutex
+}
+
+func newWSConnection(conn *websocket.Conn) *wsConnection {
+	return &wsConnection{conn: conn}
+}
+
+func (c *wsConnection) WriteJSON(v any) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+func (c *wsConnection) Close() error {
+	return c.conn.Close()
+}
+
+// sseConnection streams room messages as Server-Sent Events, one "data:" line of json per message.
+type sseConnection struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+func newSSEConnection(w http.ResponseWriter) (*sseConnection, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming is not supported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseConnection{w: w, flusher: flusher, closed: make(chan struct{})}, nil
+}
+
+func (c *sseConnection) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.closed:
+		return errors.New("sse connection is closed")
+	default:
+	}
+	if _, err := fmt.Fprintf(c.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// ping keeps proxies from closing an idle stream.
+func (c *sseConnection) ping() error {
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.closed:
+		return errors.New("sse connection is closed")
+	default:
+	}
+	if _, err := fmt.Fprint(c.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c *sseConnection) Close() error {
+	c.once.Do(func() {
+		c.Lock()
+		close(c.closed)
+		c.Unlock()
+	})
+	return nil
+}
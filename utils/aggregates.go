@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"sort"
+)
+
+// QuestionAggregate is the live picture of one question the teacher dashboard shows.
+type QuestionAggregate struct {
+	QuestionID           int            `json:"question_id"`
+	OptionCounts         map[string]int `json:"option_counts"`
+	Answered             int            `json:"answered"`
+	Unanswered           int            `json:"unanswered"`
+	Correct              int            `json:"correct"`
+	PercentCorrect       float64        `json:"percent_correct"` // of the students that answered
+	MedianResponseMillis int64          `json:"median_response_ms"`
+}
+
+// QuestionAggregate counts the answers given so far to a question. participants is the number of
+// students expected to answer it. Caller must hold the lock.
+func (session *QuizSession) QuestionAggregate(questionID int, question map[string]any, participants int) QuestionAggregate {
+	aggregate := QuestionAggregate{
+		QuestionID:   questionID,
+		OptionCounts: session.AnswerDistribution(questionID),
+	}
+
+	responseTimes := make([]int64, 0, len(session.Answers))
+	for _, answers := range session.Answers {
+		answer, ok := answers[questionID]
+		if !ok {
+			continue
+		}
+		aggregate.Answered++
+		if question != nil {
+			if _, correct := GradeAnswer(question, answer.Answer); correct {
+				aggregate.Correct++
+			}
+		}
+		if responseTime := answer.ResponseMillis(); responseTime > 0 {
+			responseTimes = append(responseTimes, responseTime)
+		}
+	}
+
+	if participants > aggregate.Answered {
+		aggregate.Unanswered = participants - aggregate.Answered
+	}
+	if aggregate.Answered > 0 {
+		aggregate.PercentCorrect = float64(aggregate.Correct) * 100 / float64(aggregate.Answered)
+	}
+	if len(responseTimes) > 0 {
+		sort.Slice(responseTimes, func(i, j int) bool { return responseTimes[i] < responseTimes[j] })
+		middle := len(responseTimes) / 2
+		if len(responseTimes)%2 == 0 {
+			aggregate.MedianResponseMillis = (responseTimes[middle-1] + responseTimes[middle]) / 2
+		} else {
+			aggregate.MedianResponseMillis = responseTimes[middle]
+		}
+	}
+	return aggregate
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, so they are told apart from JWTs and easy to find in
+// leaked configs.
+const APIKeyPrefix = "qz_"
+
+const (
+	DefaultAPIKeyTTL = 90 * 24 * time.Hour
+	MaxAPIKeyTTL     = 365 * 24 * time.Hour
+	// last_used_at is only written this often, not on every request.
+	apiKeyTouchInterval = time.Minute
+)
+
+var (
+	ErrAPIKeyInvalid = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key has expired or was revoked")
+	ErrAPIKeyScopes  = errors.New("invalid API key scopes")
+)
+
+// Permissions an API key can never carry, keys must not mint keys or service accounts.
+var undelegablePermissions = []Permission{PermAPIKeyManage, PermServiceAccountManage, PermSigningKeyManage}
+
+// IsAPIKey tells an API key from a JWT.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// ValidateAPIKeyScopes checks a key for a user of the role asks only for permissions the role
+// has, a key never reaches further than its user.
+func ValidateAPIKeyScopes(role string, scopes []Permission) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrAPIKeyScopes)
+	}
+	for _, scope := range scopes {
+		if slices.Contains(undelegablePermissions, scope) {
+			return fmt.Errorf("%w: '%s' cannot be given to an API key", ErrAPIKeyScopes, scope)
+		}
+		if PermissionScope(role, scope) == ScopeNone {
+			return fmt.Errorf("%w: role '%s' does not have the '%s' permission", ErrAPIKeyScopes, role, scope)
+		}
+	}
+	return nil
+}
+
+// CreateAPIKey stores a new key for the user and returns it, the key itself is not kept anywhere.
+func CreateAPIKey(user *models.User, createdBy uint, name string, scopes []Permission, ttl time.Duration) (string, *models.APIKey, error) {
+	if err := ValidateAPIKeyScopes(user.UserType, scopes); err != nil {
+		return "", nil, err
+	}
+	scopesJSON, err := json.Marshal(slices.Compact(slices.Sorted(slices.Values(scopes))))
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := newRefreshToken()
+	if err != nil {
+		return "", nil, err
+	}
+	key := APIKeyPrefix + secret
+	apiKey := models.APIKey{
+		UserID:      user.ID,
+		Name:        name,
+		Prefix:      key[:len(APIKeyPrefix)+8],
+		KeyHash:     hashToken(key),
+		Scopes:      scopesJSON,
+		CreatedByID: createdBy,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := db.DB.Create(&apiKey).Error; err != nil {
+		return "", nil, err
+	}
+	return key, &apiKey, nil
+}
+
+// APIKeyScopes are the permissions the key was given.
+func APIKeyScopes(apiKey *models.APIKey) []Permission {
+	var scopes []Permission
+	if err := json.Unmarshal(apiKey.Scopes, &scopes); err != nil {
+		return nil
+	}
+	return scopes
+}
+
+// RevokeAPIKey stops a key from working, right away.
+func RevokeAPIKey(apiKeyID uint) error {
+	now := time.Now()
+	result := db.DB.Model(&models.APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", apiKeyID).
+		Update("revoked_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// RevokeUserAPIKeys revokes every key of a user, e.g. when a service account is disabled.
+func RevokeUserAPIKeys(userID uint) error {
+	now := time.Now()
+	return db.DB.Model(&models.APIKey{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", &now).Error
+}
+
+// CanOwnServiceAccount tells whether a user of the role may own a service account of accountRole,
+// the same rule creating one follows: teachers (own scope) only own teacher and student accounts.
+func CanOwnServiceAccount(ownerRole string, accountRole string) bool {
+	switch PermissionScope(ownerRole, PermServiceAccountManage) {
+	case ScopeAny:
+		return true
+	case ScopeOwn:
+		return accountRole != "admin"
+	}
+	return false
+}
+
+// RevokeOwnerAPIKeys revokes the keys of the owner's service accounts that a user of the owner's new
+// role could not own. With an empty role the owner is being deleted, and the keys of all their
+// service accounts and their own keys are revoked.
+func RevokeOwnerAPIKeys(tx *gorm.DB, ownerID uint, role string) error {
+	var accounts []models.ServiceAccount
+	if err := tx.Preload("User").Where("owner_id = ?", ownerID).Find(&accounts).Error; err != nil {
+		return err
+	}
+	var userIDs []uint
+	if role == "" {
+		userIDs = append(userIDs, ownerID)
+	}
+	for _, account := range accounts {
+		if role == "" || account.User == nil || !CanOwnServiceAccount(role, account.User.UserType) {
+			userIDs = append(userIDs, account.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return tx.Model(&models.APIKey{}).
+		Where("user_id IN ? AND revoked_at IS NULL", userIDs).
+		Update("revoked_at", &now).Error
+}
+
+// requestAPIKey is the API key the request authenticates with, from X-API-Key or a bearer token.
+func requestAPIKey(r *http.Request) (string, bool) {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key, true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && IsAPIKey(token) {
+		return token, true
+	}
+	return "", false
+}
+
+func authorizeAPIKey(r *http.Request, key string) (*models.User, *models.APIKey, error) {
+	if !IsAPIKey(key) {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	var apiKey models.APIKey
+	if err := db.DB.Where("key_hash = ?", hashToken(key)).First(&apiKey).Error; err != nil {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	now := time.Now()
+	if apiKey.RevokedAt != nil || now.After(apiKey.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+
+	var user models.User
+	if err := db.DB.Preload("UserDetails").Preload("QuizEvents").Preload("EventResults").First(&user, apiKey.UserID).Error; err != nil {
+		return nil, nil, errors.New("user not found")
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+		apiKey.LastUsedAt = &now
+		apiKey.LastUsedIP = RequestIP(r)
+		db.DB.Model(&apiKey).UpdateColumns(map[string]any{"last_used_at": &now, "last_used_ip": apiKey.LastUsedIP})
+	}
+	return &user, &apiKey, nil
+}
+
+// CreateServiceAccount adds a service account with the role, owned by the user creating it.
+func CreateServiceAccount(owner uint, name string, role string, description *string) (*models.ServiceAccount, error) {
+	// Nobody knows this password, service accounts only use API keys.
+	randomPassword, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	emailID, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var account models.ServiceAccount
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// .invalid can never receive mail, so the forgot password flow cannot take the account over.
+		user := models.User{
+			Email:    "service-" + strings.ToLower(emailID[:16]) + "@service-accounts.invalid",
+			Password: string(hashedPassword),
+			UserType: role,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.UserDetails{UserID: user.ID, FullName: name}).Error; err != nil {
+			return err
+		}
+		account = models.ServiceAccount{UserID: user.ID, OwnerID: owner, Name: name, Description: description}
+		if err := tx.Create(&account).Error; err != nil {
+			return err
+		}
+		account.User = &user
+		return RecordRoleChange(tx, user.ID, "", role, &owner, RoleSourceServiceAccount, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// IsServiceAccount tells service accounts from people, they cannot log in with a password.
+func IsServiceAccount(userID uint) bool {
+	var count int64
+	db.DB.Model(&models.ServiceAccount{}).Where("user_id = ?", userID).Count(&count)
+	return count > 0
+}
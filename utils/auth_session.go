@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrSessionRevoked      = errors.New("session has been revoked, please log in again")
+)
+
+// TokenPair is what a login, an email verification or a refresh hands out.
+type TokenPair struct {
+	Token        string `json:"token"` // short-lived access token, sent as "Authorization: Bearer <token>"
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds the access token is valid for
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+func signAccessToken(userID uint, sessionID uint) (string, error) {
+	return Keys.Sign(TokenTypeAccess, jwt.MapClaims{
+		"id":  userID,
+		"sid": sessionID,
+		"exp": time.Now().Add(AccessTokenTTL).Unix(),
+	})
+}
+
+// IssueTokens starts a new session for the user on the device the request came from.
+func IssueTokens(user *models.User, r *http.Request) (*TokenPair, error) {
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := models.AuthSession{
+		UserID:           user.ID,
+		RefreshTokenHash: hashToken(refreshToken),
+		ExpiresAt:        now.Add(RefreshTokenTTL),
+		LastUsedAt:       now,
+		UserAgent:        r.UserAgent(),
+		IPAddress:        clientIP(r),
+	}
+	if err := db.DB.Create(&session).Error; err != nil {
+		return nil, err
+	}
+
+	accessToken, err := signAccessToken(user.ID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Token: accessToken, RefreshToken: refreshToken, ExpiresIn: int64(AccessTokenTTL.Seconds())}, nil
+}
+
+// RefreshTokens trades a refresh token for a new access token and a new refresh token, the old
+// one stops working. Presenting a refresh token that was already rotated out means it was
+// copied, so the whole session is revoked.
+func RefreshTokens(refreshToken string) (*TokenPair, error) {
+	hash := hashToken(refreshToken)
+
+	var session models.AuthSession
+	if err := db.DB.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		var reused models.AuthSession
+		if db.DB.Where("previous_token_hash = ?", hash).First(&reused).Error == nil {
+			RevokeSession(reused.ID)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	newToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	result := db.DB.Model(&models.AuthSession{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, hash).
+		Updates(map[string]any{
+			"refresh_token_hash":  hashToken(newToken),
+			"previous_token_hash": hash,
+			"last_used_at":        time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Another request rotated it first.
+		return nil, ErrInvalidRefreshToken
+	}
+
+	accessToken, err := signAccessToken(session.UserID, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Token: accessToken, RefreshToken: newToken, ExpiresIn: int64(AccessTokenTTL.Seconds())}, nil
+}
+
+func RevokeSession(sessionID uint) error {
+	return db.DB.Model(&models.AuthSession{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAllSessions logs the user out everywhere, e.g. after a password change.
+func RevokeAllSessions(userID uint) error {
+	return db.DB.Model(&models.AuthSession{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// activeSession loads the session an access token belongs to, it fails once the session is revoked.
+func activeSession(sessionID uint, userID uint) (*models.AuthSession, error) {
+	var session models.AuthSession
+	if err := db.DB.First(&session, sessionID).Error; err != nil || session.UserID != userID {
+		return nil, ErrSessionRevoked
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionRevoked
+	}
+	return &session, nil
+}
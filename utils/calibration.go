@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+)
+
+// Students rate their confidence in an answer from MinConfidence (guessing) to MaxConfidence (sure).
+const (
+	MinConfidence = 1
+	MaxConfidence = 5
+)
+
+type CalibrationBucket struct {
+	Confidence int     `json:"confidence"`
+	Answered   int     `json:"answered"`
+	Correct    int     `json:"correct"`
+	Accuracy   float64 `json:"accuracy"` // percent
+}
+
+// Calibration compares how sure students were with how often they were right. Confidence is
+// read as a probability, level/MaxConfidence, so a well calibrated student has an
+// Overconfidence close to 0, positive when they were surer than they should have been.
+type Calibration struct {
+	Rated          int                 `json:"rated"` // answers that carried a confidence
+	MeanConfidence float64             `json:"mean_confidence"`
+	Accuracy       float64             `json:"accuracy"`
+	Overconfidence float64             `json:"overconfidence"`
+	Buckets        []CalibrationBucket `json:"buckets"`
+}
+
+type calibrationSample struct {
+	confidence int
+	correct    bool
+}
+
+func ValidConfidence(confidence *int) bool {
+	return confidence == nil || (*confidence >= MinConfidence && *confidence <= MaxConfidence)
+}
+
+func calibrationOf(samples []calibrationSample) Calibration {
+	calibration := Calibration{Buckets: make([]CalibrationBucket, 0)}
+	buckets := make(map[int]*CalibrationBucket)
+	correct, confidenceSum := 0, 0
+	for _, sample := range samples {
+		bucket, exists := buckets[sample.confidence]
+		if !exists {
+			bucket = &CalibrationBucket{Confidence: sample.confidence}
+			buckets[sample.confidence] = bucket
+		}
+		bucket.Answered++
+		confidenceSum += sample.confidence
+		if sample.correct {
+			bucket.Correct++
+			correct++
+		}
+	}
+	calibration.Rated = len(samples)
+	if calibration.Rated == 0 {
+		return calibration
+	}
+	calibration.MeanConfidence = float64(confidenceSum) * 100 / float64(calibration.Rated*MaxConfidence)
+	calibration.Accuracy = float64(correct) * 100 / float64(calibration.Rated)
+	calibration.Overconfidence = calibration.MeanConfidence - calibration.Accuracy
+	for _, bucket := range buckets {
+		bucket.Accuracy = float64(bucket.Correct) * 100 / float64(bucket.Answered)
+		calibration.Buckets = append(calibration.Buckets, *bucket)
+	}
+	sort.Slice(calibration.Buckets, func(i, j int) bool { return calibration.Buckets[i].Confidence < calibration.Buckets[j].Confidence })
+	return calibration
+}
+
+// StudentCalibration grades the answers that carry a confidence, voided questions are left out.
+func StudentCalibration(answers map[int]QuizAnswer, quizJson map[string]any) Calibration {
+	samples := make([]calibrationSample, 0, len(answers))
+	for questionID, answer := range answers {
+		if answer.Confidence == nil {
+			continue
+		}
+		question, exists := FindQuestion(quizJson, questionID)
+		if !exists || IsVoided(question) {
+			continue
+		}
+		_, correct := GradeAnswer(question, answer.Answer)
+		samples = append(samples, calibrationSample{confidence: *answer.Confidence, correct: correct})
+	}
+	return calibrationOf(samples)
+}
+
+// QuizCalibration reports calibration per student and per question from the stored results of a quiz.
+func QuizCalibration(quizEvent models.QuizEvent) (map[uint]Calibration, map[int]Calibration, error) {
+	quizJson, err := quizEvent.GetQuizJsonFileMap()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var results []models.EventResult
+	if err := db.DB.Where("quiz_event_id = ?", quizEvent.ID).Find(&results).Error; err != nil {
+		return nil, nil, err
+	}
+
+	perStudent := make(map[uint]Calibration)
+	questionSamples := make(map[int][]calibrationSample)
+	for _, result := range results {
+		if result.ExtraInfoJson == nil {
+			continue
+		}
+		var stored storedAnalytics
+		if err := json.Unmarshal(*result.ExtraInfoJson, &stored); err != nil || stored.Answers == nil {
+			continue
+		}
+		perStudent[result.UserID] = StudentCalibration(stored.Answers, quizJson)
+		for questionID, answer := range stored.Answers {
+			if answer.Confidence == nil {
+				continue
+			}
+			question, exists := FindQuestion(quizJson, questionID)
+			if !exists || IsVoided(question) {
+				continue
+			}
+			_, correct := GradeAnswer(question, answer.Answer)
+			questionSamples[questionID] = append(questionSamples[questionID], calibrationSample{confidence: *answer.Confidence, correct: correct})
+		}
+	}
+
+	perQuestion := make(map[int]Calibration, len(questionSamples))
+	for questionID, samples := range questionSamples {
+		perQuestion[questionID] = calibrationOf(samples)
+	}
+	return perStudent, perQuestion, nil
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultInvitationTTL = 7 * 24 * time.Hour
+	MaxInvitationTTL     = 30 * 24 * time.Hour
+)
+
+// Where the role change came from, see models.RoleChange.
+const (
+	RoleSourceInvitation       = "invitation"
+	RoleSourceSelfRegistration = "self_registration"
+	RoleSourceUserCreate       = "user_create"
+	RoleSourceUserUpdate       = "user_update"
+	RoleSourceSSO              = "sso"
+	RoleSourceServiceAccount   = "service_account"
+)
+
+var (
+	ErrInvitationInvalid = errors.New("invalid invitation")
+	ErrInvitationUsed    = errors.New("invitation has already been used")
+	ErrInvitationExpired = errors.New("invitation has expired or was revoked")
+	ErrInvitationEmail   = errors.New("invitation was sent to a different email")
+)
+
+// CreateInvitation stores a new invitation and returns the token for the invite link, which is
+// not kept anywhere else.
+func CreateInvitation(invitedBy uint, email string, role string, department *string, ttl time.Duration) (string, *models.Invitation, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", nil, err
+	}
+	invitation := models.Invitation{
+		TokenHash:   hashToken(token),
+		Role:        role,
+		Department:  department,
+		InvitedByID: invitedBy,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if email = normalizeEmail(email); email != "" {
+		invitation.Email = &email
+	}
+	if err := db.DB.Create(&invitation).Error; err != nil {
+		return "", nil, err
+	}
+	return token, &invitation, nil
+}
+
+// InvitationURL is the link sent to the invitee, INVITE_URL_BASE points it at the frontend's
+// register page.
+func InvitationURL(token string) string {
+	base := os.Getenv("INVITE_URL_BASE")
+	if base == "" {
+		base = "http://" + GetServerBaseUrl() + "/register"
+	}
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "invite=" + token
+}
+
+// FindInvitation looks an invite token up and checks it can still be redeemed by the email.
+func FindInvitation(token string, email string) (*models.Invitation, error) {
+	var invitation models.Invitation
+	if err := db.DB.Where("token_hash = ?", hashToken(strings.TrimSpace(token))).First(&invitation).Error; err != nil {
+		return nil, ErrInvitationInvalid
+	}
+	if invitation.UsedAt != nil {
+		return nil, ErrInvitationUsed
+	}
+	if invitation.RevokedAt != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrInvitationExpired
+	}
+	if invitation.Email != nil && *invitation.Email != normalizeEmail(email) {
+		return nil, ErrInvitationEmail
+	}
+	return &invitation, nil
+}
+
+// RedeemInvitation uses the invitation up for the new user, inside the transaction creating them.
+// Only one of two registrations racing for the same invitation gets it.
+func RedeemInvitation(tx *gorm.DB, invitationID uint, userID uint) error {
+	now := time.Now()
+	result := tx.Model(&models.Invitation{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", invitationID, now).
+		Updates(map[string]any{"used_at": &now, "used_by_id": userID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvitationUsed
+	}
+	return nil
+}
+
+// RevokeInvitation stops an unused invitation from being redeemed.
+func RevokeInvitation(invitationID uint) error {
+	now := time.Now()
+	result := db.DB.Model(&models.Invitation{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", invitationID).
+		Update("revoked_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvitationUsed
+	}
+	return nil
+}
+
+// RecordRoleChange adds to the role audit trail, oldRole is empty for a new account.
+func RecordRoleChange(tx *gorm.DB, userID uint, oldRole string, newRole string, changedBy *uint, source string, invitationID *uint) error {
+	change := models.RoleChange{
+		UserID:       userID,
+		NewRole:      newRole,
+		ChangedByID:  changedBy,
+		Source:       source,
+		InvitationID: invitationID,
+	}
+	if oldRole != "" {
+		change.OldRole = &oldRole
+	}
+	return tx.Create(&change).Error
+}
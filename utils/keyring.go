@@ -0,0 +1,442 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"OnlineQuizSystem/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms the key ring signs with, JWT_SIGNING_ALG picks the one new keys use.
+const (
+	SigningAlgEdDSA = "EdDSA"
+	SigningAlgRS256 = "RS256"
+)
+
+const (
+	// SigningKeyVerifyGrace is how long a retired key keeps verifying, longer than any token
+	// lives (display tokens, 12 hours).
+	SigningKeyVerifyGrace     = 24 * time.Hour
+	DefaultSigningKeyRotation = 30 * 24 * time.Hour
+
+	signingKeyPurpose      = "signing-key"
+	rsaKeyBits             = 2048
+	keyRingRefreshInterval = time.Minute
+	// An unknown kid reloads the ring at most this often, it may be a key another instance just made.
+	keyRingMissReload = 5 * time.Second
+)
+
+// Token types, in the typ header of every token the ring signs. A token is only accepted where its
+// type is expected, e.g. a display token is no access token even though the same key signed both.
+const (
+	TokenTypeAccess             = "at+jwt"
+	TokenTypeDisplay            = "display+jwt"
+	TokenTypeTwoFactorChallenge = "2fa-challenge+jwt"
+	TokenTypeSSOLogin           = "sso-login+jwt"
+)
+
+const defaultTokenIssuer = "OnlineQuizSystem"
+
+var ErrUnknownSigningKey = errors.New("unknown or expired signing key")
+
+// SigningKeyStore keeps the signing keys of the ring.
+type SigningKeyStore interface {
+	// Valid returns the keys that still verify, oldest first.
+	Valid() ([]models.SigningKey, error)
+	// Rotate stores a key made by newKey as the signing key and retires the current ones, unless
+	// the signing key is younger than maxAge (0 always rotates). It returns nil when it rotated nothing.
+	Rotate(maxAge time.Duration, newKey func() (*models.SigningKey, error)) (*models.SigningKey, error)
+	// Expire stops a key from verifying now, ErrUnknownSigningKey when it already does not.
+	Expire(kid string) error
+}
+
+type ringKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+// KeyRing signs and verifies the JWTs this server issues with the signing keys of its store.
+// Every instance keeps them in memory and reloads them every minute, so keys rotated by another
+// instance are picked up.
+type KeyRing struct {
+	Store SigningKeyStore
+
+	mu       sync.RWMutex
+	keys     map[string]*ringKey
+	signer   *ringKey
+	loadedAt time.Time
+}
+
+// JSONWebKeySet is a JWKS document, as served by /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+var Keys = &KeyRing{Store: NewDBSigningKeyStore()}
+
+// TokenIssuer is JWT_ISSUER, the iss of every token the ring signs.
+func TokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return defaultTokenIssuer
+}
+
+// SigningAlgorithm is JWT_SIGNING_ALG, EdDSA unless it is RS256.
+func SigningAlgorithm() string {
+	if strings.EqualFold(os.Getenv("JWT_SIGNING_ALG"), SigningAlgRS256) {
+		return SigningAlgRS256
+	}
+	return SigningAlgEdDSA
+}
+
+// SigningKeyRotationFromEnv is JWT_KEY_ROTATION_DAYS as a duration, 0 turns scheduled rotation off.
+func SigningKeyRotationFromEnv() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("JWT_KEY_ROTATION_DAYS"))
+	if err != nil || days < 0 {
+		return DefaultSigningKeyRotation
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case SigningAlgEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	case SigningAlgRS256:
+		return jwt.SigningMethodRS256, nil
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %s", algorithm)
+}
+
+// signingKeyID is derived from the public key, so the same key always gets the same kid.
+func signingKeyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func newSigningKey(algorithm string) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case SigningAlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case SigningAlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %s", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := signingKeyID(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(signingKeyPurpose, der)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SigningKey{KID: kid, Algorithm: algorithm, EncryptedPrivateKey: encrypted}, nil
+}
+
+func loadRingKey(signingKey *models.SigningKey) (*ringKey, error) {
+	method, err := signingMethod(signingKey.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	der, err := decryptSecret(signingKeyPurpose, signingKey.EncryptedPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("signing key is not a private key")
+	}
+	return &ringKey{
+		kid:       signingKey.KID,
+		method:    method,
+		private:   private,
+		createdAt: signingKey.CreatedAt,
+		expiresAt: signingKey.ExpiresAt,
+	}, nil
+}
+
+// Load replaces the keys in memory with those in the store that still verify. The newest key
+// that is not retired signs.
+func (k *KeyRing) Load() error {
+	signingKeys, err := k.Store.Valid()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*ringKey, len(signingKeys))
+	var signer *ringKey
+	for i := range signingKeys {
+		key, err := loadRingKey(&signingKeys[i])
+		if err != nil {
+			// e.g. SECRET_KEY changed since the key was made, the next rotation replaces it.
+			log.Printf("Skipping signing key %s: %v", signingKeys[i].KID, err)
+			continue
+		}
+		keys[key.kid] = key
+		if signingKeys[i].RetiredAt == nil {
+			signer = key
+		}
+	}
+
+	k.mu.Lock()
+	k.keys, k.signer, k.loadedAt = keys, signer, time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// Start loads the ring, making the first key on a new database, then keeps it fresh in the
+// background and rotates the signing key once it is older than rotateAfter (never when 0).
+func (k *KeyRing) Start(rotateAfter time.Duration) error {
+	if err := k.Load(); err != nil {
+		return err
+	}
+	if k.currentSigner() == nil {
+		if _, err := k.Rotate(); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(keyRingRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if rotateAfter > 0 {
+				if _, err := k.rotateIfOlder(rotateAfter); err != nil {
+					log.Println("Signing key rotation failed: ", err)
+				}
+			}
+			if err := k.Load(); err != nil {
+				log.Println("Reloading the signing keys failed: ", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Rotate makes a new key the signing key and retires the current one, which keeps verifying the
+// tokens it signed for SigningKeyVerifyGrace.
+func (k *KeyRing) Rotate() (*models.SigningKey, error) {
+	return k.rotateIfOlder(0)
+}
+
+func (k *KeyRing) rotateIfOlder(maxAge time.Duration) (*models.SigningKey, error) {
+	created, err := k.Store.Rotate(maxAge, func() (*models.SigningKey, error) {
+		return newSigningKey(SigningAlgorithm())
+	})
+	if err != nil || created == nil {
+		return created, err
+	}
+	log.Printf("Rotated the JWT signing key, new kid %s", created.KID)
+	return created, k.Load()
+}
+
+// Revoke stops a key from verifying right away, for a key that leaked. Tokens it signed stop
+// working (their sessions can still refresh), other instances follow within a minute. Revoking
+// the signing key rotates first.
+func (k *KeyRing) Revoke(kid string) error {
+	if signer := k.currentSigner(); signer != nil && signer.kid == kid {
+		if _, err := k.Rotate(); err != nil {
+			return err
+		}
+	}
+	if err := k.Store.Expire(kid); err != nil {
+		return err
+	}
+	return k.Load()
+}
+
+func (k *KeyRing) currentSigner() *ringKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.signer
+}
+
+// Sign issues a token of the given type signed by the current signing key, its kid and type are
+// in the header and the claims get our iss.
+func (k *KeyRing) Sign(tokenType string, claims jwt.MapClaims) (string, error) {
+	signer := k.currentSigner()
+	if signer == nil {
+		return "", errors.New("no JWT signing key, the key ring is not loaded")
+	}
+	claims["iss"] = TokenIssuer()
+	token := jwt.NewWithClaims(signer.method, claims)
+	token.Header["kid"] = signer.kid
+	token.Header["typ"] = tokenType
+	return token.SignedString(signer.private)
+}
+
+// Parse verifies a token of the given type that we issued, signed by any key of the ring that has
+// not expired.
+func (k *KeyRing) Parse(tokenStr string, tokenType string) (*jwt.Token, error) {
+	return jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != tokenType {
+			return nil, fmt.Errorf("token type %q is not %q", typ, tokenType)
+		}
+		return k.verificationKey(t)
+	}, jwt.WithValidMethods([]string{SigningAlgEdDSA, SigningAlgRS256}), jwt.WithIssuer(TokenIssuer()))
+}
+
+func (k *KeyRing) lookup(kid string) (*ringKey, time.Time) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[kid], k.loadedAt
+}
+
+func (k *KeyRing) verificationKey(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, loadedAt := k.lookup(kid)
+	if key == nil && kid != "" && time.Since(loadedAt) > keyRingMissReload {
+		if err := k.Load(); err != nil {
+			return nil, err
+		}
+		key, _ = k.lookup(kid)
+	}
+	if key == nil || (key.expiresAt != nil && time.Now().After(*key.expiresAt)) {
+		return nil, ErrUnknownSigningKey
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("token algorithm %s does not match signing key %s", t.Method.Alg(), kid)
+	}
+	return key.private.Public(), nil
+}
+
+// JWKS is the public half of every key that still verifies, so other services can check our
+// tokens without sharing a secret.
+func (k *KeyRing) JWKS() JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := slices.SortedFunc(maps.Values(k.keys), func(a, b *ringKey) int {
+		return b.createdAt.Compare(a.createdAt)
+	})
+	keySet := JSONWebKeySet{Keys: []jsonWebKey{}}
+	for _, key := range keys {
+		if key.expiresAt != nil && time.Now().After(*key.expiresAt) {
+			continue
+		}
+		jwk := jsonWebKey{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		keySet.Keys = append(keySet.Keys, jwk)
+	}
+	return keySet
+}
+
+// MemorySigningKeyStore keeps the signing keys in the process, for a single instance. They are lost
+// on restart, which logs everybody out.
+type MemorySigningKeyStore struct {
+	keys   []models.SigningKey
+	nextID uint
+	sync.Mutex
+}
+
+func NewMemorySigningKeyStore() *MemorySigningKeyStore {
+	return &MemorySigningKeyStore{}
+}
+
+func (m *MemorySigningKeyStore) Valid() ([]models.SigningKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	var valid []models.SigningKey
+	for _, key := range m.keys {
+		if key.ExpiresAt == nil || key.ExpiresAt.After(now) {
+			valid = append(valid, key)
+		}
+	}
+	return valid, nil
+}
+
+func (m *MemorySigningKeyStore) Rotate(maxAge time.Duration, newKey func() (*models.SigningKey, error)) (*models.SigningKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	var current []int
+	for i, key := range m.keys {
+		if key.RetiredAt == nil {
+			current = append(current, i)
+		}
+	}
+	if maxAge > 0 && len(current) > 0 && time.Since(m.keys[current[len(current)-1]].CreatedAt) < maxAge {
+		return nil, nil
+	}
+
+	signingKey, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	m.nextID++
+	signingKey.ID, signingKey.CreatedAt, signingKey.UpdatedAt = m.nextID, now, now
+	expiresAt := now.Add(SigningKeyVerifyGrace)
+	for _, i := range current {
+		m.keys[i].RetiredAt, m.keys[i].ExpiresAt = &now, &expiresAt
+	}
+	m.keys = append(m.keys, *signingKey)
+	return signingKey, nil
+}
+
+func (m *MemorySigningKeyStore) Expire(kid string) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	for i, key := range m.keys {
+		if key.KID != kid || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+			continue
+		}
+		if key.RetiredAt == nil {
+			m.keys[i].RetiredAt = &now
+		}
+		m.keys[i].ExpiresAt = &now
+		return nil
+	}
+	return ErrUnknownSigningKey
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DBSigningKeyStore keeps the signing keys in the database, shared by every instance.
+type DBSigningKeyStore struct{}
+
+func NewDBSigningKeyStore() *DBSigningKeyStore {
+	return &DBSigningKeyStore{}
+}
+
+func (DBSigningKeyStore) Valid() ([]models.SigningKey, error) {
+	var signingKeys []models.SigningKey
+	err := db.DB.Where("expires_at IS NULL OR expires_at > ?", time.Now()).Order("id").Find(&signingKeys).Error
+	return signingKeys, err
+}
+
+func (DBSigningKeyStore) Rotate(maxAge time.Duration, newKey func() (*models.SigningKey, error)) (*models.SigningKey, error) {
+	var created *models.SigningKey
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// Instances rotating at the same time take turns on the lock, the later ones then see the
+		// new key is young enough and leave it.
+		var current []models.SigningKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("retired_at IS NULL").Order("id desc").Find(&current).Error; err != nil {
+			return err
+		}
+		if maxAge > 0 && len(current) > 0 && time.Since(current[0].CreatedAt) < maxAge {
+			return nil
+		}
+
+		signingKey, err := newKey()
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(signingKey).Error; err != nil {
+			return err
+		}
+		if len(current) > 0 {
+			ids := make([]uint, len(current))
+			for i, key := range current {
+				ids[i] = key.ID
+			}
+			now := time.Now()
+			expiresAt := now.Add(SigningKeyVerifyGrace)
+			if err := tx.Model(&models.SigningKey{}).Where("id IN ?", ids).Updates(map[string]any{"retired_at": &now, "expires_at": &expiresAt}).Error; err != nil {
+				return err
+			}
+		}
+		created = signingKey
+		return nil
+	})
+	return created, err
+}
+
+func (DBSigningKeyStore) Expire(kid string) error {
+	now := time.Now()
+	result := db.DB.Model(&models.SigningKey{}).
+		Where("kid = ? AND (expires_at IS NULL OR expires_at > ?)", kid, now).
+		Updates(map[string]any{"retired_at": gorm.Expr("COALESCE(retired_at, ?)", now), "expires_at": &now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUnknownSigningKey
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestKeyRing(t *testing.T) (*KeyRing, *MemorySigningKeyStore) {
+	t.Helper()
+	t.Setenv("SECRET_KEY", "test-secret")
+	store := NewMemorySigningKeyStore()
+	keys := &KeyRing{Store: store}
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+	return keys, store
+}
+
+func signTestToken(t *testing.T, keys *KeyRing) string {
+	t.Helper()
+	token, err := keys.Sign(TokenTypeAccess, jwt.MapClaims{"id": 7, "exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return token
+}
+
+func tokenKid(t *testing.T, tokenStr string) string {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	keys, store := newTestKeyRing(t)
+	oldToken := signTestToken(t, keys)
+
+	rotated, err := keys.Rotate()
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	newToken := signTestToken(t, keys)
+	if kid := tokenKid(t, newToken); kid != rotated.KID || kid == tokenKid(t, oldToken) {
+		t.Fatalf("token after rotating is signed by %s, want the new key %s", kid, rotated.KID)
+	}
+	if _, err := keys.Parse(oldToken, TokenTypeAccess); err != nil {
+		t.Fatalf("token of the retired key is rejected during the grace period: %v", err)
+	}
+	if got := len(keys.JWKS().Keys); got != 2 {
+		t.Fatalf("JWKS lists %d keys during the grace period, want 2", got)
+	}
+
+	// The grace period ends.
+	store.Lock()
+	ended := time.Now().Add(-time.Second)
+	store.keys[0].ExpiresAt = &ended
+	store.Unlock()
+	if err := keys.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Parse(oldToken, TokenTypeAccess); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Fatalf("token of an expired key: got %v, want ErrUnknownSigningKey", err)
+	}
+	if _, err := keys.Parse(newToken, TokenTypeAccess); err != nil {
+		t.Fatalf("token of the signing key: %v", err)
+	}
+}
+
+func TestKeyRingRotateIfOlderKeepsAYoungKey(t *testing.T) {
+	keys, _ := newTestKeyRing(t)
+	rotated, err := keys.rotateIfOlder(time.Hour)
+	if err != nil || rotated != nil {
+		t.Fatalf("a key made just now was rotated: %v, %v", rotated, err)
+	}
+}
+
+func TestKeyRingRevoke(t *testing.T) {
+	keys, _ := newTestKeyRing(t)
+	token := signTestToken(t, keys)
+	kid := tokenKid(t, token)
+
+	if err := keys.Revoke(kid); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := keys.Parse(token, TokenTypeAccess); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Fatalf("token of a revoked key: got %v, want ErrUnknownSigningKey", err)
+	}
+	// Revoking the signing key rotated, so tokens are still issued.
+	after := signTestToken(t, keys)
+	if tokenKid(t, after) == kid {
+		t.Fatal("the revoked key still signs")
+	}
+	if _, err := keys.Parse(after, TokenTypeAccess); err != nil {
+		t.Fatalf("token of the new key: %v", err)
+	}
+	if err := keys.Revoke(kid); !errors.Is(err, ErrUnknownSigningKey) {
+		t.Fatalf("revoking twice: got %v, want ErrUnknownSigningKey", err)
+	}
+}
+
+func TestKeyRingRejects(t *testing.T) {
+	keys, _ := newTestKeyRing(t)
+	kid := keys.currentSigner().kid
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"id": 7, "iss": TokenIssuer(), "exp": time.Now().Add(time.Minute).Unix()}
+	}
+	forge := func(method jwt.SigningMethod, key any) string {
+		token := jwt.NewWithClaims(method, claims())
+		token.Header["kid"] = kid
+		token.Header["typ"] = TokenTypeAccess
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	cases := []struct {
+		name  string
+		token func() string
+		typ   string
+	}{
+		{name: "HS256", token: func() string { return forge(jwt.SigningMethodHS256, []byte("test-secret")) }, typ: TokenTypeAccess},
+		{name: "algorithm of another key type", token: func() string { return forge(jwt.SigningMethodRS256, otherKey) }, typ: TokenTypeAccess},
+		{name: "wrong token type", token: func() string { return signTestToken(t, keys) }, typ: TokenTypeDisplay},
+		{name: "another issuer", token: func() string {
+			t.Setenv("JWT_ISSUER", "https://other.example")
+			defer t.Setenv("JWT_ISSUER", "")
+			return signTestToken(t, keys)
+		}, typ: TokenTypeAccess},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := keys.Parse(tc.token(), tc.typ); err == nil {
+				t.Fatal("token was accepted")
+			}
+		})
+	}
+}
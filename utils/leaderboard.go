@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+)
+
+type LeaderboardOptions struct {
+	Enabled   bool `json:"enabled"`
+	Interval  int  `json:"interval"`  // seconds between broadcasts, 0 = when a question window closes or opens, or as answers are graded without windows
+	Anonymize bool `json:"anonymize"` // show generated nicknames instead of real names
+	TopN      int  `json:"top_n"`     // 0 = everyone
+}
+
+type LeaderboardEntry struct {
+	Rank         int    `json:"rank"`
+	UserID       uint   `json:"user_id,omitempty"`
+	Nickname     string `json:"nickname"`
+	Score        int    `json:"score"`
+	Answered     int    `json:"answered"`
+	ResponseTime int64  `json:"response_time"` // total millis taken across answered questions
+}
+
+var nicknameAdjectives = []string{"Swift", "Clever", "Brave", "Calm", "Bright", "Lucky", "Quiet", "Bold", "Witty", "Happy"}
+var nicknameAnimals = []string{"Otter", "Falcon", "Panda", "Tiger", "Koala", "Fox", "Dolphin", "Owl", "Lynx", "Heron"}
+
+// GetLeaderboardOptions reads the optional "leaderboard" block of a quiz json.
+// The leaderboard is enabled by default, showing everyone with real names. Without an interval
+// it is sent when a question window opens or closes, or, for a quiz without windows, as answers
+// are graded (at most once a second).
+func GetLeaderboardOptions(quizJson map[string]any) LeaderboardOptions {
+	options := LeaderboardOptions{Enabled: true}
+	raw, ok := quizJson["leaderboard"].(map[string]any)
+	if !ok {
+		return options
+	}
+	if enabled, ok := raw["enabled"].(bool); ok {
+		options.Enabled = enabled
+	}
+	if interval, ok := raw["interval"].(float64); ok && interval > 0 {
+		options.Interval = int(interval)
+	}
+	if anonymize, ok := raw["anonymize"].(bool); ok {
+		options.Anonymize = anonymize
+	}
+	if topN, ok := raw["top_n"].(float64); ok && topN > 0 {
+		options.TopN = int(topN)
+	}
+	return options
+}
+
+// anonymousNickname is derived from a MAC of the quiz and the student keyed with the server
+// secret, so nobody can work out who is behind a name. attempt picks another name when the
+// first one is taken.
+func anonymousNickname(quizEventID uint, userID uint, attempt int) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SECRET_KEY")))
+	fmt.Fprintf(mac, "nickname\x00%d\x00%d\x00%d", quizEventID, userID, attempt)
+	sum := mac.Sum(nil)
+	return fmt.Sprintf("%s %s %d",
+		nicknameAdjectives[int(sum[0])%len(nicknameAdjectives)],
+		nicknameAnimals[int(sum[1])%len(nicknameAnimals)],
+		binary.BigEndian.Uint16(sum[2:4])%1000)
+}
+
+// pseudonym is the student's anonymous name in this quiz, no two students share one. Names are
+// kept in the session so they do not change during the quiz.
+func (session *QuizSession) pseudonym(quizEventID uint, userID uint) string {
+	if name, ok := session.Pseudonyms[userID]; ok {
+		return name
+	}
+	taken := make(map[string]bool, len(session.Pseudonyms))
+	for _, name := range session.Pseudonyms {
+		taken[name] = true
+	}
+	name := anonymousNickname(quizEventID, userID, 0)
+	for attempt := 1; taken[name]; attempt++ {
+		name = anonymousNickname(quizEventID, userID, attempt)
+	}
+	session.Pseudonyms[userID] = name
+	return name
+}
+
+// displayName is cached in the session so we only hit the database once per student.
+func (session *QuizSession) displayName(userID uint) string {
+	if name, ok := session.Nicknames[userID]; ok {
+		return name
+	}
+	name := fmt.Sprintf("Student %d", userID)
+	var user models.User
+	if err := db.DB.Preload("UserDetails").First(&user, userID).Error; err == nil {
+		if user.UserDetails.FullName != "" {
+			name = user.UserDetails.FullName
+		} else {
+			name = strings.Split(user.Email, "@")[0]
+		}
+	}
+	session.Nicknames[userID] = name
+	return name
+}
+
+// BuildLeaderboard ranks students by score, ties are broken by who answered faster.
+// Caller must hold the session lock.
+func (session *QuizSession) BuildLeaderboard(quizEventID uint, options LeaderboardOptions) []LeaderboardEntry {
+	entries := make([]LeaderboardEntry, 0, len(session.Scores))
+	for userID, scores := range session.Scores {
+		entry := LeaderboardEntry{UserID: userID}
+		for qID, points := range scores {
+			entry.Score += points
+			entry.Answered++
+			if ans, ok := session.Answers[userID][qID]; ok {
+				entry.ResponseTime += ans.ResponseMillis()
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		if entries[i].ResponseTime != entries[j].ResponseTime {
+			return entries[i].ResponseTime < entries[j].ResponseTime
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+
+	if options.TopN > 0 && len(entries) > options.TopN {
+		entries = entries[:options.TopN]
+	}
+
+	for i := range entries {
+		entries[i].Rank = i + 1
+		if options.Anonymize {
+			entries[i].Nickname = session.pseudonym(quizEventID, entries[i].UserID)
+			entries[i].UserID = 0
+		} else {
+			entries[i].Nickname = session.displayName(entries[i].UserID)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "testing"
+
+func TestPseudonymsAreUniqueAndStable(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	session := NewQuizSession(0)
+
+	names := make(map[string]uint)
+	for userID := uint(1); userID <= 2000; userID++ {
+		name := session.pseudonym(7, userID)
+		if other, taken := names[name]; taken {
+			t.Fatalf("students %d and %d are both %q", other, userID, name)
+		}
+		names[name] = userID
+	}
+	if again := session.pseudonym(7, 150); names[again] != 150 {
+		t.Fatalf("student 150 got a new name %q", again)
+	}
+}
+
+func TestNicknamesDoNotFollowUserIDs(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-secret")
+	// Students 100 apart always shared a name when it was derived from the id.
+	same := 0
+	for userID := uint(1); userID <= 100; userID++ {
+		if anonymousNickname(7, userID, 0) == anonymousNickname(7, userID+100, 0) {
+			same++
+		}
+	}
+	if same > 2 {
+		t.Fatalf("%d of 100 students share their name with the student 100 ids later", same)
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+
+	"gorm.io/gorm"
+)
+
+// GetLobbySettings reads the optional "lobby" block of a quiz json, by default anyone with the
+// channel code can join, no matter how many.
+func GetLobbySettings(quizJson map[string]any) socManager.LobbySettings {
+	var settings socManager.LobbySettings
+	raw, ok := quizJson["lobby"].(map[string]any)
+	if !ok {
+		return settings
+	}
+	if requireApproval, ok := raw["require_approval"].(bool); ok {
+		settings.RequireApproval = requireApproval
+	}
+	if maxParticipants, ok := raw["max_participants"].(float64); ok && maxParticipants > 0 {
+		settings.MaxParticipants = int(maxParticipants)
+	}
+	if locked, ok := raw["locked"].(bool); ok {
+		settings.Locked = locked
+	}
+	return settings
+}
+
+func IsBanned(quizEventID uint, userID uint) bool {
+	var count int64
+	db.DB.Model(&models.QuizBan{}).Where("quiz_event_id = ? AND user_id = ?", quizEventID, userID).Count(&count)
+	return count > 0
+}
+
+// BanUser keeps the user out of the quiz event. A ban lifted before left a soft-deleted row
+// behind (older versions deleted softly), that row is brought back rather than clashing with
+// the unique index.
+func BanUser(tx *gorm.DB, quizEventID uint, userID uint, bannedBy uint, reason *string) error {
+	ban := models.QuizBan{QuizEventID: quizEventID, UserID: userID}
+	if err := tx.Unscoped().Where(ban).Attrs(models.QuizBan{BannedBy: bannedBy, Reason: reason}).FirstOrCreate(&ban).Error; err != nil {
+		return err
+	}
+	if !ban.DeletedAt.Valid {
+		return nil
+	}
+	return tx.Unscoped().Model(&ban).Updates(map[string]any{"deleted_at": nil, "banned_by": bannedBy, "reason": reason}).Error
+}
+
+// UnbanUsers lifts the bans for good, the rows are deleted so a later ban can be stored again.
+func UnbanUsers(tx *gorm.DB, quizEventID uint, userIDs []uint) error {
+	return tx.Unscoped().Where("quiz_event_id = ? AND user_id IN ?", quizEventID, userIDs).Delete(&models.QuizBan{}).Error
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// statementLog keeps the SQL gorm would run, nothing reaches a database in dry run mode.
+type statementLog struct {
+	logger.Interface
+	statements []string
+}
+
+func (l *statementLog) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	l.statements = append(l.statements, sql)
+}
+
+func dryRunDB(t *testing.T) (*gorm.DB, *statementLog) {
+	t.Helper()
+	statements := &statementLog{Interface: logger.Discard}
+	tx, err := gorm.Open(mysql.New(mysql.Config{DSN: "quiz:quiz@tcp(127.0.0.1:1)/quiz", SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true, Logger: statements})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, statements
+}
+
+func TestBanUnbanBan(t *testing.T) {
+	tx, statements := dryRunDB(t)
+
+	if err := BanUser(tx, 3, 7, 1, nil); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	if err := UnbanUsers(tx, 3, []uint{7}); err != nil {
+		t.Fatalf("unban: %v", err)
+	}
+	unban := statements.statements[len(statements.statements)-1]
+	if !strings.HasPrefix(unban, "DELETE FROM `quiz_bans`") {
+		t.Fatalf("unban does not delete the ban row, a second ban would clash with the unique index: %s", unban)
+	}
+
+	before := len(statements.statements)
+	if err := BanUser(tx, 3, 7, 1, nil); err != nil {
+		t.Fatalf("second ban: %v", err)
+	}
+	lookup := statements.statements[before]
+	if !strings.HasPrefix(lookup, "SELECT") || strings.Contains(lookup, "deleted_at") {
+		t.Fatalf("the second ban does not look for soft-deleted bans before inserting: %s", lookup)
+	}
+}
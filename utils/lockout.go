@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// After LockoutThreshold failed logins in a row an account is locked, first for LockoutBaseDelay
+// and twice as long after every further failure, up to LockoutMaxDelay. Failures are forgotten
+// a day after the first one or on a successful login.
+const (
+	LockoutThreshold  = 5
+	LockoutBaseDelay  = 30 * time.Second
+	LockoutMaxDelay   = time.Hour
+	lockoutFailWindow = 24 * time.Hour
+)
+
+func lockoutKeys(email string) (string, string) {
+	email = normalizeEmail(email)
+	return "login-failures:" + email, "login-locked:" + email
+}
+
+// LockoutDelay is how long an account is locked after the given number of failures.
+func LockoutDelay(failures int64) time.Duration {
+	if failures < LockoutThreshold {
+		return 0
+	}
+	delay := LockoutBaseDelay
+	for i := int64(LockoutThreshold); i < failures && delay < LockoutMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, LockoutMaxDelay)
+}
+
+// AccountLockedFor is how long until the account can try to log in again, 0 when it is not locked.
+func AccountLockedFor(email string) time.Duration {
+	_, lockedKey := lockoutKeys(email)
+	left, err := Limiter.BlockedFor(lockedKey)
+	if err != nil {
+		log.Println("Could not read the account lockout: ", err)
+		return 0
+	}
+	return left
+}
+
+// RecordLoginFailure counts a wrong password or second factor and locks the account when there
+// were too many. It returns how long the account is locked now.
+func RecordLoginFailure(email string) time.Duration {
+	failuresKey, lockedKey := lockoutKeys(email)
+	failures, _, err := Limiter.Incr(failuresKey, lockoutFailWindow)
+	if err != nil {
+		log.Println("Could not count the failed login: ", err)
+		return 0
+	}
+	delay := LockoutDelay(failures)
+	if delay > 0 {
+		if err := Limiter.Block(lockedKey, delay); err != nil {
+			log.Println("Could not lock the account: ", err)
+			return 0
+		}
+		log.Printf("Account %s locked for %s after %d failed logins", strings.TrimSpace(email), delay, failures)
+	}
+	return delay
+}
+
+func ClearLoginFailures(email string) {
+	failuresKey, lockedKey := lockoutKeys(email)
+	if err := Limiter.Delete(failuresKey, lockedKey); err != nil {
+		log.Println("Could not clear the failed logins: ", err)
+	}
+}
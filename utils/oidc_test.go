@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID = "quiz-app"
+	testIdPKid   = "idp-key-1"
+)
+
+// fakeIdP is an OpenID Connect provider serving discovery, a token endpoint that checks PKCE
+// and the JWKS its ID tokens are verified with.
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// challenge and nonce of the login in progress, from the authorization request.
+	challenge string
+	nonce     string
+	// idTokenClaims lets a test change what the ID token says.
+	idTokenClaims func(claims jwt.MapClaims)
+	// signingKey signs the ID token, the key published in the JWKS when nil.
+	signingKey *rsa.PrivateKey
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": testIdPKid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != "the-code" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            testClientID,
+		"sub":            "idp-user-1",
+		"email":          "Ada@School.example",
+		"email_verified": true,
+		"name":           "Ada Lovelace",
+		"nonce":          idp.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+	}
+	if idp.idTokenClaims != nil {
+		idp.idTokenClaims(claims)
+	}
+	signingKey := idp.key
+	if idp.signingKey != nil {
+		signingKey = idp.signingKey
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = testIdPKid
+	idToken, err := token.SignedString(signingKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": idToken, "token_type": "Bearer"})
+}
+
+// login runs the flow up to the code exchange, like the login and callback handlers do.
+func (idp *fakeIdP) login(t *testing.T, verifierOverride string) (*ExternalIdentity, error) {
+	t.Helper()
+	provider, err := NewOIDCProvider(OIDCConfig{
+		Name:        "school",
+		Issuer:      idp.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://quiz.example/auth/school/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := NewRandomState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthURL(context.Background(), "the-state", nonce, challenge)
+	if err != nil {
+		t.Fatalf("AuthURL: %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") || query.Get("code_challenge_method") != "S256" ||
+		query.Get("state") != "the-state" || query.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization url %s", authURL)
+	}
+	idp.challenge, idp.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	if verifierOverride != "" {
+		verifier = verifierOverride
+	}
+	return provider.Exchange(context.Background(), "the-code", verifier, nonce)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	identity, err := idp.login(t, "")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if identity.Provider != "school" || identity.Subject != "idp-user-1" || identity.Email != "Ada@School.example" ||
+		!identity.EmailVerified || identity.Name != "Ada Lovelace" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestOIDCLoginUnverifiedEmail(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.idTokenClaims = func(claims jwt.MapClaims) { claims["email_verified"] = false }
+	identity, err := idp.login(t, "")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if identity.EmailVerified {
+		t.Fatal("an unverified email was reported as verified")
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		claims   func(jwt.MapClaims)
+		key      *rsa.PrivateKey
+		verifier string
+		wantErr  string
+	}{
+		{name: "wrong nonce", claims: func(c jwt.MapClaims) { c["nonce"] = "replayed" }, wantErr: "nonce"},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "another-app" }, wantErr: "aud"},
+		{name: "wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }, wantErr: "iss"},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "not signed by the provider", key: otherKey, wantErr: "signature"},
+		{name: "wrong PKCE verifier", verifier: "not-the-verifier", wantErr: "PKCE"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := newFakeIdP(t)
+			idp.idTokenClaims = tc.claims
+			idp.signingKey = tc.key
+			identity, err := idp.login(t, tc.verifier)
+			if err == nil {
+				t.Fatalf("login succeeded with %+v", identity)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("error %q does not mention %q", err, tc.wantErr)
+			}
+		})
+	}
+}
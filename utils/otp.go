@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What an OTP was sent for, codes of one purpose can never be used for another.
+const (
+	OTPPurposeRegister       = "register"
+	OTPPurposeForgotPassword = "forgot_password"
+)
+
+var (
+	ErrOTPInvalid         = errors.New("invalid OTP or email")
+	ErrOTPExpired         = errors.New("OTP has expired, please request a new one")
+	ErrOTPTooManyAttempts = errors.New("too many wrong OTPs, please request a new one")
+	ErrOTPCooldown        = errors.New("an OTP was sent recently, please wait before asking for another one")
+)
+
+// OTPRecord is a code waiting to be verified, only the code's hash is kept.
+type OTPRecord struct {
+	Purpose   string
+	Email     string
+	CodeHash  string
+	Payload   string // json the caller gets back once the code is verified, e.g. a pending registration
+	Attempts  int
+	SentAt    time.Time
+	ExpiresAt time.Time
+}
+
+// OTPStore keeps the pending codes, there is an in-memory store for a single instance and
+// a database store that survives restarts and is shared between instances. Every check and
+// change of a code is one atomic step, so parallel requests can not race past the limits.
+type OTPStore interface {
+	// Save replaces any pending code of the same purpose and email, unless that one was sent less
+	// than cooldown ago, then it returns ErrOTPCooldown.
+	Save(record OTPRecord, cooldown time.Duration) error
+	// ReserveAttempt counts a guess before it is checked and returns the code with the attempt
+	// counted. It returns nil, nil when there is no pending code and ErrOTPTooManyAttempts when
+	// maxAttempts guesses were already made.
+	ReserveAttempt(purpose string, email string, maxAttempts int) (*OTPRecord, error)
+	// DeleteCode uses the code up, only if it is still the pending one. It reports whether it did,
+	// so of two requests with the right code only one gets through.
+	DeleteCode(purpose string, email string, codeHash string) (bool, error)
+	Delete(purpose string, email string) error
+}
+
+type OTPService struct {
+	Store          OTPStore
+	TTL            time.Duration
+	ResendCooldown time.Duration
+	MaxAttempts    int
+}
+
+func NewOTPService(store OTPStore) *OTPService {
+	return &OTPService{
+		Store:          store,
+		TTL:            10 * time.Minute,
+		ResendCooldown: time.Minute,
+		MaxAttempts:    5,
+	}
+}
+
+// OTP is the service the auth handlers use, main switches it to the database store with OTP_STORE=db.
+var OTP = NewOTPService(NewMemoryOTPStore())
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// hashOTP is keyed with the server secret, a plain hash of a 6 digit code would be trivial to reverse.
+func hashOTP(purpose string, email string, code string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SECRET_KEY")))
+	mac.Write([]byte(purpose + "\x00" + email + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// Issue creates a new code for the email, replacing the pending one. payload is handed back by Verify.
+func (s *OTPService) Issue(purpose string, email string, payload any) (string, error) {
+	email = normalizeEmail(email)
+	code, err := generateOTPCode()
+	if err != nil {
+		return "", err
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.Store.Save(OTPRecord{
+		Purpose:   purpose,
+		Email:     email,
+		CodeHash:  hashOTP(purpose, email, code),
+		Payload:   string(payloadBytes),
+		SentAt:    now,
+		ExpiresAt: now.Add(s.TTL),
+	}, s.ResendCooldown)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Verify checks the code and uses it up, the issued payload is decoded into payload when it is not nil.
+// Every guess counts before it is checked, after MaxAttempts the code is thrown away.
+func (s *OTPService) Verify(purpose string, email string, code string, payload any) error {
+	email = normalizeEmail(email)
+	record, err := s.Store.ReserveAttempt(purpose, email, s.MaxAttempts)
+	if errors.Is(err, ErrOTPTooManyAttempts) {
+		s.Store.Delete(purpose, email)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return ErrOTPInvalid
+	}
+	if time.Now().After(record.ExpiresAt) {
+		s.Store.Delete(purpose, email)
+		return ErrOTPExpired
+	}
+
+	expected := []byte(record.CodeHash)
+	given := []byte(hashOTP(purpose, email, strings.TrimSpace(code)))
+	if !hmac.Equal(expected, given) {
+		if record.Attempts >= s.MaxAttempts {
+			s.Store.Delete(purpose, email)
+			return ErrOTPTooManyAttempts
+		}
+		return ErrOTPInvalid
+	}
+
+	deleted, err := s.Store.DeleteCode(purpose, email, record.CodeHash)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrOTPInvalid
+	}
+	if payload != nil {
+		return json.Unmarshal([]byte(record.Payload), payload)
+	}
+	return nil
+}
+
+// MemoryOTPStore keeps codes in the process, they are lost on restart.
+type MemoryOTPStore struct {
+	records map[string]OTPRecord
+	sync.Mutex
+}
+
+func NewMemoryOTPStore() *MemoryOTPStore {
+	return &MemoryOTPStore{records: make(map[string]OTPRecord)}
+}
+
+func otpKey(purpose string, email string) string {
+	return purpose + "\x00" + email
+}
+
+func (m *MemoryOTPStore) Save(record OTPRecord, cooldown time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	key := otpKey(record.Purpose, record.Email)
+	if existing, ok := m.records[key]; ok && time.Since(existing.SentAt) < cooldown {
+		return ErrOTPCooldown
+	}
+	// Drop codes nobody came back for, so the map does not grow forever.
+	now := time.Now()
+	for key, existing := range m.records {
+		if now.After(existing.ExpiresAt) {
+			delete(m.records, key)
+		}
+	}
+	m.records[key] = record
+	return nil
+}
+
+func (m *MemoryOTPStore) ReserveAttempt(purpose string, email string, maxAttempts int) (*OTPRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := otpKey(purpose, email)
+	record, ok := m.records[key]
+	if !ok {
+		return nil, nil
+	}
+	if record.Attempts >= maxAttempts {
+		return nil, ErrOTPTooManyAttempts
+	}
+	record.Attempts++
+	m.records[key] = record
+	return &record, nil
+}
+
+func (m *MemoryOTPStore) DeleteCode(purpose string, email string, codeHash string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	key := otpKey(purpose, email)
+	if record, ok := m.records[key]; !ok || record.CodeHash != codeHash {
+		return false, nil
+	}
+	delete(m.records, key)
+	return true, nil
+}
+
+func (m *MemoryOTPStore) Delete(purpose string, email string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.records, otpKey(purpose, email))
+	return nil
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"gorm.io/gorm"
+)
+
+// DBOTPStore keeps codes in the database, so they survive restarts and work across instances.
+type DBOTPStore struct{}
+
+func NewDBOTPStore() *DBOTPStore {
+	return &DBOTPStore{}
+}
+
+// Save replaces the pending code in place with a conditional update, which only matches a code
+// older than the cooldown. Without a pending code the insert runs into the unique index when
+// another request created one meanwhile.
+func (store DBOTPStore) Save(record OTPRecord, cooldown time.Duration) error {
+	if err := db.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OTPCode{}).Error; err != nil {
+		return err
+	}
+
+	result := db.DB.Model(&models.OTPCode{}).
+		Where("purpose = ? AND email = ? AND sent_at <= ?", record.Purpose, record.Email, time.Now().Add(-cooldown)).
+		Updates(map[string]any{
+			"code_hash":  record.CodeHash,
+			"payload":    record.Payload,
+			"attempts":   record.Attempts,
+			"sent_at":    record.SentAt,
+			"expires_at": record.ExpiresAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	err := db.DB.Create(&models.OTPCode{
+		Purpose:   record.Purpose,
+		Email:     record.Email,
+		CodeHash:  record.CodeHash,
+		Payload:   record.Payload,
+		Attempts:  record.Attempts,
+		SentAt:    record.SentAt,
+		ExpiresAt: record.ExpiresAt,
+	}).Error
+	if err != nil {
+		if existing, loadErr := store.load(record.Purpose, record.Email); loadErr == nil && existing != nil {
+			return ErrOTPCooldown
+		}
+		return err
+	}
+	return nil
+}
+
+func (DBOTPStore) load(purpose string, email string) (*OTPRecord, error) {
+	var code models.OTPCode
+	err := db.DB.Where("purpose = ? AND email = ?", purpose, email).First(&code).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &OTPRecord{
+		Purpose:   code.Purpose,
+		Email:     code.Email,
+		CodeHash:  code.CodeHash,
+		Payload:   code.Payload,
+		Attempts:  code.Attempts,
+		SentAt:    code.SentAt,
+		ExpiresAt: code.ExpiresAt,
+	}, nil
+}
+
+// ReserveAttempt counts the guess with a conditional update, the database serializes parallel ones.
+func (store DBOTPStore) ReserveAttempt(purpose string, email string, maxAttempts int) (*OTPRecord, error) {
+	result := db.DB.Model(&models.OTPCode{}).
+		Where("purpose = ? AND email = ? AND attempts < ?", purpose, email, maxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	record, err := store.load(purpose, email)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrOTPTooManyAttempts
+	}
+	return record, nil
+}
+
+func (DBOTPStore) DeleteCode(purpose string, email string, codeHash string) (bool, error) {
+	result := db.DB.Unscoped().Where("purpose = ? AND email = ? AND code_hash = ?", purpose, email, codeHash).Delete(&models.OTPCode{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (DBOTPStore) Delete(purpose string, email string) error {
+	return db.DB.Unscoped().Where("purpose = ? AND email = ?", purpose, email).Delete(&models.OTPCode{}).Error
+}
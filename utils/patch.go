@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+
+	"gorm.io/datatypes"
+)
+
+// FieldKind is the json type a PATCH field must have.
+type FieldKind int
+
+const (
+	FieldString FieldKind = iota
+	FieldInt
+	FieldUint
+	FieldFloat
+	FieldBool
+	FieldJSON // any json object or array, stored in a datatypes.JSON column
+)
+
+// PatchField describes one field the generic PATCH apis may change.
+type PatchField struct {
+	Kind     FieldKind
+	Column   string   // database column, the json key when empty
+	Nullable bool     // whether null clears the field
+	Roles    []string // roles allowed to change the field
+	Min      *float64 // lower bound of number fields
+	OneOf    []string // allowed values of string fields
+}
+
+// PatchSchema is the allow-list of a model's updatable fields, keyed by json key.
+type PatchSchema map[string]PatchField
+
+var (
+	ErrPatchInvalid   = errors.New("invalid update")
+	ErrPatchForbidden = errors.New("field can not be changed")
+)
+
+func MinValue(min float64) *float64 {
+	return &min
+}
+
+// Allows tells whether the role may set the field, create apis use it for fields a model only
+// lets some roles set.
+func (s PatchSchema) Allows(role string, key string) bool {
+	field, ok := s[key]
+	return ok && slices.Contains(field.Roles, role)
+}
+
+// Apply checks a PATCH body against the schema for the caller's role and returns the column
+// updates to hand to gorm. Unknown fields, fields the role may not change and values of the
+// wrong type are rejected as a whole, nothing is updated then.
+func (s PatchSchema) Apply(role string, body map[string]any) (map[string]any, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("%w: no fields to update", ErrPatchInvalid)
+	}
+
+	keys := make([]string, 0, len(body))
+	for key := range body {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	updates := make(map[string]any, len(body))
+	for _, key := range keys {
+		field, ok := s[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s' is not an updatable field", ErrPatchInvalid, key)
+		}
+		if !slices.Contains(field.Roles, role) {
+			return nil, fmt.Errorf("%w: role '%s' can not change '%s'", ErrPatchForbidden, role, key)
+		}
+		value, err := field.convert(body[key])
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s' %s", ErrPatchInvalid, key, err.Error())
+		}
+		column := field.Column
+		if column == "" {
+			column = key
+		}
+		updates[column] = value
+	}
+	return updates, nil
+}
+
+func (f PatchField) convert(value any) (any, error) {
+	if value == nil {
+		if !f.Nullable {
+			return nil, errors.New("can not be null")
+		}
+		return nil, nil
+	}
+
+	switch f.Kind {
+	case FieldString:
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.New("must be a string")
+		}
+		if len(f.OneOf) > 0 && !slices.Contains(f.OneOf, str) {
+			return nil, fmt.Errorf("must be one of %v", f.OneOf)
+		}
+		return str, nil
+
+	case FieldInt, FieldUint, FieldFloat:
+		number, ok := value.(float64)
+		if !ok {
+			return nil, errors.New("must be a number")
+		}
+		if f.Min != nil && number < *f.Min {
+			return nil, fmt.Errorf("must be at least %v", *f.Min)
+		}
+		if f.Kind == FieldFloat {
+			return number, nil
+		}
+		if number != math.Trunc(number) {
+			return nil, errors.New("must be a whole number")
+		}
+		if f.Kind == FieldUint {
+			if number < 0 {
+				return nil, errors.New("can not be negative")
+			}
+			return uint(number), nil
+		}
+		return int(number), nil
+
+	case FieldBool:
+		boolean, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("must be true or false")
+		}
+		return boolean, nil
+
+	case FieldJSON:
+		switch value.(type) {
+		case map[string]any, []any:
+		default:
+			return nil, errors.New("must be a json object or array")
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return datatypes.JSON(raw), nil
+	}
+	return nil, errors.New("has an unknown type")
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// QuestionEdit fixes a question of a running quiz, only the fields that are set are changed.
+type QuestionEdit struct {
+	QuestionID    int      `json:"question_id"`
+	Text          *string  `json:"text"`
+	Options       []any    `json:"options"` // replaces every option, answer key included
+	CorrectAnswer *float64 `json:"correct_answer"`
+	Points        *float64 `json:"points"`
+}
+
+// UpdateQuestion applies change to a copy of the quiz json and returns the copy with the changed
+// question. The original is left untouched since it is read without locks while the quiz runs.
+func UpdateQuestion(quizJson map[string]any, questionID int, change func(question map[string]any) error) (map[string]any, map[string]any, error) {
+	data, err := json.Marshal(quizJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	var updated map[string]any
+	if err := json.Unmarshal(data, &updated); err != nil {
+		return nil, nil, err
+	}
+	question, exists := FindQuestion(updated, questionID)
+	if !exists {
+		return nil, nil, errors.New("question not found")
+	}
+	if err := change(question); err != nil {
+		return nil, nil, err
+	}
+	return updated, question, nil
+}
+
+func (edit QuestionEdit) Apply(question map[string]any) error {
+	if edit.Text == nil && edit.Options == nil && edit.CorrectAnswer == nil && edit.Points == nil {
+		return errors.New("nothing to change")
+	}
+	if edit.Text != nil {
+		question["text"] = *edit.Text
+	}
+	if edit.Options != nil {
+		for _, option := range edit.Options {
+			if _, ok := option.(map[string]any); !ok {
+				return errors.New(`options must look like {"option": "...", "correct": true}`)
+			}
+		}
+		question["options"] = edit.Options
+	}
+	if edit.CorrectAnswer != nil {
+		question["correct_answer"] = *edit.CorrectAnswer
+	}
+	if edit.Points != nil {
+		if *edit.Points < 0 {
+			return errors.New("points cannot be negative")
+		}
+		question["points"] = *edit.Points
+	}
+	return nil
+}
+
+// IsVoided is true for questions the teacher dropped from scoring.
+func IsVoided(question map[string]any) bool {
+	voided, _ := question["voided"].(bool)
+	return voided
+}
+
+// isAcceptedAnswer checks the extra answers the teacher accepted on top of the answer key.
+func isAcceptedAnswer(question map[string]any, answer any) bool {
+	accepted, ok := question["accepted_answers"].([]any)
+	if !ok {
+		return false
+	}
+	key := answerKey(answer)
+	for _, acceptedAnswer := range accepted {
+		if answerKey(acceptedAnswer) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Regrade grades every submitted answer to the question again after it changed. Caller must hold the lock.
+func (session *QuizSession) Regrade(questionID int, question map[string]any) int {
+	regraded := 0
+	for userID, answers := range session.Answers {
+		answer, ok := answers[questionID]
+		if !ok {
+			continue
+		}
+		if _, exists := session.Scores[userID]; !exists {
+			session.Scores[userID] = make(map[int]int)
+		}
+		session.Scores[userID][questionID], _ = GradeAnswer(question, answer.Answer)
+		regraded++
+	}
+	return regraded
+}
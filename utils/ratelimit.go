@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LimiterStore keeps the counters of the rate limiter and the account lockouts. The in-memory
+// store is enough for one instance, the redis store shares them between instances.
+type LimiterStore interface {
+	// Incr counts one hit in the fixed window that starts with the key's first hit, and returns
+	// the hits so far and the time left until the window resets.
+	Incr(key string, window time.Duration) (int64, time.Duration, error)
+	// Block marks the key for the duration, BlockedFor returns how much of it is left.
+	Block(key string, duration time.Duration) error
+	BlockedFor(key string) (time.Duration, error)
+	Delete(keys ...string) error
+}
+
+// Limiter is the store the rate limit middleware and the login lockout use, main switches it
+// to redis when REDIS_URL is set.
+var Limiter LimiterStore = NewMemoryLimiterStore()
+
+// RequestIP is the caller's address. X-Forwarded-For is only trusted with TRUST_PROXY_HEADERS=yes,
+// otherwise anyone could dodge the per IP limits by sending it.
+func RequestIP(r *http.Request) string {
+	if strings.ToLower(os.Getenv("TRUST_PROXY_HEADERS")) == "yes" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type limiterEntry struct {
+	count     int64
+	expiresAt time.Time
+}
+
+type MemoryLimiterStore struct {
+	entries map[string]limiterEntry
+	hits    int
+	sync.Mutex
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{entries: make(map[string]limiterEntry)}
+}
+
+// sweepLocked drops expired entries every so often so the map does not grow forever.
+func (m *MemoryLimiterStore) sweepLocked(now time.Time) {
+	m.hits++
+	if m.hits%1000 != 0 {
+		return
+	}
+	for key, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func (m *MemoryLimiterStore) Incr(key string, window time.Duration) (int64, time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.sweepLocked(now)
+	entry, ok := m.entries[key]
+	if !ok || now.After(entry.expiresAt) {
+		entry = limiterEntry{expiresAt: now.Add(window)}
+	}
+	entry.count++
+	m.entries[key] = entry
+	return entry.count, entry.expiresAt.Sub(now), nil
+}
+
+func (m *MemoryLimiterStore) Block(key string, duration time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[key] = limiterEntry{count: 1, expiresAt: time.Now().Add(duration)}
+	return nil
+}
+
+func (m *MemoryLimiterStore) BlockedFor(key string) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	if left := time.Until(entry.expiresAt); left > 0 {
+		return left, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryLimiterStore) Delete(keys ...string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// RedisLimiterStore works with redis or anything speaking its protocol (e.g. valkey, dragonfly).
+type RedisLimiterStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisLimiterStore connects to a redis url such as redis://localhost:6379/0.
+func NewRedisLimiterStore(redisURL string) (*RedisLimiterStore, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &RedisLimiterStore{client: client, prefix: "quizzer:limit:"}, nil
+}
+
+func (s *RedisLimiterStore) Incr(key string, window time.Duration) (int64, time.Duration, error) {
+	ctx := context.Background()
+	key = s.prefix + key
+	count, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 1 {
+		if err := s.client.PExpire(ctx, key, window).Err(); err != nil {
+			return 0, 0, err
+		}
+		return count, window, nil
+	}
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	// The expiry got lost (e.g. a crash between INCR and PEXPIRE), start the window again.
+	if ttl < 0 {
+		if err := s.client.PExpire(ctx, key, window).Err(); err != nil {
+			return 0, 0, err
+		}
+		ttl = window
+	}
+	return count, ttl, nil
+}
+
+func (s *RedisLimiterStore) Block(key string, duration time.Duration) error {
+	return s.client.Set(context.Background(), s.prefix+key, 1, duration).Err()
+}
+
+func (s *RedisLimiterStore) BlockedFor(key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(context.Background(), s.prefix+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// A missing key has a negative ttl.
+	return max(ttl, 0), nil
+}
+
+func (s *RedisLimiterStore) Delete(keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.prefix + key
+	}
+	return s.client.Del(context.Background(), prefixed...).Err()
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"OnlineQuizSystem/models"
+)
+
+// Permission is something a role may do. Routes declare the permission they need in main.go
+// and the api policy middleware enforces it.
+type Permission string
+
+const (
+	PermAccount Permission = "account" // own profile, logout and quiz websockets
+
+	PermUserCreate Permission = "user.create"
+	PermUserRead   Permission = "user.read"
+	PermUserUpdate Permission = "user.update"
+	PermUserDelete Permission = "user.delete"
+
+	PermUserDetailsCreate Permission = "user_details.create"
+	PermUserDetailsRead   Permission = "user_details.read"
+	PermUserDetailsUpdate Permission = "user_details.update"
+	PermUserDetailsDelete Permission = "user_details.delete"
+
+	PermQuizEventCreate Permission = "quiz_event.create"
+	PermQuizEventRead   Permission = "quiz_event.read"
+	PermQuizEventUpdate Permission = "quiz_event.update"
+	PermQuizEventDelete Permission = "quiz_event.delete"
+
+	PermEventResultCreate Permission = "event_result.create"
+	PermEventResultRead   Permission = "event_result.read"
+	PermEventResultUpdate Permission = "event_result.update"
+	PermEventResultDelete Permission = "event_result.delete"
+
+	PermAccommodationRead   Permission = "accommodation.read"
+	PermAccommodationManage Permission = "accommodation.manage"
+
+	PermQuizRun     Permission = "quiz.run"    // start, end, pause, resume, extend and display the quiz
+	PermQuizReview  Permission = "quiz.review" // messages, regrade history and calibration of a quiz
+	PermQuizRegrade Permission = "quiz.regrade"
+	PermQuizJoin    Permission = "quiz.join"
+
+	PermTwoFactorReset Permission = "two_factor.reset"
+
+	PermInvitationManage Permission = "invitation.manage" // own scope: department heads, see api.CreateInvitationHandler
+	PermRoleAuditRead    Permission = "role_audit.read"
+
+	PermServiceAccountManage Permission = "service_account.manage"
+	PermAPIKeyManage         Permission = "api_key.manage" // own scope: keys of the user and their service accounts
+
+	PermSigningKeyManage Permission = "signing_key.manage"
+)
+
+// Scope is how far a permission reaches.
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	// ScopeOwn only covers resources the user owns, e.g. the quiz events a teacher created
+	// or the results of those quizzes.
+	ScopeOwn
+	ScopeAny
+)
+
+func grantAll(scope Scope, permissions ...Permission) map[Permission]Scope {
+	grants := make(map[Permission]Scope, len(permissions))
+	for _, permission := range permissions {
+		grants[permission] = scope
+	}
+	return grants
+}
+
+func merge(grants ...map[Permission]Scope) map[Permission]Scope {
+	merged := make(map[Permission]Scope)
+	for _, grant := range grants {
+		for permission, scope := range grant {
+			merged[permission] = scope
+		}
+	}
+	return merged
+}
+
+// RolePermissions is the permission model, a role that is not listed here can do nothing.
+var RolePermissions = map[string]map[Permission]Scope{
+	"admin": grantAll(ScopeAny,
+		PermAccount,
+		PermUserCreate, PermUserRead, PermUserUpdate, PermUserDelete,
+		PermUserDetailsCreate, PermUserDetailsRead, PermUserDetailsUpdate, PermUserDetailsDelete,
+		PermQuizEventCreate, PermQuizEventRead, PermQuizEventUpdate, PermQuizEventDelete,
+		PermEventResultCreate, PermEventResultRead, PermEventResultUpdate, PermEventResultDelete,
+		PermAccommodationRead, PermAccommodationManage,
+		PermQuizRun, PermQuizReview, PermQuizRegrade, PermQuizJoin,
+		PermTwoFactorReset, PermInvitationManage, PermRoleAuditRead,
+		PermServiceAccountManage, PermAPIKeyManage, PermSigningKeyManage,
+	),
+	"teacher": merge(
+		grantAll(ScopeAny, PermAccount, PermQuizJoin, PermAccommodationRead),
+		grantAll(ScopeOwn,
+			PermAccommodationManage,
+			PermUserRead, PermUserUpdate,
+			PermUserDetailsCreate, PermUserDetailsRead, PermUserDetailsUpdate,
+			PermQuizEventCreate, PermQuizEventRead, PermQuizEventUpdate, PermQuizEventDelete,
+			PermEventResultCreate, PermEventResultRead, PermEventResultUpdate,
+			PermQuizRun, PermQuizReview, PermQuizRegrade,
+			PermInvitationManage,
+			PermServiceAccountManage, PermAPIKeyManage,
+		),
+	),
+	"student": merge(
+		grantAll(ScopeAny, PermAccount, PermQuizJoin),
+		grantAll(ScopeOwn,
+			PermUserRead, PermUserUpdate,
+			PermUserDetailsCreate, PermUserDetailsRead, PermUserDetailsUpdate,
+			PermQuizEventRead, PermEventResultRead,
+			PermAccommodationRead,
+		),
+	),
+}
+
+// PermissionScope is how far the role's grant of the permission reaches.
+func PermissionScope(role string, permission Permission) Scope {
+	return RolePermissions[role][permission]
+}
+
+// CredentialScope is PermissionScope for a request made with an API key: the key only reaches
+// as far as the role does, and not at all for permissions outside the key's scopes.
+func CredentialScope(role string, apiKey *models.APIKey, permission Permission) Scope {
+	if apiKey != nil && !slices.Contains(APIKeyScopes(apiKey), permission) {
+		return ScopeNone
+	}
+	return PermissionScope(role, permission)
+}
+
+type authContextKey struct{}
+
+type authContext struct {
+	user    *models.User
+	session *models.AuthSession
+	apiKey  *models.APIKey
+	scope   Scope
+}
+
+// WithAuth remembers the authorized user on the request, so handlers behind the policy
+// middleware do not look the token up again.
+func WithAuth(r *http.Request, user *models.User, session *models.AuthSession, apiKey *models.APIKey, scope Scope) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authContextKey{}, &authContext{user: user, session: session, apiKey: apiKey, scope: scope}))
+}
+
+func authFromContext(r *http.Request) *authContext {
+	auth, _ := r.Context().Value(authContextKey{}).(*authContext)
+	return auth
+}
+
+// RequestScope is the scope the policy middleware granted for the route's permission. List and
+// create handlers use it to limit ScopeOwn callers to their own resources.
+func RequestScope(r *http.Request) Scope {
+	if auth := authFromContext(r); auth != nil {
+		return auth.scope
+	}
+	return ScopeNone
+}
+
+// RequestAPIKey is the API key the request was made with, nil for a login.
+func RequestAPIKey(r *http.Request) *models.APIKey {
+	if auth := authFromContext(r); auth != nil {
+		return auth.apiKey
+	}
+	return nil
+}
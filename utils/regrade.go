@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+	"OnlineQuizSystem/socManager"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// RegradeRequest optionally changes the answer key of one question, then grades the stored
+// submissions again, for that question only or, without a question_id, for the whole quiz run.
+type RegradeRequest struct {
+	QuestionID    *int          `json:"question_id"`
+	Reason        string        `json:"reason"`
+	Edit          *QuestionEdit `json:"edit"`
+	Voided        *bool         `json:"voided"`
+	AcceptAnswers []any         `json:"accept_answers"`
+}
+
+type RegradeDiff struct {
+	UserID     uint `json:"user_id"`
+	Before     int  `json:"before"`
+	After      int  `json:"after"`
+	TeamBefore *int `json:"team_before,omitempty"`
+	TeamAfter  *int `json:"team_after,omitempty"`
+}
+
+var ErrQuizNotEnded = errors.New("only ended quizzes can be regraded, fix questions of a running quiz live instead")
+
+// storedAnalytics is the part of EventResult.ExtraInfoJson (see calculateResults) regrading needs.
+type storedAnalytics struct {
+	Answers map[int]QuizAnswer `json:"Answers"`
+	Points  map[int]int        `json:"Points"`
+}
+
+func (req RegradeRequest) changesKey() bool {
+	return req.Edit != nil || req.Voided != nil || len(req.AcceptAnswers) > 0
+}
+
+func (req RegradeRequest) applyTo(question map[string]any) error {
+	if req.Edit != nil {
+		if err := req.Edit.Apply(question); err != nil {
+			return err
+		}
+	}
+	if req.Voided != nil {
+		question["voided"] = *req.Voided
+	}
+	if len(req.AcceptAnswers) > 0 {
+		accepted, _ := question["accepted_answers"].([]any)
+		question["accepted_answers"] = append(accepted, req.AcceptAnswers...)
+	}
+	return nil
+}
+
+// RegradeQuiz re-runs grading of an ended quiz against the submissions stored in its results,
+// updates the results and records the regrade with a before/after diff per student.
+func RegradeQuiz(quizEvent models.QuizEvent, regradedBy uint, req RegradeRequest) (*models.QuizRegrade, []RegradeDiff, error) {
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		return nil, nil, errors.New("a reason is required")
+	}
+
+	oldJson, err := quizEvent.GetQuizJsonFileMap()
+	if err != nil {
+		return nil, nil, err
+	}
+	if oldJson["status"] != "completed" {
+		return nil, nil, ErrQuizNotEnded
+	}
+
+	var oldQuestion map[string]any
+	if req.QuestionID != nil {
+		question, exists := FindQuestion(oldJson, *req.QuestionID)
+		if !exists {
+			return nil, nil, errors.New("question not found")
+		}
+		oldQuestion = question
+	} else if req.changesKey() {
+		return nil, nil, errors.New("question_id is required to change the answer key")
+	}
+
+	newJson := oldJson
+	if req.changesKey() {
+		newJson, _, err = UpdateQuestion(oldJson, *req.QuestionID, req.applyTo)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// Numbers read back from the json file are float64, calculateResults expects the start time as int64.
+	startTime, _ := newJson["event_start_time"].(float64)
+	newJson["event_start_time"] = int64(startTime)
+
+	var results []models.EventResult
+	if err := db.DB.Where("quiz_event_id = ?", quizEvent.ID).Find(&results).Error; err != nil {
+		return nil, nil, err
+	}
+
+	diffs := make([]RegradeDiff, 0, len(results))
+	session := NewQuizSession(int64(startTime))
+	for i := range results {
+		result := &results[i]
+		if result.ExtraInfoJson == nil {
+			continue
+		}
+		var stored storedAnalytics
+		var analytics map[string]any
+		if err := json.Unmarshal(*result.ExtraInfoJson, &stored); err != nil {
+			log.Printf("Skipping result %d in regrade, unreadable analytics: %v", result.ID, err)
+			continue
+		}
+		json.Unmarshal(*result.ExtraInfoJson, &analytics)
+		if stored.Answers == nil {
+			continue
+		}
+		session.Answers[result.UserID] = stored.Answers
+
+		score, fresh := calculateResults(stored.Answers, newJson)
+		if fresh == nil {
+			continue
+		}
+		if req.QuestionID != nil {
+			// Only the regraded question moves, every other question keeps the points it was given.
+			freshPoints, _ := fresh["Points"].(map[string]any)
+			newPoints, _ := freshPoints[strconv.Itoa(*req.QuestionID)].(float64)
+			oldPoints, graded := stored.Points[*req.QuestionID]
+			if !graded {
+				if answer, answered := stored.Answers[*req.QuestionID]; answered {
+					oldPoints, _ = GradeAnswer(oldQuestion, answer.Answer)
+				}
+			}
+			score = result.ExpScore - oldPoints + int(newPoints)
+		}
+		// Keep what grading does not produce, the team and the questions flagged for review.
+		for key, value := range analytics {
+			if _, recomputed := fresh[key]; !recomputed {
+				fresh[key] = value
+			}
+		}
+
+		freshBytes, _ := json.Marshal(fresh)
+		freshJson := datatypes.JSON(freshBytes)
+		diffs = append(diffs, RegradeDiff{UserID: result.UserID, Before: result.ExpScore, After: score})
+		result.ExpScore = score
+		result.ExtraInfoJson = &freshJson
+	}
+
+	diffs = regradeTeams(results, session, newJson, diffs)
+
+	keyChangeBytes, _ := json.Marshal(req)
+	keyChange := datatypes.JSON(keyChangeBytes)
+	diffBytes, _ := json.Marshal(diffs)
+	diffJson := datatypes.JSON(diffBytes)
+	regrade := models.QuizRegrade{
+		QuizEventID: quizEvent.ID,
+		RegradedBy:  regradedBy,
+		QuestionID:  req.QuestionID,
+		Reason:      req.Reason,
+		Diff:        &diffJson,
+	}
+	if req.changesKey() {
+		regrade.KeyChange = &keyChange
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		for i := range results {
+			if err := tx.Save(&results[i]).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&regrade).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.changesKey() {
+		if _, err := quizEvent.SetQuizJsonFileMap(newJson); err != nil {
+			log.Printf("Regrade %d saved, but the changed answer key of quiz %d was not: %v", regrade.ID, quizEvent.ID, err)
+		}
+	}
+	return &regrade, diffs, nil
+}
+
+// regradeTeams scores the teams again from their members' stored answers. Teams are rebuilt from
+// the team names on the results, the captain is not stored but under the captain rule only the
+// captain's answers were taken, so the first answer rule picks the same ones.
+func regradeTeams(results []models.EventResult, session *QuizSession, quizJson map[string]any, diffs []RegradeDiff) []RegradeDiff {
+	options := GetTeamOptions(quizJson)
+	if !options.Enabled {
+		return diffs
+	}
+	rule := options.Rule
+	if rule == TeamRuleCaptain {
+		rule = TeamRuleFirstAnswer
+	}
+
+	teams := make(map[string]*socManager.Team)
+	for _, result := range results {
+		if result.TeamName == nil {
+			continue
+		}
+		team, exists := teams[*result.TeamName]
+		if !exists {
+			team = &socManager.Team{Name: *result.TeamName}
+			teams[*result.TeamName] = team
+		}
+		team.Members = append(team.Members, result.UserID)
+	}
+
+	teamScores := make(map[string]int)
+	for name, team := range teams {
+		teamScores[name], _ = session.TeamScore(*team, quizJson, rule)
+	}
+
+	for i := range results {
+		result := &results[i]
+		if result.TeamName == nil {
+			continue
+		}
+		before := 0
+		if result.TeamScore != nil {
+			before = *result.TeamScore
+		}
+		after := teamScores[*result.TeamName]
+		result.TeamScore = &after
+		setAnalyticsTeamScore(result, after)
+		found := false
+		for j := range diffs {
+			if diffs[j].UserID == result.UserID {
+				diffs[j].TeamBefore = &before
+				diffs[j].TeamAfter = &after
+				found = true
+			}
+		}
+		if !found {
+			// Members that never answered themselves only have a team score.
+			diffs = append(diffs, RegradeDiff{UserID: result.UserID, Before: result.ExpScore, After: result.ExpScore, TeamBefore: &before, TeamAfter: &after})
+		}
+	}
+	return diffs
+}
+
+// setAnalyticsTeamScore keeps the team entry of the result's analytics in line with its team score.
+func setAnalyticsTeamScore(result *models.EventResult, score int) {
+	if result.ExtraInfoJson == nil {
+		return
+	}
+	var analytics map[string]any
+	if err := json.Unmarshal(*result.ExtraInfoJson, &analytics); err != nil {
+		return
+	}
+	team, ok := analytics["Team"].(map[string]any)
+	if !ok {
+		return
+	}
+	team["score"] = score
+	analyticsBytes, err := json.Marshal(analytics)
+	if err != nil {
+		return
+	}
+	analyticsJson := datatypes.JSON(analyticsBytes)
+	result.ExtraInfoJson = &analyticsJson
+}
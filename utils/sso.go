@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var ErrSSOEmailUnverified = errors.New("the identity provider did not verify this email, it can not be used to sign in")
+
+// MapSSORole picks the role of a new single sign-on user from the IdP claim named by
+// SSO_ROLE_CLAIM (default "groups", a string or a list). Values listed in SSO_ADMIN_VALUES or
+// SSO_TEACHER_VALUES map to those roles, everyone else becomes a student.
+func MapSSORole(claims map[string]any) string {
+	claimName := os.Getenv("SSO_ROLE_CLAIM")
+	if claimName == "" {
+		claimName = "groups"
+	}
+	var values []string
+	switch claim := claims[claimName].(type) {
+	case string:
+		values = strings.Fields(strings.ReplaceAll(claim, ",", " "))
+	case []any:
+		for _, value := range claim {
+			if str, ok := value.(string); ok {
+				values = append(values, str)
+			}
+		}
+	}
+
+	matches := func(envName string) bool {
+		for _, wanted := range strings.Split(os.Getenv(envName), ",") {
+			if wanted = strings.TrimSpace(wanted); wanted != "" && slices.Contains(values, wanted) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case matches("SSO_ADMIN_VALUES"):
+		return "admin"
+	case matches("SSO_TEACHER_VALUES"):
+		return "teacher"
+	}
+	return "student"
+}
+
+// ProvisionSSOUser finds the user an external identity belongs to. A known identity logs its
+// user in, an unknown one needs an IdP verified email: it is linked to the account with that
+// email, or a new account is created just in time with the mapped role. The role is only mapped on creation,
+// later role changes are made in this system.
+func ProvisionSSOUser(identity *ExternalIdentity) (*models.User, error) {
+	var user models.User
+	now := time.Now()
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var login models.ExternalLogin
+		err := tx.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&login).Error
+		if err == nil {
+			if err := tx.First(&user, login.UserID).Error; err != nil {
+				return err
+			}
+			return tx.Model(&login).Updates(map[string]any{"last_login": &now, "email": identity.Email}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		email := normalizeEmail(identity.Email)
+		if email == "" {
+			return errors.New("the identity provider did not share an email")
+		}
+		// Whoever controls an unverified address at the IdP must not get the account of, or
+		// an account as, its owner here.
+		if !identity.EmailVerified {
+			return ErrSSOEmailUnverified
+		}
+		err = tx.Where("email = ?", email).First(&user).Error
+		switch {
+		case err == nil:
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := createSSOUser(tx, &user, email, identity); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		return tx.Create(&models.ExternalLogin{
+			UserID:    user.ID,
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+			Email:     email,
+			LastLogin: &now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func createSSOUser(tx *gorm.DB, user *models.User, email string, identity *ExternalIdentity) error {
+	// Nobody knows this password, a password login needs the forgot password flow first.
+	randomPassword, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	*user = models.User{Email: email, Password: string(hashedPassword), UserType: MapSSORole(identity.Claims)}
+	if err := tx.Create(user).Error; err != nil {
+		return err
+	}
+	details := models.UserDetails{UserID: user.ID, FullName: identity.Name}
+	if department, ok := identity.Claims["department"].(string); ok && department != "" {
+		details.Department = &department
+	}
+	if err := tx.Create(&details).Error; err != nil {
+		return err
+	}
+	return RecordRoleChange(tx, user.ID, "", user.UserType, nil, RoleSourceSSO, nil)
+}
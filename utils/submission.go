@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"time"
+)
+
+type SubmissionOptions struct {
+	ShowResult bool `json:"show_result"` // students see their score as soon as they submit
+	AutoEnd    bool `json:"auto_end"`    // the quiz ends once every participant has submitted
+}
+
+// GetSubmissionOptions reads the optional "submission" block of a quiz json, both are off by default.
+func GetSubmissionOptions(quizJson map[string]any) SubmissionOptions {
+	var options SubmissionOptions
+	raw, ok := quizJson["submission"].(map[string]any)
+	if !ok {
+		return options
+	}
+	if showResult, ok := raw["show_result"].(bool); ok {
+		options.ShowResult = showResult
+	}
+	if autoEnd, ok := raw["auto_end"].(bool); ok {
+		options.AutoEnd = autoEnd
+	}
+	return options
+}
+
+// MarkSubmitted finalizes a student's attempt, it returns when they submitted and whether
+// this call did it. Caller must hold the lock.
+func (session *QuizSession) MarkSubmitted(userID uint) (int64, bool) {
+	if submittedAt, submitted := session.Submitted[userID]; submitted {
+		return submittedAt, false
+	}
+	submittedAt := time.Now().UnixMilli()
+	session.Submitted[userID] = submittedAt
+	return submittedAt, true
+}
+
+// IsSubmitted is true once the student submitted, caller must hold the lock.
+func (session *QuizSession) IsSubmitted(userID uint) bool {
+	_, submitted := session.Submitted[userID]
+	return submitted
+}
+
+// AttemptResult grades one student's answers the way the final results will. Caller must hold the lock.
+func (session *QuizSession) AttemptResult(userID uint, quizJson map[string]any) (int, map[string]any) {
+	quizData := make(map[string]any, len(quizJson)+1)
+	for key, value := range quizJson {
+		quizData[key] = value
+	}
+	quizData["event_start_time"] = session.StartTime
+	return calculateResults(session.Answers[userID], quizData)
+}
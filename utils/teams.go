@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"OnlineQuizSystem/socManager"
+)
+
+// How a team's answer to a question is picked from its members' answers.
+const (
+	TeamRuleCaptain     = "captain"      // only the captain can answer
+	TeamRuleMajority    = "majority"     // every member answers, the most given answer counts
+	TeamRuleFirstAnswer = "first_answer" // the first member to answer answers for the team
+)
+
+type TeamOptions struct {
+	Enabled bool   `json:"enabled"`
+	Rule    string `json:"rule"`
+	Count   int    `json:"count"` // number of teams when they are auto-balanced
+}
+
+type TeamLeaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	TeamID   int    `json:"team_id"`
+	Name     string `json:"name"`
+	Score    int    `json:"score"`
+	Answered int    `json:"answered"`
+	Members  int    `json:"members"`
+}
+
+// GetTeamOptions reads the optional "teams" block of a quiz json, quizzes are played individually by default.
+func GetTeamOptions(quizJson map[string]any) TeamOptions {
+	options := TeamOptions{Rule: TeamRuleCaptain, Count: 2}
+	raw, ok := quizJson["teams"].(map[string]any)
+	if !ok {
+		return options
+	}
+	if enabled, ok := raw["enabled"].(bool); ok {
+		options.Enabled = enabled
+	}
+	if rule, ok := raw["rule"].(string); ok {
+		switch strings.TrimSpace(strings.ToLower(rule)) {
+		case TeamRuleMajority:
+			options.Rule = TeamRuleMajority
+		case TeamRuleFirstAnswer:
+			options.Rule = TeamRuleFirstAnswer
+		}
+	}
+	if count, ok := raw["count"].(float64); ok && count >= 1 {
+		options.Count = int(count)
+	}
+	return options
+}
+
+// CheckTeamAnswer returns a reject reason when the team rule does not let this member answer
+// the question, or "" when the answer can be taken. Caller must hold the lock.
+func (session *QuizSession) CheckTeamAnswer(userID uint, team socManager.Team, questionID int, rule string) string {
+	switch rule {
+	case TeamRuleCaptain:
+		if userID != team.Captain {
+			return RejectNotTeamCaptain
+		}
+	case TeamRuleFirstAnswer:
+		for _, memberID := range team.Members {
+			if _, answered := session.Answers[memberID][questionID]; answered && memberID != userID {
+				return RejectTeamAlreadyAnswered
+			}
+		}
+	}
+	return ""
+}
+
+// TeamAnswer is the answer that counts for the team. With the majority rule ties go to
+// the answer that was given first. Caller must hold the lock.
+func (session *QuizSession) TeamAnswer(team socManager.Team, questionID int, rule string) (QuizAnswer, bool) {
+	if rule == TeamRuleCaptain {
+		answer, ok := session.Answers[team.Captain][questionID]
+		return answer, ok
+	}
+
+	answers := make([]QuizAnswer, 0, len(team.Members))
+	for _, memberID := range team.Members {
+		if answer, ok := session.Answers[memberID][questionID]; ok {
+			answers = append(answers, answer)
+		}
+	}
+	if len(answers) == 0 {
+		return QuizAnswer{}, false
+	}
+	sort.Slice(answers, func(i, j int) bool { return answers[i].Timestamp < answers[j].Timestamp })
+	if rule == TeamRuleFirstAnswer {
+		return answers[0], true
+	}
+
+	votes := make(map[string]int)
+	topVotes := 0
+	for _, answer := range answers {
+		key := answerKey(answer.Answer)
+		votes[key]++
+		if votes[key] > topVotes {
+			topVotes = votes[key]
+		}
+	}
+	// answers are in time order, so on a tie the answer given first wins.
+	for _, answer := range answers {
+		if votes[answerKey(answer.Answer)] == topVotes {
+			return answer, true
+		}
+	}
+	return answers[0], true
+}
+
+// answerKey makes equal answers compare equal whatever the case or order of the options.
+func answerKey(answer any) string {
+	if selected, ok := answer.([]any); ok {
+		options := make([]string, 0, len(selected))
+		for _, option := range selected {
+			options = append(options, normalizeOption(option))
+		}
+		sort.Strings(options)
+		return strings.Join(options, "\x00")
+	}
+	data, _ := json.Marshal(answer)
+	return string(data)
+}
+
+// TeamScore grades the team's answer to every question. Caller must hold the lock.
+func (session *QuizSession) TeamScore(team socManager.Team, quizJson map[string]any, rule string) (int, map[int]QuizAnswer) {
+	answered := make(map[int]bool)
+	for _, memberID := range team.Members {
+		for questionID := range session.Answers[memberID] {
+			answered[questionID] = true
+		}
+	}
+
+	score := 0
+	teamAnswers := make(map[int]QuizAnswer)
+	for questionID := range answered {
+		answer, ok := session.TeamAnswer(team, questionID, rule)
+		if !ok {
+			continue
+		}
+		teamAnswers[questionID] = answer
+		if question, exists := FindQuestion(quizJson, questionID); exists {
+			points, _ := GradeAnswer(question, answer.Answer)
+			score += points
+		}
+	}
+	return score, teamAnswers
+}
+
+// BuildTeamLeaderboard ranks teams by score. Caller must hold the session lock.
+func (session *QuizSession) BuildTeamLeaderboard(teams []socManager.Team, quizJson map[string]any, rule string) []TeamLeaderboardEntry {
+	entries := make([]TeamLeaderboardEntry, 0, len(teams))
+	for _, team := range teams {
+		score, answers := session.TeamScore(team, quizJson, rule)
+		entries = append(entries, TeamLeaderboardEntry{
+			TeamID:   team.ID,
+			Name:     team.Name,
+			Score:    score,
+			Answered: len(answers),
+			Members:  len(team.Members),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].TeamID < entries[j].TeamID
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+type teamResult struct {
+	TeamID int    `json:"team_id"`
+	Name   string `json:"name"`
+	Score  int    `json:"score"`
+}
+
+// teamResultsOf scores every team of the room and returns the result of each member,
+// it is empty when the quiz was not played in teams.
+func teamResultsOf(session *QuizSession, room *socManager.Room, quizData map[string]any) map[uint]teamResult {
+	results := make(map[uint]teamResult)
+	if room == nil {
+		return results
+	}
+	options := GetTeamOptions(quizData)
+	if !options.Enabled {
+		return results
+	}
+	for _, team := range room.GetTeams() {
+		score, _ := session.TeamScore(team, quizData, options.Rule)
+		for _, memberID := range team.Members {
+			results[memberID] = teamResult{TeamID: team.ID, Name: team.Name, Score: score}
+		}
+	}
+	return results
+}
@@ -0,0 +1,420 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"OnlineQuizSystem/db"
+	"OnlineQuizSystem/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app understands: SHA1, 6 digits,
+// 30 second steps. One step of clock drift either way is accepted.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpIssuer        = "OnlineQuizSystem"
+	recoveryCodeCount = 10
+
+	twoFactorSecretPurpose = "two-factor"
+
+	TwoFactorChallengeTTL = 5 * time.Minute
+
+	// At most this many codes are checked per user in TwoFactorAttemptWindow, so a stolen access
+	// token or challenge can not brute force the 6 digits.
+	TwoFactorMaxAttempts   = 5
+	TwoFactorAttemptWindow = 15 * time.Minute
+)
+
+var (
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not set up")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorInvalidCode = errors.New("invalid two-factor code")
+	ErrTwoFactorRequired    = errors.New("two-factor authentication is required for your role")
+	ErrInvalidChallenge     = errors.New("invalid or expired two-factor challenge, please log in again")
+	ErrTwoFactorLocked      = errors.New("too many two-factor codes tried, please wait before trying again")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorRequired tells whether users of the role must use 2FA, the roles are listed in
+// TWO_FACTOR_REQUIRED_ROLES (e.g. "admin,teacher"). For everyone else it is optional.
+func TwoFactorRequired(role string) bool {
+	for _, required := range strings.Split(os.Getenv("TWO_FACTOR_REQUIRED_ROLES"), ",") {
+		if strings.TrimSpace(strings.ToLower(required)) == role {
+			return true
+		}
+	}
+	return false
+}
+
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code belongs to, or false when it matches none near now.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// secretCipher encrypts secrets stored in the database with a key derived from SECRET_KEY, the
+// purpose keeps the keys for two-factor secrets and signing keys apart.
+func secretCipher(purpose string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(purpose + ":" + os.Getenv("SECRET_KEY")))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(purpose string, secret []byte) (string, error) {
+	gcm, err := secretCipher(purpose)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptSecret(purpose string, encrypted string) ([]byte, error) {
+	gcm, err := secretCipher(purpose)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(raw) < gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt %s secret", purpose)
+	}
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+}
+
+// GetTwoFactor returns nil, nil when the user never started enrolling.
+func GetTwoFactor(userID uint) (*models.TwoFactorAuth, error) {
+	var twoFactor models.TwoFactorAuth
+	err := db.DB.Where("user_id = ?", userID).First(&twoFactor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &twoFactor, nil
+}
+
+func TwoFactorEnabled(userID uint) (bool, error) {
+	twoFactor, err := GetTwoFactor(userID)
+	if err != nil {
+		return false, err
+	}
+	return twoFactor != nil && twoFactor.Enabled, nil
+}
+
+// StartTwoFactorEnrollment creates a new secret for the user, it is not used until confirmed
+// with ConfirmTwoFactorEnrollment. The otpauth url is what the enrollment QR code encodes.
+func StartTwoFactorEnrollment(user *models.User) (string, string, error) {
+	existing, err := GetTwoFactor(user.ID)
+	if err != nil {
+		return "", "", err
+	}
+	if existing != nil && existing.Enabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encrypted, err := encryptSecret(twoFactorSecretPurpose, secret)
+	if err != nil {
+		return "", "", err
+	}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&models.TwoFactorAuth{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.TwoFactorAuth{UserID: user.ID, EncryptedSecret: encrypted}).Error
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	encodedSecret := base32NoPadding.EncodeToString(secret)
+	query := url.Values{}
+	query.Set("secret", encodedSecret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	otpauthURL := fmt.Sprintf("otpauth://totp/%s:%s?%s", totpIssuer, url.PathEscape(user.Email), query.Encode())
+	return encodedSecret, otpauthURL, nil
+}
+
+// ConfirmTwoFactorEnrollment enables 2FA once the user proves the app works, and returns the
+// recovery codes. They are only shown this once.
+func ConfirmTwoFactorEnrollment(userID uint, code string) ([]string, error) {
+	twoFactor, err := GetTwoFactor(userID)
+	if err != nil {
+		return nil, err
+	}
+	if twoFactor == nil {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if twoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err := reserveTwoFactorAttempt(userID); err != nil {
+		return nil, err
+	}
+	if err := useTOTP(twoFactor, code); err != nil {
+		return nil, err
+	}
+	clearTwoFactorAttempts(userID)
+
+	now := time.Now()
+	if err := db.DB.Model(twoFactor).Updates(map[string]any{"enabled": true, "enabled_at": &now}).Error; err != nil {
+		return nil, err
+	}
+	return RegenerateRecoveryCodes(userID)
+}
+
+func twoFactorAttemptsKey(userID uint) string {
+	return fmt.Sprintf("2fa-attempts:%d", userID)
+}
+
+// reserveTwoFactorAttempt counts a code before it is checked, so parallel requests can not get
+// past the limit. A right code clears the count.
+func reserveTwoFactorAttempt(userID uint) error {
+	attempts, _, err := Limiter.Incr(twoFactorAttemptsKey(userID), TwoFactorAttemptWindow)
+	if err != nil {
+		return err
+	}
+	if attempts > TwoFactorMaxAttempts {
+		return ErrTwoFactorLocked
+	}
+	return nil
+}
+
+func clearTwoFactorAttempts(userID uint) {
+	if err := Limiter.Delete(twoFactorAttemptsKey(userID)); err != nil {
+		log.Println("Could not clear the two-factor attempts: ", err)
+	}
+}
+
+// useTOTP checks the code and marks its time step as used, so the same code can not log in twice.
+func useTOTP(twoFactor *models.TwoFactorAuth, code string) error {
+	secret, err := decryptSecret(twoFactorSecretPurpose, twoFactor.EncryptedSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrTwoFactorInvalidCode
+	}
+	result := db.DB.Model(&models.TwoFactorAuth{}).
+		Where("id = ? AND last_used_step < ?", twoFactor.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTwoFactorInvalidCode
+	}
+	return nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user, only their hashes are stored.
+func RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32NoPadding.EncodeToString(buf))[:10]
+		code := raw[:5] + "-" + raw[5:]
+		if slices.Contains(codes, code) {
+			continue
+		}
+		codes = append(codes, code)
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))})
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code, or a recovery code when code is empty. A recovery code
+// is used up.
+func VerifySecondFactor(userID uint, code string, recoveryCode string) error {
+	twoFactor, err := GetTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+	if twoFactor == nil || !twoFactor.Enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+	if err := reserveTwoFactorAttempt(userID); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(code) != "" {
+		if err := useTOTP(twoFactor, code); err != nil {
+			return err
+		}
+		clearTwoFactorAttempts(userID)
+		return nil
+	}
+
+	now := time.Now()
+	result := db.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(recoveryCode))).
+		Update("used_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTwoFactorInvalidCode
+	}
+	clearTwoFactorAttempts(userID)
+	return nil
+}
+
+// RemainingRecoveryCodes is how many unused recovery codes the user has left.
+func RemainingRecoveryCodes(userID uint) (int64, error) {
+	var count int64
+	err := db.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// DisableTwoFactor removes the user's secret and recovery codes, e.g. when an admin resets a
+// lost device.
+func DisableTwoFactor(userID uint) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.TwoFactorAuth{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// IssueTwoFactorChallenge is the intermediate token a password login gets when a second factor
+// is needed. It has no "id" or "sid" claim, so it is useless as an access token. Its jti makes
+// it single-use, see SpendTwoFactorChallenge.
+func IssueTwoFactorChallenge(userID uint) (string, error) {
+	challengeID, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	return Keys.Sign(TokenTypeTwoFactorChallenge, jwt.MapClaims{
+		"challenge": userID,
+		"purpose":   "2fa",
+		"jti":       challengeID,
+		"exp":       time.Now().Add(TwoFactorChallengeTTL).Unix(),
+	})
+}
+
+func parseChallengeClaims(challengeToken string) (jwt.MapClaims, string, error) {
+	token, err := Keys.Parse(challengeToken, TokenTypeTwoFactorChallenge)
+	if err != nil || !token.Valid {
+		return nil, "", ErrInvalidChallenge
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != "2fa" {
+		return nil, "", ErrInvalidChallenge
+	}
+	challengeID, ok := claims["jti"].(string)
+	if !ok || challengeID == "" {
+		return nil, "", ErrInvalidChallenge
+	}
+	return claims, "2fa-challenge:" + challengeID, nil
+}
+
+// ParseTwoFactorChallenge returns the user who passed the password step, as long as the
+// challenge was not spent on a finished login yet.
+func ParseTwoFactorChallenge(challengeToken string) (*models.User, error) {
+	claims, spentKey, err := parseChallengeClaims(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	if spent, err := Limiter.BlockedFor(spentKey); err != nil || spent > 0 {
+		return nil, ErrInvalidChallenge
+	}
+	userIDFloat, ok := claims["challenge"].(float64)
+	if !ok {
+		return nil, ErrInvalidChallenge
+	}
+
+	var user models.User
+	if err := db.DB.First(&user, uint(userIDFloat)).Error; err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	return &user, nil
+}
+
+// SpendTwoFactorChallenge uses the challenge up once it finished a login. Of two requests racing
+// with the same challenge only the first gets through.
+func SpendTwoFactorChallenge(challengeToken string) error {
+	_, spentKey, err := parseChallengeClaims(challengeToken)
+	if err != nil {
+		return err
+	}
+	uses, _, err := Limiter.Incr(spentKey, TwoFactorChallengeTTL)
+	if err != nil {
+		return err
+	}
+	if uses > 1 {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
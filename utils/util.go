@@ -5,8 +5,11 @@ import (
 	"os"
 	"log"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 	"errors"
+	"slices"
 	"strings"
 	"net/http"
 	"net/smtp"
@@ -123,43 +126,121 @@ func SendOtpEmail(toEmail string, otp string, subject string) error {
 
 
 
+// AuthorizeUser is the caller of the request. Behind the policy middleware (api.Require) that is
+// whoever it let through, including the user of an API key whose scopes allow the route; elsewhere
+// only an access token is accepted.
 func AuthorizeUser(r *http.Request) (*models.User, int, error) {
+	user, _, status, err := AuthorizeSession(r)
+	return user, status, err
+}
+
+
+
+// AuthorizeSession is AuthorizeUser that also returns the login session the access token belongs to,
+// tokens of revoked sessions are refused. Outside the policy middleware API keys are refused, so
+// routes without a permission (2FA setup, websockets, SSE) need a login.
+func AuthorizeSession(r *http.Request) (*models.User, *models.AuthSession, int, error) {
+	if auth := authFromContext(r); auth != nil {
+		return auth.user, auth.session, http.StatusOK, nil
+	}
+
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return nil, http.StatusUnauthorized, errors.New("missing or invalid Authorization header")
+		return nil, nil, http.StatusUnauthorized, errors.New("missing or invalid Authorization header")
 	}
 
 	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-	secret := os.Getenv("SECRET_KEY")
-
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(secret), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if IsAPIKey(tokenStr) {
+		return nil, nil, http.StatusUnauthorized, errors.New("API keys are not accepted here, log in instead")
+	}
+	token, err := Keys.Parse(tokenStr, TokenTypeAccess)
 
 	if err != nil || !token.Valid {
-		return nil, http.StatusUnauthorized, errors.New("invalid token")
+		return nil, nil, http.StatusUnauthorized, errors.New("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return nil, http.StatusUnauthorized, errors.New("invalid token claims")
+		return nil, nil, http.StatusUnauthorized, errors.New("invalid token claims")
 	}
 
 	userIDFloat, ok := claims["id"].(float64)
 	if !ok {
-		return nil, http.StatusUnauthorized, errors.New("user ID not found in token")
+		return nil, nil, http.StatusUnauthorized, errors.New("user ID not found in token")
 	}
 	userID := uint(userIDFloat)
 
+	sessionIDFloat, ok := claims["sid"].(float64)
+	if !ok {
+		return nil, nil, http.StatusUnauthorized, errors.New("session not found in token, please log in again")
+	}
+	session, err := activeSession(uint(sessionIDFloat), userID)
+	if err != nil {
+		return nil, nil, http.StatusUnauthorized, err
+	}
+
 	var user models.User
 	if err := db.DB.Preload("UserDetails").Preload("QuizEvents").Preload("EventResults").First(&user, userID).Error; err != nil {
-		return nil, http.StatusUnauthorized, errors.New("user not found")
+		return nil, nil, http.StatusUnauthorized, errors.New("user not found")
 	}
 
-	return &user, http.StatusOK, nil
+	return &user, session, http.StatusOK, nil
+}
+
+
+
+
+// AuthorizeRequest is AuthorizeSession that also accepts API keys, in the X-API-Key header or as
+// the bearer token. Requests made with a key have no session but carry the key, whose scopes
+// limit what the policy layer lets through.
+func AuthorizeRequest(r *http.Request) (*models.User, *models.AuthSession, *models.APIKey, int, error) {
+	if auth := authFromContext(r); auth != nil {
+		return auth.user, auth.session, auth.apiKey, http.StatusOK, nil
+	}
+
+	if key, ok := requestAPIKey(r); ok {
+		user, apiKey, err := authorizeAPIKey(r, key)
+		if err != nil {
+			return nil, nil, nil, http.StatusUnauthorized, err
+		}
+		return user, nil, apiKey, http.StatusOK, nil
+	}
+
+	user, session, status, err := AuthorizeSession(r)
+	return user, session, nil, status, err
+}
+
+
+
+
+// GenerateDisplayToken issues a token that only lets a projector watch one room.
+// It carries no user id, so it can never be used against the REST apis.
+func GenerateDisplayToken(quizEventID uint, channelCode string) (string, error) {
+	return Keys.Sign(TokenTypeDisplay, jwt.MapClaims{
+		"display":       channelCode,
+		"quiz_event_id": quizEventID,
+		"exp":           time.Now().Add(12 * time.Hour).Unix(),
+	})
+}
+
+
+
+func ValidateDisplayToken(tokenStr string, channelCode string) error {
+	token, err := Keys.Parse(tokenStr, TokenTypeDisplay)
+
+	if err != nil || !token.Valid {
+		return errors.New("invalid display token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return errors.New("invalid display token claims")
+	}
+
+	if display, ok := claims["display"].(string); !ok || display != channelCode {
+		return errors.New("display token is not valid for this room")
+	}
+	return nil
 }
 
 
@@ -221,11 +302,269 @@ type QuizAnswer struct {
 	QuestionID int    `json:"question_id"`
 	Answer     any    `json:"answer"`
 	Timestamp  int64  `json:"timestamp"`
+	Confidence *int   `json:"confidence,omitempty"` // MinConfidence..MaxConfidence, optional
+	Flagged    *bool  `json:"flagged,omitempty"`    // marks (or unmarks) the question for review, left as is when missing
+	OpenedAt   int64  `json:"-"`                    // unix millis the question opened at, set by the server
+}
+
+// ResponseMillis is how long the student took to answer once the question was open.
+func (answer QuizAnswer) ResponseMillis() int64 {
+	if answer.Timestamp > answer.OpenedAt {
+		return answer.Timestamp - answer.OpenedAt
+	}
+	return 0
 }
 
+// SessionsLock guards the quizEventID -> session map of the running quizzes, kept by the
+// sockets package and handed to PrepareEndQuiz.
+var SessionsLock sync.Mutex
+
 type QuizSession struct {
 	sync.Mutex
-	Answers map[uint]map[int]QuizAnswer // userID -> questionID -> answer
+	Answers   map[uint]map[int]QuizAnswer // userID -> questionID -> answer
+	Scores    map[uint]map[int]int        // userID -> questionID -> points awarded so far
+	Changes   map[uint]map[int]int        // userID -> questionID -> times the answer was changed
+	StartTime int64                       // unix millis the quiz was started at
+	Nicknames map[uint]string             // userID -> display name cache for the leaderboard
+	Pseudonyms map[uint]string            // userID -> anonymous leaderboard name, unique in the quiz
+	Flags     map[uint]map[int]bool       // userID -> questionID -> marked for review
+	Submitted map[uint]int64              // userID -> unix millis the student submitted the quiz at
+}
+
+
+func NewQuizSession(startTime int64) *QuizSession {
+	return &QuizSession{
+		Answers:   make(map[uint]map[int]QuizAnswer),
+		Scores:    make(map[uint]map[int]int),
+		Changes:   make(map[uint]map[int]int),
+		StartTime: startTime,
+		Nicknames: make(map[uint]string),
+		Pseudonyms: make(map[uint]string),
+		Flags:     make(map[uint]map[int]bool),
+		Submitted: make(map[uint]int64),
+	}
+}
+
+
+// SetFlag marks a question for review, or clears the mark. Caller must hold the lock.
+func (session *QuizSession) SetFlag(userID uint, questionID int, flagged bool) {
+	if _, exists := session.Flags[userID]; !exists {
+		session.Flags[userID] = make(map[int]bool)
+	}
+	if flagged {
+		session.Flags[userID][questionID] = true
+	} else {
+		delete(session.Flags[userID], questionID)
+	}
+}
+
+
+// FlaggedQuestions returns the questions the student marked for review, in order. Caller must hold the lock.
+func (session *QuizSession) FlaggedQuestions(userID uint) []int {
+	flagged := make([]int, 0, len(session.Flags[userID]))
+	for questionID := range session.Flags[userID] {
+		flagged = append(flagged, questionID)
+	}
+	sort.Ints(flagged)
+	return flagged
+}
+
+
+// RecordAnswer stores the answer and grades it straight away against the question,
+// so that standings are available while the quiz is still running. Caller must hold the lock.
+func (session *QuizSession) RecordAnswer(userID uint, answer QuizAnswer, question map[string]any) int {
+	if _, exists := session.Answers[userID]; !exists {
+		session.Answers[userID] = make(map[int]QuizAnswer)
+	}
+	if _, exists := session.Scores[userID]; !exists {
+		session.Scores[userID] = make(map[int]int)
+	}
+	if _, exists := session.Changes[userID]; !exists {
+		session.Changes[userID] = make(map[int]int)
+	}
+	if _, answered := session.Answers[userID][answer.QuestionID]; answered {
+		session.Changes[userID][answer.QuestionID]++
+	}
+	session.Answers[userID][answer.QuestionID] = answer
+	if answer.Flagged != nil {
+		session.SetFlag(userID, answer.QuestionID, *answer.Flagged)
+	}
+
+	points := 0
+	if question != nil {
+		points, _ = GradeAnswer(question, answer.Answer)
+	}
+	session.Scores[userID][answer.QuestionID] = points
+	return points
+}
+
+
+// AnswerDistribution counts how many students picked each option (or numeric value) of a question.
+// Caller must hold the lock.
+func (session *QuizSession) AnswerDistribution(questionID int) map[string]int {
+	distribution := make(map[string]int)
+	for _, answers := range session.Answers {
+		ans, ok := answers[questionID]
+		if !ok || ans.Answer == nil {
+			continue
+		}
+		switch value := ans.Answer.(type) {
+		case []any:
+			for _, option := range value {
+				distribution[normalizeOption(option)]++
+			}
+		default:
+			distribution[fmt.Sprint(value)]++
+		}
+	}
+	return distribution
+}
+
+
+func FindQuestion(quizJson map[string]any, questionID int) (map[string]any, bool) {
+	questions, ok := quizJson["questions"].([]any)
+	if !ok {
+		return nil, false
+	}
+	for _, q := range questions {
+		question, ok := q.(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, ok := question["id"].(float64); ok && int(id) == questionID {
+			return question, true
+		}
+	}
+	return nil, false
+}
+
+
+// answerKeyFields give away the answers, PublicQuizJson leaves them out.
+var answerKeyFields = []string{"correct", "correct_answer", "answer", "accepted", "accepted_answers"}
+
+// PublicQuizJson is a copy of the quiz without the answer key, for screens everybody can see.
+// The quiz itself is left untouched.
+func PublicQuizJson(quizJson map[string]any) map[string]any {
+	if quizJson == nil {
+		return nil
+	}
+	public, _ := withoutAnswerKey(quizJson).(map[string]any)
+	return public
+}
+
+func withoutAnswerKey(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(v))
+		for key, field := range v {
+			if slices.Contains(answerKeyFields, key) {
+				continue
+			}
+			copied[key] = withoutAnswerKey(field)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(v))
+		for i, item := range v {
+			copied[i] = withoutAnswerKey(item)
+		}
+		return copied
+	}
+	return value
+}
+
+
+func normalizeOption(value any) string {
+	str, _ := value.(string)
+	return strings.TrimSpace(strings.ToLower(str))
+}
+
+
+// selectedOption is true when the idx-th selected option is this one.
+func selectedOption(option map[string]any, selected []any, idx int) bool {
+	if idx >= len(selected) {
+		return false
+	}
+	answer, ok := selected[idx].(string)
+	return ok && normalizeOption(option["option"]) == answer
+}
+
+
+// GradeAnswer returns the points earned for a single answer and whether it was fully correct.
+// Selected options are compared with the trimmed, lower case option text.
+// mcq: first selected option must be a correct one.
+// msq: selected options are matched in the order of the options, +points for every correct
+// option selected, -points for every wrong option selected.
+// numeric: answer must equal correct_answer.
+// Voided questions are worth nothing, answers listed in accepted_answers get the full points.
+func GradeAnswer(question map[string]any, answer any) (int, bool) {
+	if answer == nil || IsVoided(question) {
+		return 0, false
+	}
+	pointsFloat, _ := question["points"].(float64)
+	points := int(pointsFloat)
+	if isAcceptedAnswer(question, answer) {
+		return points, true
+	}
+	qType, _ := question["type"].(string)
+
+	switch strings.TrimSpace(strings.ToLower(qType)) {
+	case "mcq":
+		selected, ok := answer.([]any)
+		if !ok || len(selected) == 0 {
+			return 0, false
+		}
+		options, _ := question["options"].([]any)
+		for _, optionMap := range options {
+			option, ok := optionMap.(map[string]any)
+			if !ok {
+				continue
+			}
+			opCorrectness, _ := option["correct"].(bool)
+			if opCorrectness && selectedOption(option, selected, 0) {
+				return points, true
+			}
+		}
+		return 0, false
+	case "msq":
+		selected, ok := answer.([]any)
+		if !ok || len(selected) == 0 {
+			return 0, false
+		}
+		score := 0
+		allCorrect := true
+		next := 0 // the next selected option to match
+		options, _ := question["options"].([]any)
+		for _, optionMap := range options {
+			option, ok := optionMap.(map[string]any)
+			if !ok {
+				continue
+			}
+			opCorrectness, _ := option["correct"].(bool)
+			if selectedOption(option, selected, next) {
+				next++
+				if opCorrectness {
+					score += points
+				} else {
+					score -= points
+					allCorrect = false
+				}
+			} else if opCorrectness {
+				allCorrect = false
+			}
+		}
+		return score, allCorrect && next == len(selected)
+	case "numeric":
+		value, ok := answer.(float64)
+		if !ok {
+			return 0, false
+		}
+		if correctAns, ok := question["correct_answer"].(float64); ok && value == correctAns {
+			return points, true
+		}
+		return 0, false
+	}
+	return 0, false
 }
 
 
@@ -255,10 +594,14 @@ func FinalizeQuiz(quizEventID uint, activeSessions *map[uint]*QuizSession) {
 	log.Println("Starting FinalizeQuiz function .....")
 
 	log.Println("getting quizEvent answers from activeSessions .....")
+	SessionsLock.Lock()
 	session, exists := (*activeSessions)[quizEventID]
+	SessionsLock.Unlock()
 	if !exists {
 		return
 	}
+	session.Lock()
+	defer session.Unlock()
 
 	
 	
@@ -279,16 +622,22 @@ func FinalizeQuiz(quizEventID uint, activeSessions *map[uint]*QuizSession) {
 	log.Println("Getting socket manager .....")
 	manager := socManager.GetManager()
 	room, _ := manager.GetRoom(*quizEvent.ChannelCode)
-	quizData["event_start_time"] = room.EventStartTime
-	quizData["event_end_time"] = room.EventEndTime
+	quizData["event_start_time"], quizData["event_end_time"] = room.EventTimes()
 
 	quizEvent.SetQuizJsonFileMap(quizData)
 	log.Println("quizEvent's quizData: ", quizData)
 
+	teamResults := teamResultsOf(session, room, quizData)
+
 	for userID, answers := range session.Answers {
 		log.Println("\tuserID : ", userID)
 		log.Println("\tanswers : ", answers)
 		score, analytics := calculateResults(answers, quizData)
+		teamResult, inTeam := teamResults[userID]
+		if inTeam {
+			analytics["Team"] = teamResult
+		}
+		analytics["Flagged"] = session.FlaggedQuestions(userID)
 		analyticsByted, _ := json.Marshal(analytics)
 		analyticsJson := datatypes.JSON(analyticsByted)
 		log.Println("\tscore : ", score)
@@ -298,6 +647,10 @@ func FinalizeQuiz(quizEventID uint, activeSessions *map[uint]*QuizSession) {
 			ExpScore:      score,
 			ExtraInfoJson: &analyticsJson,
 		}
+		if inTeam {
+			result.TeamName = &teamResult.Name
+			result.TeamScore = &teamResult.Score
+		}
 
 		if err := db.DB.Create(&result).Error; err != nil {
 			log.Printf("Error saving final result: %v", err)
@@ -306,7 +659,26 @@ func FinalizeQuiz(quizEventID uint, activeSessions *map[uint]*QuizSession) {
 	}
 
 
+	// Members that never answered themselves (e.g. under the captain rule) still get their team's score.
+	for userID, teamResult := range teamResults {
+		if _, answered := session.Answers[userID]; answered {
+			continue
+		}
+		teamResult := teamResult
+		result := models.EventResult{
+			UserID:      userID,
+			QuizEventID: quizEventID,
+			TeamName:    &teamResult.Name,
+			TeamScore:   &teamResult.Score,
+		}
+		if err := db.DB.Create(&result).Error; err != nil {
+			log.Printf("Error saving team result: %v", err)
+		}
+	}
+
+	SessionsLock.Lock()
 	delete(*activeSessions, quizEventID)
+	SessionsLock.Unlock()
 	log.Println("Ending FinalizeQuiz function .....")
 }
 
@@ -317,6 +689,8 @@ func calculateResults(answers map[int]QuizAnswer, quizData map[string]any) (int,
 		CorrectCount  int
 		WrongCount    int
 		TimeStats     map[int]float64
+		Points        map[int]int // questionID -> points awarded, used when a single question is regraded
+		Calibration   Calibration // confidence against correctness
 	}
 
 	score := 0
@@ -325,6 +699,7 @@ func calculateResults(answers map[int]QuizAnswer, quizData map[string]any) (int,
 		CorrectCount: 	 0,
 		WrongCount:      0,
 		TimeStats:       make(map[int]float64),
+		Points:          make(map[int]int),
 	}
 
 	var prevTimeStat float64 = 0.0
@@ -333,66 +708,27 @@ func calculateResults(answers map[int]QuizAnswer, quizData map[string]any) (int,
 	for qIDx, q := range questions {
 		question := q.(map[string]any)
 		qID := int(question["id"].(float64))
+		if IsVoided(question) {
+			continue
+		}
 		ans, exists := answers[qID]
 		if !exists || ans.Answer == nil {
 			analytics.WrongCount = analytics.WrongCount + 1
 			continue
 		}
 
-		switch strings.TrimSpace(strings.ToLower(question["type"].(string))) {
-		case "mcq":
-			options := question["options"].([]any)
-			for _, optionMap := range options {
-				opVal := strings.TrimSpace(strings.ToLower(optionMap.(map[string]any)["option"].(string)))
-				opCorrectness := optionMap.(map[string]any)["correct"].(bool)
-				if opCorrectness && opVal == analytics.Answers[qID].Answer.([]any)[0].(string) {
-					score += int(question["points"].(float64))
-					analytics.CorrectCount = analytics.CorrectCount + 1	
-				} else {
-					analytics.WrongCount = analytics.WrongCount + 1
-				}
-			}
-		case "msq":
-			options := question["options"].([]any)
-			tmpIdxCount := 0
-			ans, exists := answers[qID]
-			if !exists || ans.Answer == nil {
-				analytics.WrongCount = analytics.WrongCount + 1
-				continue
-			}
-			for _, optionMap := range options {
-				opVal := strings.TrimSpace(strings.ToLower(optionMap.(map[string]any)["option"].(string)))
-				opCorrectness := optionMap.(map[string]any)["correct"].(bool)
-				
-				if opCorrectness && tmpIdxCount < len(analytics.Answers[qID].Answer.([]any)) && opVal == answers[qID].Answer.([]any)[tmpIdxCount].(string) {
-					score += int(question["points"].(float64))
-					analytics.CorrectCount = analytics.CorrectCount + 1
-					tmpIdxCount++
-				} else if !opCorrectness && tmpIdxCount < len(answers[qID].Answer.([]any)) && opVal == answers[qID].Answer.([]any)[tmpIdxCount].(string) {
-					score -= int(question["points"].(float64))
-					analytics.WrongCount = analytics.WrongCount + 1
-					tmpIdxCount++
-				}
-			}
-		case "numeric":
-			ans, exists := answers[qID]
-			if !exists || ans.Answer == nil {
-				analytics.WrongCount = analytics.WrongCount + 1
-				continue
-			}
-			correctAns := question["correct_answer"]
-			if ans, exists := answers[qID]; exists {
-				if ans.Answer.(float64) == correctAns {
-					score += int(question["points"].(float64))
-					analytics.CorrectCount = analytics.CorrectCount + 1
-				} else {
-					analytics.WrongCount = analytics.WrongCount + 1
-				}
-			}
+		points, correct := GradeAnswer(question, ans.Answer)
+		score += points
+		analytics.Points[qID] = points
+		if correct {
+			analytics.CorrectCount = analytics.CorrectCount + 1
+		} else {
+			analytics.WrongCount = analytics.WrongCount + 1
 		}
 		analytics.TimeStats[qIDx] = float64((answers[qID].Timestamp - quizData["event_start_time"].(int64)) / 1000.0) - prevTimeStat
 		prevTimeStat = analytics.TimeStats[qIDx]
 	}
+	analytics.Calibration = StudentCalibration(answers, quizData)
 	log.Println("Ending calculateResults function .....")
 	mapified, err := StructToMap(analytics)
 	if err != nil {
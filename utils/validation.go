@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Reasons sent back to the student in an answer_rejected message.
+const (
+	RejectInvalidPayload      = "invalid_payload"
+	RejectQuizNotRunning      = "quiz_not_running"
+	RejectUnknownQuestion     = "unknown_question"
+	RejectDeadlinePassed      = "deadline_passed"
+	RejectQuestionNotOpen     = "question_not_open"
+	RejectQuestionClosed      = "question_closed"
+	RejectAnswerLocked        = "answer_locked"
+	RejectChangeLimitReached  = "change_limit_reached"
+	RejectAlreadySubmitted    = "already_submitted"
+	RejectQuestionVoided      = "question_voided"
+	RejectNotAdmitted         = "not_admitted"
+	RejectNotInTeam           = "not_in_team"
+	RejectNotTeamCaptain      = "not_team_captain"
+	RejectTeamAlreadyAnswered = "team_already_answered"
+)
+
+const (
+	AnswerPolicyAllow            = "allow"
+	AnswerPolicyFirstAnswerLocks = "first_answer_locks"
+	AnswerPolicyLimit            = "limit"
+)
+
+type AnswerPolicy struct {
+	Mode       string `json:"mode"`
+	MaxChanges int    `json:"max_changes"` // only used with the "limit" mode
+}
+
+// GetAnswerPolicy reads the optional "answer_policy" block of a quiz json, answers can be changed freely by default.
+func GetAnswerPolicy(quizJson map[string]any) AnswerPolicy {
+	policy := AnswerPolicy{Mode: AnswerPolicyAllow}
+	raw, ok := quizJson["answer_policy"].(map[string]any)
+	if !ok {
+		return policy
+	}
+	if mode, ok := raw["mode"].(string); ok {
+		switch strings.TrimSpace(strings.ToLower(mode)) {
+		case AnswerPolicyFirstAnswerLocks:
+			policy.Mode = AnswerPolicyFirstAnswerLocks
+		case AnswerPolicyLimit:
+			policy.Mode = AnswerPolicyLimit
+		}
+	}
+	if maxChanges, ok := raw["max_changes"].(float64); ok && maxChanges >= 0 {
+		policy.MaxChanges = int(maxChanges)
+	}
+	return policy
+}
+
+// QuestionWindow returns the unix millis a question opens and closes at. Questions can carry an
+// optional "window" : {"open": secs, "close": secs} relative to the quiz start, a missing bound
+// is returned as 0 and means the question is open from the start / until the student's deadline.
+func QuestionWindow(question map[string]any, startTime int64) (int64, int64) {
+	window, ok := question["window"].(map[string]any)
+	if !ok {
+		return 0, 0
+	}
+	var opensAt, closesAt int64
+	if open, ok := window["open"].(float64); ok {
+		opensAt = startTime + int64(open*1000)
+	}
+	if close, ok := window["close"].(float64); ok {
+		closesAt = startTime + int64(close*1000)
+	}
+	return opensAt, closesAt
+}
+
+// CheckAnswerChange returns a reject reason when the policy does not allow the student to
+// (re-)answer the question, or "" when the answer can be taken. Caller must hold the lock.
+func (session *QuizSession) CheckAnswerChange(userID uint, questionID int, policy AnswerPolicy) string {
+	if _, answered := session.Answers[userID][questionID]; !answered {
+		return ""
+	}
+	switch policy.Mode {
+	case AnswerPolicyFirstAnswerLocks:
+		return RejectAnswerLocked
+	case AnswerPolicyLimit:
+		if session.Changes[userID][questionID] >= policy.MaxChanges {
+			return RejectChangeLimitReached
+		}
+	}
+	return ""
+}